@@ -0,0 +1,71 @@
+package authorization_tools
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+var ErrDeletionNotScheduled = errors.New("удаление учетной записи не запланировано")
+
+// ScheduleAccountDeletion назначает удаление учётной записи на время at и завершает все её сессии
+func ScheduleAccountDeletion(userID int, at time.Time, db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`UPDATE users SET deletion_scheduled_at = ? WHERE id = ?`, at, userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM refresh_tokens WHERE user_id = ?`, userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// PendingDeletion возвращает время, на которое назначено удаление учётной записи
+func PendingDeletion(username string, db *sql.DB) (time.Time, bool, error) {
+	var at sql.NullTime
+	err := db.QueryRow(`SELECT deletion_scheduled_at FROM users WHERE username = ?`, username).Scan(&at)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	return at.Time, at.Valid, nil
+}
+
+// CancelAccountDeletion отменяет назначенное удаление, пока оно не выполнено
+func CancelAccountDeletion(userID int, db *sql.DB) error {
+	res, err := db.Exec(`UPDATE users SET deletion_scheduled_at = NULL WHERE id = ? AND deletion_scheduled_at IS NOT NULL`, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrDeletionNotScheduled
+	}
+	return nil
+}
+
+// DueAccountDeletions возвращает id учётных записей, срок удаления которых наступил
+func DueAccountDeletions(db *sql.DB) ([]int, error) {
+	rows, err := db.Query(`SELECT id, deletion_scheduled_at FROM users WHERE deletion_scheduled_at IS NOT NULL`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	now := time.Now()
+	var due []int
+	for rows.Next() {
+		var id int
+		var at time.Time
+		if err := rows.Scan(&id, &at); err != nil {
+			return nil, err
+		}
+		if !now.Before(at) {
+			due = append(due, id)
+		}
+	}
+	return due, rows.Err()
+}
@@ -0,0 +1,225 @@
+package authorization_tools
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// apiKeyPrefix отличает API-ключ от JWT в заголовке Authorization и в параметре token
+const apiKeyPrefix = "bk_"
+
+// Области действия API-ключей
+const (
+	ScopeMessagesRead  = "messages:read"  // чтение чатов, сообщений и вложений, получение событий по /ws
+	ScopeMessagesWrite = "messages:write" // отправка, изменение и удаление сообщений, загрузка вложений
+)
+
+var knownScopes = []string{ScopeMessagesRead, ScopeMessagesWrite}
+
+var (
+	ErrAPIKeyInvalid = errors.New("неверный API-ключ")
+	// ErrAPIKeyDisabled — бот или его владелец заблокирован модератором либо удаляет учётную запись
+	ErrAPIKeyDisabled = errors.New("учетная запись бота или его владельца заблокирована")
+	ErrUnknownScope   = errors.New("неизвестная область действия")
+)
+
+// APIKey — сведения о ключе без самого ключа: он показывается один раз при создании
+type APIKey struct {
+	ID         int        `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+// IsAPIKey сообщает, что строка из Authorization — API-ключ, а не JWT
+func IsAPIKey(token string) bool {
+	return strings.HasPrefix(token, apiKeyPrefix)
+}
+
+// ValidateScopes проверяет, что все области действия известны, и убирает повторы
+func ValidateScopes(scopes []string) ([]string, error) {
+	if len(scopes) == 0 {
+		return nil, fmt.Errorf("%w: нужно указать хотя бы одну из %s", ErrUnknownScope, strings.Join(knownScopes, ", "))
+	}
+	seen := make(map[string]bool)
+	var result []string
+	for _, scope := range scopes {
+		known := false
+		for _, k := range knownScopes {
+			known = known || k == scope
+		}
+		if !known {
+			return nil, fmt.Errorf("%w: %q", ErrUnknownScope, scope)
+		}
+		if !seen[scope] {
+			seen[scope] = true
+			result = append(result, scope)
+		}
+	}
+	return result, nil
+}
+
+// HasScope сообщает, разрешена ли ключу область действия
+func HasScope(scopes []string, scope string) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// CreateBot регистрирует бота владельца ownerID. Войти под ботом по паролю нельзя,
+// он работает только через API-ключи.
+func CreateBot(ownerID int, username, displayName string, db *sql.DB) (int, error) {
+	secret, err := newOpaqueToken()
+	if err != nil {
+		return 0, err
+	}
+	hash, err := HashPassword(secret)
+	if err != nil {
+		return 0, err
+	}
+
+	// Адрес с двоеточием не пройдёт проверку почты, поэтому не совпадёт с адресом человека
+	res, err := db.Exec(`
+		INSERT INTO users (username, email, password, role, display_name, bot_owner_id, email_verified_at)
+		VALUES (?, ?, ?, 'bot', NULLIF(?, ''), ?, ?)`,
+		username, "bot:"+username, hash, displayName, ownerID, time.Now())
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	return int(id), err
+}
+
+// CountBots возвращает число ботов владельца
+func CountBots(ownerID int, db *sql.DB) (int, error) {
+	var n int
+	err := db.QueryRow(`SELECT COUNT(*) FROM users WHERE bot_owner_id = ?`, ownerID).Scan(&n)
+	return n, err
+}
+
+// BotOwnedBy возвращает id бота с именем username, если он принадлежит ownerID
+func BotOwnedBy(ownerID int, username string, db *sql.DB) (int, error) {
+	var id int
+	err := db.QueryRow(`SELECT id FROM users WHERE username = ? AND bot_owner_id = ?`, username, ownerID).Scan(&id)
+	return id, err
+}
+
+// CreateAPIKey выпускает ключ бота. В базе хранится только хеш, ключ возвращается один раз.
+func CreateAPIKey(botID int, name string, scopes []string, db *sql.DB) (string, APIKey, error) {
+	secret, err := newOpaqueToken()
+	if err != nil {
+		return "", APIKey{}, err
+	}
+	key := apiKeyPrefix + secret
+
+	k := APIKey{
+		Name:      name,
+		Prefix:    key[:len(apiKeyPrefix)+8],
+		Scopes:    scopes,
+		CreatedAt: time.Now(),
+	}
+	res, err := db.Exec(`
+		INSERT INTO api_keys (user_id, name, prefix, key_hash, scopes, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)`,
+		botID, name, k.Prefix, HashToken(key), strings.Join(scopes, ","), k.CreatedAt)
+	if err != nil {
+		return "", APIKey{}, err
+	}
+	id, err := res.LastInsertId()
+	k.ID = int(id)
+	return key, k, err
+}
+
+// ListAPIKeys возвращает ключи бота
+func ListAPIKeys(botID int, db *sql.DB) ([]APIKey, error) {
+	rows, err := db.Query(`
+		SELECT id, name, prefix, scopes, created_at, last_used_at
+		FROM api_keys WHERE user_id = ? ORDER BY id`, botID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []APIKey{}
+	for rows.Next() {
+		var k APIKey
+		var scopes string
+		var lastUsedAt sql.NullTime
+		if err := rows.Scan(&k.ID, &k.Name, &k.Prefix, &scopes, &k.CreatedAt, &lastUsedAt); err != nil {
+			return nil, err
+		}
+		k.Scopes = strings.Split(scopes, ",")
+		if lastUsedAt.Valid {
+			k.LastUsedAt = &lastUsedAt.Time
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+// RevokeAPIKey удаляет ключ бота, found == false — такого ключа у бота нет
+func RevokeAPIKey(botID, keyID int, db *sql.DB) (bool, error) {
+	res, err := db.Exec(`DELETE FROM api_keys WHERE id = ? AND user_id = ?`, keyID, botID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// AuthenticateAPIKey находит бота по ключу и возвращает его id, имя, id ключа и области действия.
+// Ключ не действует, пока бот или его владелец заблокирован или ожидает удаления.
+func AuthenticateAPIKey(key string, db *sql.DB) (userID int, username string, keyID int, scopes []string, err error) {
+	var rawScopes string
+	var disabled bool
+	err = db.QueryRow(`
+		SELECT k.id, k.scopes, u.id, u.username,
+			u.suspended_at IS NOT NULL OR u.deletion_scheduled_at IS NOT NULL OR
+			o.suspended_at IS NOT NULL OR o.deletion_scheduled_at IS NOT NULL
+		FROM api_keys k
+		JOIN users u ON u.id = k.user_id
+		LEFT JOIN users o ON o.id = u.bot_owner_id
+		WHERE k.key_hash = ?`, HashToken(key)).
+		Scan(&keyID, &rawScopes, &userID, &username, &disabled)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, "", 0, nil, ErrAPIKeyInvalid
+	}
+	if err != nil {
+		return 0, "", 0, nil, err
+	}
+	if disabled {
+		return 0, "", 0, nil, ErrAPIKeyDisabled
+	}
+
+	if _, err := db.Exec(`UPDATE api_keys SET last_used_at = ? WHERE id = ?`, time.Now(), keyID); err != nil {
+		return 0, "", 0, nil, err
+	}
+	return userID, username, keyID, strings.Split(rawScopes, ","), nil
+}
+
+// OwnedBots возвращает id ботов владельца
+func OwnedBots(ownerID int, db *sql.DB) ([]int, error) {
+	rows, err := db.Query(`SELECT id FROM users WHERE bot_owner_id = ?`, ownerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
@@ -2,21 +2,85 @@ package authorization_tools
 
 import (
 	"database/sql"
+	"errors"
+	"log"
+	"time"
 )
 
-func FindUsername(username string, db *sql.DB) (string, string, error) {
-	var userName string
+// FindUsername возвращает id пользователя и хеш его пароля
+func FindUsername(username string, db *sql.DB) (int, string, error) {
+	var id int
 	var password string
-	var salt string
-	row := db.QueryRow("SELECT username, password, salt FROM users WHERE username=?", username)
-	err := row.Scan(&userName, &password, &salt)
+	err := db.QueryRow("SELECT id, password FROM users WHERE username=?", username).Scan(&id, &password)
+	return id, password, err
+}
+
+// CheckPassword проверяет пароль пользователя. Для неизвестного имени возвращает false без ошибки:
+// вызывающий код не должен отличать его от неверного пароля.
+// Хеш, сделанный с устаревшими параметрами, после успешной проверки пересчитывается по текущей политике.
+func CheckPassword(username, password string, db *sql.DB) (bool, error) {
+	id, storedHash, err := FindUsername(username, db)
+	if errors.Is(err, sql.ErrNoRows) {
+		// Хешируем впустую, чтобы ответ для несуществующего пользователя занимал столько же времени
+		HashPassword(password)
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	ok, needsRehash, err := VerifyPassword(password, storedHash)
+	if err != nil || !ok {
+		return false, err
+	}
+	if needsRehash {
+		if err := rehashPassword(id, password, storedHash, db); err != nil {
+			log.Printf("Не удалось обновить хеш пароля пользователя %d: %v", id, err)
+		}
+	}
+	return true, nil
+}
+
+// rehashPassword заменяет хеш, если пароль не успели сменить параллельно
+func rehashPassword(userID int, password, oldHash string, db *sql.DB) error {
+	hash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("UPDATE users SET password=? WHERE id=? AND password=?", hash, userID, oldHash)
+	return err
+}
+
+func GetUserID(username string, db *sql.DB) (int, error) {
+	var id int
+	err := db.QueryRow("SELECT id FROM users WHERE username=?", username).Scan(&id)
+	return id, err
+}
+
+func GetUserRole(username string, db *sql.DB) (string, error) {
+	var role string
+	err := db.QueryRow("SELECT role FROM users WHERE username=?", username).Scan(&role)
+	return role, err
+}
+
+func IsSuspended(username string, db *sql.DB) (bool, error) {
+	var suspendedAt sql.NullTime
+	err := db.QueryRow("SELECT suspended_at FROM users WHERE username=?", username).Scan(&suspendedAt)
 	if err != nil {
-		return "", "", err
+		return false, err
 	}
-	return password, salt, nil
+	return suspendedAt.Valid, nil
 }
 
-func DeleteUser(username string, db *sql.DB) error {
-	_, err := db.Exec("DELETE FROM users WHERE username=?", username)
+// SuspendUser блокирует учётную запись, отзывает все её refresh токены и API-ключи
+func SuspendUser(username string, db *sql.DB) error {
+	_, err := db.Exec("UPDATE users SET suspended_at=? WHERE username=?", time.Now(), username)
+	if err != nil {
+		return err
+	}
+	if _, err := db.Exec("DELETE FROM api_keys WHERE user_id = (SELECT id FROM users WHERE username=?)", username); err != nil {
+		return err
+	}
+	_, err = RevokeAllRefreshTokens(username, db)
 	return err
 }
@@ -0,0 +1,101 @@
+package authorization_tools
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+const emailVerificationTTL = 24 * time.Hour
+
+var ErrVerificationTokenInvalid = errors.New("ссылка подтверждения недействительна или устарела")
+
+// newOpaqueToken генерирует случайный токен для ссылок из писем.
+// В базе хранится только его хеш, как и для ротированных refresh токенов.
+func newOpaqueToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// CreateEmailVerification выдаёт токен подтверждения адреса email.
+// Предыдущие неиспользованные токены пользователя аннулируются.
+func CreateEmailVerification(userID int, email string, db *sql.DB) (string, error) {
+	token, err := newOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM email_verifications WHERE user_id = ?`, userID); err != nil {
+		return "", err
+	}
+	_, err = tx.Exec(`INSERT INTO email_verifications (token_hash, user_id, email, expires_at) VALUES (?, ?, ?, ?)`,
+		HashToken(token), userID, email, time.Now().Add(emailVerificationTTL))
+	if err != nil {
+		return "", err
+	}
+	return token, tx.Commit()
+}
+
+// VerifyEmail отмечает адрес подтверждённым и возвращает имя пользователя.
+// Токен одноразовый и действует, только пока адрес в профиле не менялся.
+func VerifyEmail(token string, db *sql.DB) (string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var userID int
+	var email string
+	var expiresAt time.Time
+	err = tx.QueryRow(`SELECT user_id, email, expires_at FROM email_verifications WHERE token_hash = ?`, HashToken(token)).
+		Scan(&userID, &email, &expiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrVerificationTokenInvalid
+	}
+	if err != nil {
+		return "", err
+	}
+	if _, err := tx.Exec(`DELETE FROM email_verifications WHERE token_hash = ?`, HashToken(token)); err != nil {
+		return "", err
+	}
+	if !time.Now().Before(expiresAt) {
+		if err := tx.Commit(); err != nil {
+			return "", err
+		}
+		return "", ErrVerificationTokenInvalid
+	}
+
+	var username string
+	err = tx.QueryRow(`SELECT username FROM users WHERE id = ? AND email = ?`, userID, email).Scan(&username)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrVerificationTokenInvalid
+	}
+	if err != nil {
+		return "", err
+	}
+	if _, err := tx.Exec(`UPDATE users SET email_verified_at = ? WHERE id = ?`, time.Now(), userID); err != nil {
+		return "", err
+	}
+	return username, tx.Commit()
+}
+
+func IsEmailVerified(username string, db *sql.DB) (bool, error) {
+	var verifiedAt sql.NullTime
+	err := db.QueryRow("SELECT email_verified_at FROM users WHERE username=?", username).Scan(&verifiedAt)
+	if err != nil {
+		return false, err
+	}
+	return verifiedAt.Valid, nil
+}
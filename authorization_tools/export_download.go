@@ -0,0 +1,46 @@
+package authorization_tools
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+const exportDownloadTTL = 5 * time.Minute
+
+var ErrExportDownloadTokenInvalid = errors.New("ссылка на архив недействительна, устарела или уже использована")
+
+// CreateExportDownloadToken выдаёт одноразовый токен для скачивания готовой выгрузки без заголовка
+// Authorization. Токен привязан к выгрузке, действует только последний выданный.
+// Возвращает sql.ErrNoRows, если у пользователя нет такой выгрузки.
+func CreateExportDownloadToken(exportID, userID int, db *sql.DB) (string, time.Time, error) {
+	token, err := newOpaqueToken()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	expiresAt := time.Now().Add(exportDownloadTTL)
+
+	res, err := db.Exec(`UPDATE data_exports SET download_token_hash = ?, download_token_expires_at = ? WHERE id = ? AND user_id = ?`,
+		HashToken(token), expiresAt.Unix(), exportID, userID)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return "", time.Time{}, sql.ErrNoRows
+	}
+	return token, expiresAt, nil
+}
+
+// ConsumeExportDownloadToken расходует токен скачивания выгрузки exportID и возвращает id её владельца
+func ConsumeExportDownloadToken(exportID int, token string, db *sql.DB) (int, error) {
+	var userID int
+	err := db.QueryRow(`
+		UPDATE data_exports SET download_token_hash = NULL, download_token_expires_at = NULL
+		WHERE id = ? AND download_token_hash = ? AND download_token_expires_at >= ?
+		RETURNING user_id`,
+		exportID, HashToken(token), time.Now().Unix()).Scan(&userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrExportDownloadTokenInvalid
+	}
+	return userID, err
+}
@@ -1,26 +1,18 @@
 package authorization_tools
 
 import (
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"errors"
 	"github.com/golang-jwt/jwt/v5"
-	"github.com/joho/godotenv"
+	"github.com/google/uuid"
 	"log"
-	"os"
+	"strconv"
 	"strings"
 	"time"
 )
 
-func getJWTSecretKey() string {
-	err := godotenv.Load()
-	if err != nil {
-		log.Fatal("Ошибка при загрузке .env файла")
-	}
-
-	secretKey := os.Getenv("JWT_SECRET_KEY")
-	return secretKey
-}
-
 func ExtractToken(authorizationHeader string) (string, error) {
 	const prefix = "Bearer "
 	if authorizationHeader == "" {
@@ -34,35 +26,114 @@ func ExtractToken(authorizationHeader string) (string, error) {
 	return strings.TrimPrefix(authorizationHeader, prefix), nil
 }
 
-func GenerateAccessToken(username string) (string, error) {
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"username": username,
-		"exp":      time.Now().Add(time.Hour * 1).Unix(),
-		"type":     "access",
-	})
+// GenerateAccessToken выпускает access токен для сессии sessionID (id записи refresh токена).
+// По sid можно отозвать access токен вместе с сессией, не дожидаясь его истечения.
+// Пользователь определяется по sub (id), username оставлен для удобства клиентов.
+func GenerateAccessToken(userID int, username string, sessionID int) (string, error) {
+	claims := standardClaims(userID, time.Hour*1)
+	claims["username"] = username
+	claims["sid"] = sessionID
+	claims["type"] = "access"
+	return signToken(claims)
+}
+
+func GenerateRefreshToken(userID int, username string) (string, error) {
+	claims := standardClaims(userID, 30*24*time.Hour)
+	claims["username"] = username
+	claims["type"] = "refresh"
+	return signToken(claims)
+}
 
-	return token.SignedString([]byte(getJWTSecretKey()))
+// GenerateLoginChallenge выпускает короткоживущий токен первого шага входа.
+// Он подтверждает, что пароль верный, и обменивается на сессию только вместе с кодом второго фактора.
+func GenerateLoginChallenge(userID int, username string, deviceName string) (string, error) {
+	claims := standardClaims(userID, 5*time.Minute)
+	claims["username"] = username
+	claims["device_name"] = deviceName
+	claims["type"] = "login_challenge"
+	return signToken(claims)
 }
 
-func GenerateRefreshToken(username string) (string, error) {
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"username": username,
-		"exp":      time.Now().Add(30 * 24 * time.Hour).Unix(),
-		"type":     "refresh",
-	})
+// ValidateLoginChallenge проверяет токен первого шага входа и возвращает его claims
+func ValidateLoginChallenge(challenge string) (map[string]interface{}, error) {
+	token, err := parseToken(challenge,
+		jwt.WithIssuer(tokenIssuer),
+		jwt.WithAudience(tokenAudience),
+	)
+	if err != nil || !token.Valid {
+		return nil, errors.New("недействительный или истекший токен входа")
+	}
 
-	return token.SignedString([]byte(getJWTSecretKey()))
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || claims["type"] != "login_challenge" {
+		return nil, errors.New("неверный тип токена: ожидается токен входа")
+	}
+	return claims, nil
 }
 
-func ValidateAccessToken(accessToken string) (bool, error) {
-	secretKey := getJWTSecretKey()
+var ErrLoginChallengeUsed = errors.New("токен входа уже использован")
 
-	token, err := jwt.Parse(accessToken, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, errors.New("неподдерживаемый метод подписи")
-		}
-		return []byte(secretKey), nil
-	})
+// ConsumeLoginChallenge отмечает токен первого шага входа использованным. Вызывается после
+// проверки второго фактора: с тем же токеном второй вход не состоится даже с новым кодом.
+func ConsumeLoginChallenge(claims map[string]interface{}, db *sql.DB) error {
+	jti, _ := claims["jti"].(string)
+	exp, _ := claims["exp"].(float64)
+	if jti == "" {
+		return ErrLoginChallengeUsed
+	}
+	res, err := db.Exec(`INSERT INTO used_login_challenges (jti, expires_at) VALUES (?, ?) ON CONFLICT DO NOTHING`,
+		jti, int64(exp))
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrLoginChallengeUsed
+	}
+	return nil
+}
+
+// standardClaims заполняет зарегистрированные claims RFC 7519.
+// Уникальный jti нужен ещё и затем, чтобы два входа за одну секунду не давали одинаковые токены.
+func standardClaims(userID int, ttl time.Duration) jwt.MapClaims {
+	now := time.Now()
+	return jwt.MapClaims{
+		"sub": strconv.Itoa(userID),
+		"iss": tokenIssuer,
+		"aud": tokenAudience,
+		"iat": now.Unix(),
+		"nbf": now.Unix(),
+		"exp": now.Add(ttl).Unix(),
+		"jti": uuid.NewString(),
+	}
+}
+
+// UserFromClaims определяет пользователя токена по sub и возвращает его id и текущее имя.
+// Токены без sub не принимаются: имя могло перейти к другому пользователю после переименования.
+func UserFromClaims(claims map[string]interface{}, db *sql.DB) (int, string, error) {
+	sub, ok := claims["sub"].(string)
+	if !ok || sub == "" {
+		return 0, "", errors.New("токен не содержит sub")
+	}
+	userID, err := strconv.Atoi(sub)
+	if err != nil {
+		return 0, "", errors.New("неверный sub в токене")
+	}
+
+	var id int
+	var username string
+	err = db.QueryRow("SELECT id, username FROM users WHERE id = ?", userID).Scan(&id, &username)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, "", errors.New("пользователь не найден")
+	}
+	return id, username, err
+}
+
+func ValidateAccessToken(accessToken string) (bool, error) {
+	token, err := parseToken(accessToken,
+		jwt.WithIssuer(tokenIssuer),
+		jwt.WithAudience(tokenAudience),
+		jwt.WithIssuedAt(),
+	)
 
 	if err != nil || !token.Valid {
 		return false, errors.New("недействительный или истекший access токен")
@@ -83,14 +154,7 @@ func ValidateAccessToken(accessToken string) (bool, error) {
 }
 
 func GetClaims(currentToken string) (map[string]interface{}, error) {
-	secretKey := getJWTSecretKey()
-
-	token, err := jwt.Parse(currentToken, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, errors.New("неподдерживаемый метод подписи")
-		}
-		return []byte(secretKey), nil
-	})
+	token, err := parseToken(currentToken)
 
 	if err != nil || !token.Valid {
 		return nil, errors.New("недействительный или истекший access токен")
@@ -103,39 +167,137 @@ func GetClaims(currentToken string) (map[string]interface{}, error) {
 	return claims, nil
 }
 
-func SetRefreshTokenDB(username string, token string, db *sql.DB) error {
+// SessionInfo — сведения об устройстве, с которого открыта сессия
+type SessionInfo struct {
+	DeviceName string
+	UserAgent  string
+	IP         string
+}
+
+// SetRefreshTokenDB сохраняет refresh токен и возвращает id сессии
+func SetRefreshTokenDB(username string, token string, info SessionInfo, db *sql.DB) (int, error) {
 	var userID int
 	query := `SELECT id FROM users WHERE username = ?`
 	err := db.QueryRow(query, username).Scan(&userID)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return errors.New("пользователь не найден")
+			return 0, errors.New("пользователь не найден")
 		}
 		log.Println("Ошибка при запросе к базе:", err)
-		return err
+		return 0, err
 	}
 
 	insertQuery := `
-		INSERT INTO refresh_tokens (user_id, token, expires_at, created_at)
-		VALUES (?, ?, ?, ?)
+		INSERT INTO refresh_tokens (user_id, token, expires_at, created_at, device_name, user_agent, ip, last_used_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
 	`
-	_, err = db.Exec(insertQuery, userID, token, time.Now().Add(30*24*time.Hour), time.Now())
+	res, err := db.Exec(insertQuery, userID, token, time.Now().Add(30*24*time.Hour).Unix(), time.Now(),
+		info.DeviceName, info.UserAgent, info.IP, time.Now())
 	if err != nil {
 		log.Println("Ошибка при сохранении токена в базе:", err)
-		return err
+		return 0, err
 	}
-	return nil
+	id, err := res.LastInsertId()
+	return int(id), err
 }
 
-func ValidateRefreshToken(refreshToken string, db *sql.DB) (bool, error) {
-	secretKey := getJWTSecretKey()
+// GetSessionID возвращает id сессии, к которой относится refresh токен
+func GetSessionID(refreshToken string, db *sql.DB) (int, error) {
+	var id int
+	err := db.QueryRow(`SELECT id FROM refresh_tokens WHERE token = ?`, refreshToken).Scan(&id)
+	return id, err
+}
 
-	token, err := jwt.Parse(refreshToken, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, errors.New("неподдерживаемый метод подписи")
+// SessionExists проверяет, что сессия пользователя не была отозвана и не истекла
+func SessionExists(userID int, sessionID int, db *sql.DB) (bool, error) {
+	var expiresAt int64
+	query := `SELECT expires_at FROM refresh_tokens WHERE id = ? AND user_id = ?`
+	err := db.QueryRow(query, sessionID, userID).Scan(&expiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return time.Now().Unix() < expiresAt, nil
+}
+
+// RevokeRefreshToken удаляет refresh токен и возвращает id завершённой сессии
+func RevokeRefreshToken(refreshToken string, db *sql.DB) (int, error) {
+	sessionID, err := GetSessionID(refreshToken, db)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, errors.New("refresh токен не найден в базе")
 		}
-		return []byte(secretKey), nil
-	})
+		return 0, err
+	}
+	_, err = db.Exec(`DELETE FROM refresh_tokens WHERE id = ?`, sessionID)
+	return sessionID, err
+}
+
+// Session — активная сессия пользователя (семья refresh токенов)
+type Session struct {
+	ID         int    `json:"id"`
+	DeviceName string `json:"device_name"`
+	UserAgent  string `json:"user_agent"`
+	IP         string `json:"ip"`
+	CreatedAt  string `json:"created_at"`
+	LastUsedAt string `json:"last_used_at"`
+}
+
+func GetSessions(userID int, db *sql.DB) ([]Session, error) {
+	query := `
+		SELECT id, COALESCE(device_name, ''), COALESCE(user_agent, ''), COALESCE(ip, ''),
+			created_at, last_used_at
+		FROM refresh_tokens
+		WHERE user_id = ?
+		ORDER BY COALESCE(last_used_at, created_at) DESC`
+	rows, err := db.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		var s Session
+		var createdAt time.Time
+		var lastUsedAt sql.NullTime
+		if err := rows.Scan(&s.ID, &s.DeviceName, &s.UserAgent, &s.IP, &createdAt, &lastUsedAt); err != nil {
+			return nil, err
+		}
+		// Сессии, созданные до появления last_used_at, считаем использованными при создании
+		if !lastUsedAt.Valid {
+			lastUsedAt.Time = createdAt
+		}
+		s.CreatedAt = createdAt.Format(time.RFC3339)
+		s.LastUsedAt = lastUsedAt.Time.Format(time.RFC3339)
+		sessions = append(sessions, s)
+	}
+	return sessions, rows.Err()
+}
+
+// RevokeSession удаляет сессию пользователя по id. Возвращает false, если такой сессии у него нет.
+func RevokeSession(userID int, sessionID int, db *sql.DB) (bool, error) {
+	res, err := db.Exec(`DELETE FROM refresh_tokens WHERE id = ? AND user_id = ?`, sessionID, userID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// RevokeAllRefreshTokens удаляет все refresh токены пользователя
+func RevokeAllRefreshTokens(username string, db *sql.DB) (int64, error) {
+	res, err := db.Exec(`DELETE FROM refresh_tokens WHERE user_id = (SELECT id FROM users WHERE username = ?)`, username)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func ValidateRefreshToken(refreshToken string, db *sql.DB) (bool, error) {
+	token, err := parseToken(refreshToken)
 
 	if err != nil || !token.Valid {
 		return false, errors.New("недействительный или истекший refresh токен")
@@ -152,29 +314,118 @@ func ValidateRefreshToken(refreshToken string, db *sql.DB) (bool, error) {
 		return false, errors.New("неверный тип токена: ожидается refresh токен")
 	}
 
-	var tokenInDB string
-	query := `SELECT token FROM refresh_tokens WHERE token = ?`
-	err = db.QueryRow(query, refreshToken).Scan(&tokenInDB)
+	var expiresAt int64
+	query := `SELECT expires_at FROM refresh_tokens WHERE token = ?`
+	err = db.QueryRow(query, refreshToken).Scan(&expiresAt)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return false, errors.New("refresh токен не найден в базе")
+			return false, checkRefreshTokenReuse(refreshToken, claims, db)
 		}
 		return false, errors.New("ошибка при запросе к базе: " + err.Error())
 	}
 
+	// Срок в базе может быть короче, чем exp в самом токене (например, после изменения политики)
+	if time.Now().Unix() >= expiresAt {
+		return false, errors.New("refresh токен истёк")
+	}
+
 	return true, nil
 }
 
-func UpdateRefreshToken(refreshToken string, newRefreshToken string, db *sql.DB) error {
+// RefreshTokenReuseError — предъявлен уже ротированный refresh токен.
+// Вся семья токенов (сессия) к этому моменту уже отозвана.
+type RefreshTokenReuseError struct {
+	Username string
+	FamilyID int
+}
+
+func (e *RefreshTokenReuseError) Error() string {
+	return "refresh токен уже был использован, сессия отозвана"
+}
+
+// HashToken — хеш секрета, который хранится в базе вместо него самого: ротированных refresh токенов,
+// токенов из писем, API-ключей и токенов входящих вебхуков. Секреты случайные и длинные,
+// поэтому медленный хеш, как для паролей, не нужен.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// checkRefreshTokenReuse вызывается, когда токена нет среди действующих.
+// Если токен уже был ротирован, значит его копия есть у кого-то ещё: отзываем всю семью.
+func checkRefreshTokenReuse(refreshToken string, claims jwt.MapClaims, db *sql.DB) error {
+	var familyID, userID int
+	err := db.QueryRow(`SELECT family_id, user_id FROM refresh_token_history WHERE token_hash = ?`, HashToken(refreshToken)).
+		Scan(&familyID, &userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return errors.New("refresh токен не найден в базе")
+	}
+	if err != nil {
+		return errors.New("ошибка при запросе к базе: " + err.Error())
+	}
+
+	if _, err := db.Exec(`DELETE FROM refresh_tokens WHERE id = ?`, familyID); err != nil {
+		return errors.New("ошибка при отзыве семьи токенов: " + err.Error())
+	}
+
+	var username string
+	if err := db.QueryRow(`SELECT username FROM users WHERE id = ?`, userID).Scan(&username); err != nil {
+		username, _ = claims["username"].(string)
+	}
+	return &RefreshTokenReuseError{Username: username, FamilyID: familyID}
+}
+
+// UpdateRefreshToken ротирует refresh токен внутри его семьи.
+// Старый токен запоминается в истории, чтобы распознать его повторное использование.
+// Адрес и User-Agent сессии обновляются, имя устройства остаётся прежним.
+func UpdateRefreshToken(refreshToken string, newRefreshToken string, info SessionInfo, db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var familyID, userID int
+	err = tx.QueryRow(`SELECT id, user_id FROM refresh_tokens WHERE token = ?`, refreshToken).Scan(&familyID, &userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			// Токен успели ротировать параллельным запросом
+			return errors.New("refresh токен не найден в базе")
+		}
+		return err
+	}
+
 	updateQuery := `
 		UPDATE refresh_tokens 
-		SET token = ?, expires_at = ?
-		WHERE token = ?
+		SET token = ?, expires_at = ?, user_agent = ?, ip = ?, last_used_at = ?
+		WHERE id = ? AND token = ?
 	`
-	_, err := db.Exec(updateQuery, newRefreshToken, time.Now().Add(30*24*time.Hour), refreshToken)
+	res, err := tx.Exec(updateQuery, newRefreshToken, time.Now().Add(30*24*time.Hour).Unix(),
+		info.UserAgent, info.IP, time.Now(), familyID, refreshToken)
 	if err != nil {
 		log.Println("Ошибка при обновлении refresh токена в базе:", err)
 		return err
 	}
-	return nil
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("refresh токен не найден в базе")
+	}
+
+	historyQuery := `
+		INSERT INTO refresh_token_history (token_hash, family_id, user_id, rotated_at, expires_at)
+		VALUES (?, ?, ?, ?, ?)
+	`
+	_, err = tx.Exec(historyQuery, HashToken(refreshToken), familyID, userID, time.Now(), time.Now().Add(30*24*time.Hour).Unix())
+	if err != nil {
+		log.Println("Ошибка при сохранении истории refresh токенов:", err)
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// LogAuthEvent записывает событие безопасности в журнал auth_events
+func LogAuthEvent(db *sql.DB, username, event, ip, details string) error {
+	_, err := db.Exec(`INSERT INTO auth_events (username, event, ip, details) VALUES (?, ?, ?, ?)`,
+		username, event, ip, details)
+	return err
 }
@@ -0,0 +1,265 @@
+package authorization_tools
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/golang-jwt/jwt/v5"
+	"math/big"
+	"os"
+	"sort"
+	"strings"
+)
+
+// legacyKeyID — ключ, которым проверяются токены без заголовка kid,
+// выпущенные до появления ротации ключей
+const legacyKeyID = "default"
+
+// signingKey — ключ подписи JWT с идентификатором kid.
+// У ключа, заданного только открытой частью, signKey == nil: он лишь проверяет токены.
+type signingKey struct {
+	id        string
+	method    jwt.SigningMethod
+	signKey   interface{}
+	verifyKey interface{}
+}
+
+// Keyring — набор ключей подписи. Новые токены подписываются активным ключом,
+// а проверяются любым ключом из набора, пока старые токены не истекут.
+type Keyring struct {
+	active *signingKey
+	keys   map[string]*signingKey
+}
+
+var keyring *Keyring
+
+// Значения по умолчанию для claims iss и aud
+const (
+	defaultIssuer   = "gorutines-chat"
+	defaultAudience = "gorutines-chat"
+)
+
+// tokenIssuer и tokenAudience записываются в каждый токен и проверяются у access токенов
+var (
+	tokenIssuer   = defaultIssuer
+	tokenAudience = defaultAudience
+)
+
+// LoadKeyring загружает ключи подписи из окружения. Вызывается один раз при запуске сервера.
+//
+// JWT_KEYS — список ключей HS256 через запятую в формате kid:secret.
+// JWT_KEY_FILES — список PEM-файлов с ключами Ed25519 (EdDSA) или RSA (RS256) в формате kid:путь.
+// Файл с открытым ключом можно указать для ключа, который больше не подписывает, но ещё проверяет токены.
+// JWT_ACTIVE_KEY_ID — kid ключа для подписи новых токенов (по умолчанию первый из JWT_KEYS,
+// а если он пуст — первый закрытый ключ из JWT_KEY_FILES).
+// JWT_ISSUER и JWT_AUDIENCE — значения claims iss и aud (по умолчанию gorutines-chat).
+// JWT_SECRET_KEY — прежний единственный ключ; если задан, добавляется с kid "default".
+func LoadKeyring() error {
+	kr := &Keyring{keys: make(map[string]*signingKey)}
+
+	if secret := os.Getenv("JWT_SECRET_KEY"); secret != "" {
+		kr.add(newHMACKey(legacyKeyID, secret))
+	}
+
+	var firstID string
+	for _, entry := range strings.Split(os.Getenv("JWT_KEYS"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		id, secret, ok := strings.Cut(entry, ":")
+		if !ok || id == "" || secret == "" {
+			return fmt.Errorf("неверный формат ключа в JWT_KEYS: ожидается kid:secret")
+		}
+		if _, exists := kr.keys[id]; exists {
+			return fmt.Errorf("ключ %s задан несколько раз", id)
+		}
+		kr.add(newHMACKey(id, secret))
+		if firstID == "" {
+			firstID = id
+		}
+	}
+
+	for _, entry := range strings.Split(os.Getenv("JWT_KEY_FILES"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		id, path, ok := strings.Cut(entry, ":")
+		if !ok || id == "" || path == "" {
+			return fmt.Errorf("неверный формат ключа в JWT_KEY_FILES: ожидается kid:путь")
+		}
+		if _, exists := kr.keys[id]; exists {
+			return fmt.Errorf("ключ %s задан несколько раз", id)
+		}
+		key, err := loadPEMKey(id, path)
+		if err != nil {
+			return err
+		}
+		kr.add(key)
+		if firstID == "" && key.signKey != nil {
+			firstID = id
+		}
+	}
+
+	if len(kr.keys) == 0 {
+		return errors.New("не заданы ключи подписи: укажите JWT_KEYS, JWT_KEY_FILES или JWT_SECRET_KEY")
+	}
+
+	activeID := os.Getenv("JWT_ACTIVE_KEY_ID")
+	if activeID == "" {
+		activeID = firstID
+	}
+	if activeID == "" {
+		activeID = legacyKeyID
+	}
+	active, ok := kr.keys[activeID]
+	if !ok {
+		return fmt.Errorf("активный ключ %s не найден среди ключей подписи", activeID)
+	}
+	if active.signKey == nil {
+		return fmt.Errorf("активный ключ %s содержит только открытую часть", activeID)
+	}
+	kr.active = active
+
+	keyring = kr
+
+	tokenIssuer = defaultIssuer
+	if issuer := os.Getenv("JWT_ISSUER"); issuer != "" {
+		tokenIssuer = issuer
+	}
+	tokenAudience = defaultAudience
+	if audience := os.Getenv("JWT_AUDIENCE"); audience != "" {
+		tokenAudience = audience
+	}
+	return nil
+}
+
+func newHMACKey(id, secret string) *signingKey {
+	return &signingKey{
+		id:        id,
+		method:    jwt.SigningMethodHS256,
+		signKey:   []byte(secret),
+		verifyKey: []byte(secret),
+	}
+}
+
+// loadPEMKey читает закрытый (PKCS#8 или PKCS#1) или открытый (PKIX) ключ из PEM-файла
+func loadPEMKey(id, path string) (*signingKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("не удалось прочитать ключ %s: %v", id, err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("файл ключа %s не содержит PEM", id)
+	}
+
+	var parsed interface{}
+	switch block.Type {
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("неподдерживаемый тип PEM %q в ключе %s", block.Type, id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("не удалось разобрать ключ %s: %v", id, err)
+	}
+
+	switch k := parsed.(type) {
+	case ed25519.PrivateKey:
+		return &signingKey{id: id, method: jwt.SigningMethodEdDSA, signKey: k, verifyKey: k.Public()}, nil
+	case ed25519.PublicKey:
+		return &signingKey{id: id, method: jwt.SigningMethodEdDSA, verifyKey: k}, nil
+	case *rsa.PrivateKey:
+		return &signingKey{id: id, method: jwt.SigningMethodRS256, signKey: k, verifyKey: &k.PublicKey}, nil
+	case *rsa.PublicKey:
+		return &signingKey{id: id, method: jwt.SigningMethodRS256, verifyKey: k}, nil
+	default:
+		return nil, fmt.Errorf("ключ %s: поддерживаются только Ed25519 и RSA", id)
+	}
+}
+
+func (kr *Keyring) add(key *signingKey) {
+	kr.keys[key.id] = key
+}
+
+// signToken подписывает claims активным ключом и указывает его kid в заголовке
+func signToken(claims jwt.Claims) (string, error) {
+	if keyring == nil {
+		return "", errors.New("ключи подписи не загружены")
+	}
+	token := jwt.NewWithClaims(keyring.active.method, claims)
+	token.Header["kid"] = keyring.active.id
+	return token.SignedString(keyring.active.signKey)
+}
+
+// parseToken проверяет подпись токена ключом, указанным в его заголовке kid.
+// Дополнительные проверки claims (iss, aud) передаются через opts.
+func parseToken(tokenString string, opts ...jwt.ParserOption) (*jwt.Token, error) {
+	if keyring == nil {
+		return nil, errors.New("ключи подписи не загружены")
+	}
+	return jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		if kid == "" {
+			kid = legacyKeyID
+		}
+		key, ok := keyring.keys[kid]
+		if !ok {
+			return nil, fmt.Errorf("неизвестный ключ подписи %q", kid)
+		}
+		// Алгоритм берётся из настроек ключа, а не из заголовка токена
+		if token.Method.Alg() != key.method.Alg() {
+			return nil, errors.New("неподдерживаемый метод подписи")
+		}
+		return key.verifyKey, nil
+	}, opts...)
+}
+
+// JWK — открытый ключ в формате JSON Web Key (RFC 7517)
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	Crv string `json:"crv,omitempty"` // OKP
+	X   string `json:"x,omitempty"`   // OKP
+	N   string `json:"n,omitempty"`   // RSA
+	E   string `json:"e,omitempty"`   // RSA
+}
+
+// PublicJWKS возвращает открытые части асимметричных ключей для /.well-known/jwks.json.
+// Ключи HS256 не публикуются: их секрет нельзя раскрывать.
+func PublicJWKS() []JWK {
+	jwks := []JWK{}
+	if keyring == nil {
+		return jwks
+	}
+	for _, key := range keyring.keys {
+		switch k := key.verifyKey.(type) {
+		case ed25519.PublicKey:
+			jwks = append(jwks, JWK{
+				Kty: "OKP", Kid: key.id, Alg: key.method.Alg(), Use: "sig",
+				Crv: "Ed25519",
+				X:   base64.RawURLEncoding.EncodeToString(k),
+			})
+		case *rsa.PublicKey:
+			jwks = append(jwks, JWK{
+				Kty: "RSA", Kid: key.id, Alg: key.method.Alg(), Use: "sig",
+				N: base64.RawURLEncoding.EncodeToString(k.N.Bytes()),
+				E: base64.RawURLEncoding.EncodeToString(big.NewInt(int64(k.E)).Bytes()),
+			})
+		}
+	}
+	sort.Slice(jwks, func(i, j int) bool { return jwks[i].Kid < jwks[j].Kid })
+	return jwks
+}
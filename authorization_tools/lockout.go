@@ -0,0 +1,157 @@
+package authorization_tools
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// attemptPolicy — сколько неудачных попыток допускается без задержки и как растёт блокировка после них.
+// Каждая следующая неудача удваивает блокировку, но не дольше maxDelay.
+type attemptPolicy struct {
+	prefix       string
+	freeAttempts int
+	baseDelay    time.Duration
+	maxDelay     time.Duration
+}
+
+var (
+	accountAttempts = attemptPolicy{prefix: "user:", freeAttempts: 5, baseDelay: 30 * time.Second, maxDelay: 15 * time.Minute}
+	// С одного адреса могут входить несколько человек, поэтому порог выше
+	ipAttempts = attemptPolicy{prefix: "ip:", freeAttempts: 20, baseDelay: 30 * time.Second, maxDelay: time.Hour}
+)
+
+// Счётчик, в который давно не добавлялись неудачи, начинается заново
+const attemptsResetAfter = 24 * time.Hour
+
+func (p attemptPolicy) delay(failures int) time.Duration {
+	over := failures - p.freeAttempts
+	if over <= 0 {
+		return 0
+	}
+	d := p.baseDelay
+	for i := 1; i < over && d < p.maxDelay; i++ {
+		d *= 2
+	}
+	if d > p.maxDelay {
+		d = p.maxDelay
+	}
+	return d
+}
+
+// BeginLoginAttempt учитывает попытку входа под именем username с адреса ip ещё до проверки
+// пароля или кода, поэтому параллельные запросы не проходят проверку блокировки все разом.
+// Имя учитывается, даже если такого пользователя нет, чтобы ответы не отличались.
+// Если вход заблокирован, попытка не учитывается и возвращается время ожидания.
+// Попытку, которая оказалась успешной, нужно вернуть через LoginAttemptSucceeded.
+func BeginLoginAttempt(username, ip string, db *sql.DB) (time.Duration, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	var wait time.Duration
+	for _, item := range attemptKeys(username, ip) {
+		// Счётчик увеличивается одним запросом: при гонке ни одна попытка не теряется,
+		// а блокировка считается по тому значению, которое получилось у этого запроса
+		var failures int
+		err := tx.QueryRow(`
+			INSERT INTO login_attempts (key, failures, last_failure_at) VALUES (?, 1, ?)
+			ON CONFLICT (key) DO UPDATE SET
+				failures = CASE WHEN last_failure_at < ? THEN 1 ELSE failures + 1 END,
+				last_failure_at = excluded.last_failure_at
+			WHERE locked_until IS NULL OR locked_until <= excluded.last_failure_at
+			RETURNING failures`,
+			item.key, now.Unix(), now.Add(-attemptsResetAfter).Unix()).Scan(&failures)
+		if errors.Is(err, sql.ErrNoRows) {
+			// Запись не обновлена — действует блокировка
+			var lockedUntil int64
+			if err := tx.QueryRow(`SELECT locked_until FROM login_attempts WHERE key = ?`, item.key).Scan(&lockedUntil); err != nil {
+				return 0, err
+			}
+			if d := time.Unix(lockedUntil, 0).Sub(now); d > wait {
+				wait = d
+			}
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		if d := item.policy.delay(failures); d > 0 {
+			_, err := tx.Exec(`UPDATE login_attempts SET locked_until = ? WHERE key = ?`, now.Add(d).Unix(), item.key)
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+	if wait > 0 {
+		return wait, nil
+	}
+	return 0, tx.Commit()
+}
+
+// LoginAttemptSucceeded возвращает попытку, учтённую BeginLoginAttempt, когда пароль или код оказались верными.
+// Блокировка снимается, только если без этой попытки порог не превышен.
+func LoginAttemptSucceeded(username, ip string, db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, item := range attemptKeys(username, ip) {
+		_, err := tx.Exec(`
+			UPDATE login_attempts SET failures = failures - 1,
+				locked_until = CASE WHEN failures - 1 > ? THEN locked_until END
+			WHERE key = ? AND failures > 0`,
+			item.policy.freeAttempts, item.key)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+type attemptKey struct {
+	policy attemptPolicy
+	key    string
+}
+
+func attemptKeys(username, ip string) []attemptKey {
+	return []attemptKey{
+		{accountAttempts, accountAttempts.prefix + username},
+		{ipAttempts, ipAttempts.prefix + ip},
+	}
+}
+
+// ResetLoginFailures сбрасывает счётчик учётной записи после успешного входа.
+// Счётчик адреса не сбрасывается: иначе вход в свою учётную запись обнулял бы подбор чужих паролей.
+func ResetLoginFailures(username string, db *sql.DB) error {
+	_, err := db.Exec(`DELETE FROM login_attempts WHERE key = ?`, accountAttempts.prefix+username)
+	return err
+}
+
+// UnlockAccount снимает блокировку входа с учётной записи. Возвращает false, если блокировки не было.
+func UnlockAccount(username string, db *sql.DB) (bool, error) {
+	res, err := db.Exec(`DELETE FROM login_attempts WHERE key = ?`, accountAttempts.prefix+username)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// CleanupLoginAttempts удаляет счётчики, которые уже начались бы заново и не держат блокировку
+func CleanupLoginAttempts(db *sql.DB) (int, error) {
+	now := time.Now()
+	res, err := db.Exec(`DELETE FROM login_attempts WHERE last_failure_at < ? AND (locked_until IS NULL OR locked_until <= ?)`,
+		now.Add(-attemptsResetAfter).Unix(), now.Unix())
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
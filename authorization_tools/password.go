@@ -2,32 +2,137 @@ package authorization_tools
 
 import (
 	"crypto/rand"
+	"crypto/subtle"
 	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
 	"golang.org/x/crypto/argon2"
 )
 
-func GenerateSalt(length int) (string, error) {
-	salt := make([]byte, length)
+// Argon2Params — параметры Argon2id. Они записываются в каждый хеш (формат PHC),
+// поэтому политику можно ужесточать, не ломая проверку старых хешей.
+type Argon2Params struct {
+	Time    uint32 // число проходов
+	Memory  uint32 // память в КиБ
+	Threads uint8
+	SaltLen uint32
+	KeyLen  uint32
+}
 
-	_, err := rand.Read(salt)
-	if err != nil {
+// Значения по умолчанию — второй рекомендованный вариант RFC 9106 с 64 МиБ памяти
+var passwordParams = Argon2Params{Time: 3, Memory: 64 * 1024, Threads: 2, SaltLen: 16, KeyLen: 32}
+
+var errInvalidHash = errors.New("неверный формат хеша пароля")
+
+// LoadPasswordParams читает политику хеширования из ARGON2_TIME, ARGON2_MEMORY_KIB и ARGON2_THREADS.
+// Не заданные переменные оставляют значения по умолчанию.
+func LoadPasswordParams() error {
+	params := passwordParams
+	for _, v := range []struct {
+		env string
+		min uint64
+		max uint64
+		set func(uint64)
+	}{
+		{"ARGON2_TIME", 1, 100, func(n uint64) { params.Time = uint32(n) }},
+		{"ARGON2_MEMORY_KIB", 8 * 1024, 4 * 1024 * 1024, func(n uint64) { params.Memory = uint32(n) }},
+		{"ARGON2_THREADS", 1, 255, func(n uint64) { params.Threads = uint8(n) }},
+	} {
+		raw := os.Getenv(v.env)
+		if raw == "" {
+			continue
+		}
+		n, err := strconv.ParseUint(raw, 10, 32)
+		if err != nil || n < v.min || n > v.max {
+			return fmt.Errorf("%s должен быть числом от %d до %d", v.env, v.min, v.max)
+		}
+		v.set(n)
+	}
+	passwordParams = params
+	return nil
+}
+
+// HashPassword хеширует пароль с новой солью по текущей политике.
+// Результат — строка PHC: $argon2id$v=19$m=65536,t=3,p=2$<соль>$<хеш>
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, passwordParams.SaltLen)
+	if _, err := rand.Read(salt); err != nil {
 		return "", err
 	}
+	return encodePHC(passwordParams, salt, argon2Key(password, salt, passwordParams)), nil
+}
 
-	return base64.URLEncoding.EncodeToString(salt), nil
+// VerifyPassword сверяет пароль с хешем в формате PHC. needsRehash сообщает,
+// что хеш сделан с более слабыми параметрами, чем требует текущая политика.
+func VerifyPassword(password string, encoded string) (ok bool, needsRehash bool, err error) {
+	params, salt, key, err := decodePHC(encoded)
+	if err != nil {
+		return false, false, err
+	}
+	check := argon2Key(password, salt, params)
+	if subtle.ConstantTimeCompare(check, key) != 1 {
+		return false, false, nil
+	}
+	needsRehash = params.Time < passwordParams.Time ||
+		params.Memory < passwordParams.Memory ||
+		params.KeyLen < passwordParams.KeyLen ||
+		uint32(len(salt)) < passwordParams.SaltLen
+	return true, needsRehash, nil
 }
 
-func HashPassword(password string, salt string) (string, error) {
-	hash := argon2.IDKey([]byte(password), []byte(salt),
-		1, 64*1024, 1, 32)
-	return base64.URLEncoding.EncodeToString(append([]byte(salt), hash...)), nil
+// LegacyHashToPHC переводит хеш старого формата (base64(соль||ключ), соль в отдельной колонке,
+// Argon2id t=1, 64 МиБ, p=1) в строку PHC с теми же параметрами. Пароль для этого не нужен,
+// а при следующем входе хеш будет пересчитан по текущей политике.
+func LegacyHashToPHC(storedHash string, salt string) (string, error) {
+	raw, err := base64.URLEncoding.DecodeString(storedHash)
+	if err != nil || len(raw) <= len(salt) || string(raw[:len(salt)]) != salt {
+		return "", errInvalidHash
+	}
+	key := raw[len(salt):]
+	legacy := Argon2Params{Time: 1, Memory: 64 * 1024, Threads: 1, KeyLen: uint32(len(key))}
+	return encodePHC(legacy, []byte(salt), key), nil
+}
+
+func argon2Key(password string, salt []byte, p Argon2Params) []byte {
+	return argon2.IDKey([]byte(password), salt, p.Time, p.Memory, p.Threads, p.KeyLen)
 }
 
-func VerifyPassword(password string, storedHash string, salt string) (bool, error) {
-	checkHash, err := HashPassword(password, salt)
+func encodePHC(p Argon2Params, salt, key []byte) string {
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, p.Memory, p.Time, p.Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+}
+
+func decodePHC(encoded string) (Argon2Params, []byte, []byte, error) {
+	var p Argon2Params
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[0] != "" || parts[1] != "argon2id" {
+		return p, nil, nil, errInvalidHash
+	}
 
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return p, nil, nil, errInvalidHash
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Time, &p.Threads); err != nil {
+		return p, nil, nil, errInvalidHash
+	}
+	if p.Time == 0 || p.Memory == 0 || p.Threads == 0 {
+		return p, nil, nil, errInvalidHash
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
 	if err != nil {
-		return false, err
+		return p, nil, nil, errInvalidHash
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return p, nil, nil, errInvalidHash
 	}
-	return checkHash == storedHash, nil
+	p.SaltLen = uint32(len(salt))
+	p.KeyLen = uint32(len(key))
+	return p, salt, key, nil
 }
@@ -0,0 +1,110 @@
+package authorization_tools
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+const passwordResetTTL = time.Hour
+
+var ErrResetTokenInvalid = errors.New("ссылка для сброса пароля недействительна или устарела")
+
+// CreatePasswordReset выдаёт одноразовый токен сброса пароля.
+// Действует только последний выданный токен пользователя.
+func CreatePasswordReset(userID int, db *sql.DB) (string, error) {
+	token, err := newOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM password_resets WHERE user_id = ?`, userID); err != nil {
+		return "", err
+	}
+	_, err = tx.Exec(`INSERT INTO password_resets (token_hash, user_id, expires_at) VALUES (?, ?, ?)`,
+		HashToken(token), userID, time.Now().Add(passwordResetTTL))
+	if err != nil {
+		return "", err
+	}
+	return token, tx.Commit()
+}
+
+// PasswordResetUser возвращает имя и email пользователя, которому выдан токен сброса,
+// чтобы проверить новый пароль до сброса. Действующий токен при этом не расходуется, истёкший удаляется.
+func PasswordResetUser(token string, db *sql.DB) (string, string, error) {
+	var userID int
+	var username, email string
+	var expiresAt time.Time
+	err := db.QueryRow(`
+		SELECT u.id, u.username, u.email, r.expires_at
+		FROM password_resets r
+		JOIN users u ON u.id = r.user_id
+		WHERE r.token_hash = ?`, HashToken(token)).Scan(&userID, &username, &email, &expiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", "", ErrResetTokenInvalid
+	}
+	if err != nil {
+		return "", "", err
+	}
+	if !time.Now().Before(expiresAt) {
+		if _, err := db.Exec(`DELETE FROM password_resets WHERE user_id = ?`, userID); err != nil {
+			return "", "", err
+		}
+		return "", "", ErrResetTokenInvalid
+	}
+	return username, email, nil
+}
+
+// ResetPassword задаёт новый пароль по токену сброса и возвращает имя пользователя.
+// Пароль хешируется с новой солью по текущей политике, все refresh токены пользователя отзываются.
+func ResetPassword(token, newPassword string, db *sql.DB) (string, error) {
+	hash, err := HashPassword(newPassword)
+	if err != nil {
+		return "", err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var userID int
+	var expiresAt time.Time
+	err = tx.QueryRow(`SELECT user_id, expires_at FROM password_resets WHERE token_hash = ?`, HashToken(token)).
+		Scan(&userID, &expiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrResetTokenInvalid
+	}
+	if err != nil {
+		return "", err
+	}
+	// Токен одноразовый: удаляем его и при успехе, и если он истёк
+	if _, err := tx.Exec(`DELETE FROM password_resets WHERE user_id = ?`, userID); err != nil {
+		return "", err
+	}
+	if !time.Now().Before(expiresAt) {
+		if err := tx.Commit(); err != nil {
+			return "", err
+		}
+		return "", ErrResetTokenInvalid
+	}
+
+	var username string
+	if err := tx.QueryRow(`SELECT username FROM users WHERE id = ?`, userID).Scan(&username); err != nil {
+		return "", err
+	}
+	if _, err := tx.Exec(`UPDATE users SET password = ? WHERE id = ?`, hash, userID); err != nil {
+		return "", err
+	}
+	if _, err := tx.Exec(`DELETE FROM refresh_tokens WHERE user_id = ?`, userID); err != nil {
+		return "", err
+	}
+	return username, tx.Commit()
+}
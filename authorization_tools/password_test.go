@@ -0,0 +1,96 @@
+package authorization_tools
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"testing"
+)
+
+// withPasswordParams задаёт политику хеширования на время теста
+func withPasswordParams(t *testing.T, p Argon2Params) {
+	t.Helper()
+	saved := passwordParams
+	passwordParams = p
+	t.Cleanup(func() { passwordParams = saved })
+}
+
+func TestVerifyPasswordNeedsRehash(t *testing.T) {
+	const password = "Quiet-harb0r-passphrase"
+	policy := Argon2Params{Time: 2, Memory: 16 * 1024, Threads: 1, SaltLen: 16, KeyLen: 32}
+
+	hashWith := func(p Argon2Params) string {
+		t.Helper()
+		withPasswordParams(t, p)
+		hash, err := HashPassword(password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		withPasswordParams(t, policy)
+		return hash
+	}
+	weaker := func(change func(p *Argon2Params)) Argon2Params {
+		p := policy
+		change(&p)
+		return p
+	}
+
+	for _, tc := range []struct {
+		name   string
+		params Argon2Params
+		rehash bool
+	}{
+		{"текущая политика", policy, false},
+		{"меньше проходов", weaker(func(p *Argon2Params) { p.Time = 1 }), true},
+		{"меньше памяти", weaker(func(p *Argon2Params) { p.Memory = 8 * 1024 }), true},
+		{"короче соль", weaker(func(p *Argon2Params) { p.SaltLen = 8 }), true},
+		{"короче ключ", weaker(func(p *Argon2Params) { p.KeyLen = 16 }), true},
+		{"сильнее политики", weaker(func(p *Argon2Params) { p.Time, p.Memory = 3, 32*1024 }), false},
+		// Число потоков не влияет на стойкость хеша, поэтому и пересчёта не требует
+		{"другое число потоков", weaker(func(p *Argon2Params) { p.Threads = 2 }), false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			hash := hashWith(tc.params)
+			ok, needsRehash, err := VerifyPassword(password, hash)
+			if err != nil || !ok {
+				t.Fatalf("VerifyPassword = %v, %v", ok, err)
+			}
+			if needsRehash != tc.rehash {
+				t.Errorf("needsRehash = %v, ожидалось %v", needsRehash, tc.rehash)
+			}
+			if ok, needsRehash, err := VerifyPassword("wrong-"+password, hash); ok || needsRehash || err != nil {
+				t.Errorf("неверный пароль: %v, %v, %v", ok, needsRehash, err)
+			}
+		})
+	}
+
+	t.Run("хеш старого формата", func(t *testing.T) {
+		withPasswordParams(t, policy)
+		salt := base64.RawURLEncoding.EncodeToString(randomBytes(t, 12))
+		legacy := Argon2Params{Time: 1, Memory: 64 * 1024, Threads: 1, KeyLen: 32}
+		stored := base64.URLEncoding.EncodeToString(append([]byte(salt), argon2Key(password, []byte(salt), legacy)...))
+
+		hash, err := LegacyHashToPHC(stored, salt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ok, needsRehash, err := VerifyPassword(password, hash)
+		if err != nil || !ok || !needsRehash {
+			t.Errorf("VerifyPassword = %v, %v, %v, ожидался пересчёт", ok, needsRehash, err)
+		}
+	})
+
+	t.Run("неверный формат", func(t *testing.T) {
+		if _, _, err := VerifyPassword(password, "$argon2id$v=19$m=0,t=1,p=1$c2FsdA$a2V5"); err == nil {
+			t.Error("хеш с нулевой памятью принят")
+		}
+	})
+}
+
+func randomBytes(t *testing.T, n int) []byte {
+	t.Helper()
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
@@ -0,0 +1,159 @@
+package authorization_tools
+
+import (
+	"bufio"
+	"fmt"
+	"net/mail"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// FieldError — ошибка проверки одного поля запроса.
+// Code предназначен для клиентов, Message — для показа пользователю.
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// validationPolicy — требования к учётным данным при регистрации и их смене
+type validationPolicy struct {
+	passwordMinLength int
+	passwordMaxLength int
+	denylist          map[string]bool
+	usernameMinLength int
+	usernameMaxLength int
+	reservedUsernames map[string]bool
+}
+
+var policy = validationPolicy{
+	passwordMinLength: 10,
+	// Длинные пароли ничего не добавляют к стойкости, но делают хеширование дорогим
+	passwordMaxLength: 128,
+	denylist:          map[string]bool{},
+	usernameMinLength: 3,
+	usernameMaxLength: 32,
+	reservedUsernames: setOf("admin", "administrator", "root", "system", "support", "moderator",
+		"api", "bot", "me", "null", "undefined", "help", "security"),
+}
+
+func setOf(values ...string) map[string]bool {
+	set := make(map[string]bool, len(values))
+	for _, v := range values {
+		set[strings.ToLower(v)] = true
+	}
+	return set
+}
+
+// LoadValidationPolicy читает PASSWORD_MIN_LENGTH, PASSWORD_DENYLIST_FILE (по паролю в строке)
+// и RESERVED_USERNAMES (через запятую, добавляются к встроенному списку)
+func LoadValidationPolicy() error {
+	p := policy
+
+	if raw := os.Getenv("PASSWORD_MIN_LENGTH"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > p.passwordMaxLength {
+			return fmt.Errorf("PASSWORD_MIN_LENGTH должен быть числом от 1 до %d", p.passwordMaxLength)
+		}
+		p.passwordMinLength = n
+	}
+
+	if path := os.Getenv("PASSWORD_DENYLIST_FILE"); path != "" {
+		denylist, err := loadDenylist(path)
+		if err != nil {
+			return fmt.Errorf("не удалось прочитать PASSWORD_DENYLIST_FILE: %w", err)
+		}
+		p.denylist = denylist
+	}
+
+	if raw := os.Getenv("RESERVED_USERNAMES"); raw != "" {
+		reserved := make(map[string]bool, len(p.reservedUsernames))
+		for name := range p.reservedUsernames {
+			reserved[name] = true
+		}
+		for _, name := range strings.Split(raw, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				reserved[strings.ToLower(name)] = true
+			}
+		}
+		p.reservedUsernames = reserved
+	}
+
+	policy = p
+	return nil
+}
+
+func loadDenylist(path string) (map[string]bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	denylist := make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" && !strings.HasPrefix(line, "#") {
+			denylist[strings.ToLower(line)] = true
+		}
+	}
+	return denylist, scanner.Err()
+}
+
+// ValidateUsername проверяет длину, допустимые символы и зарезервированные имена
+func ValidateUsername(username string) *FieldError {
+	n := utf8.RuneCountInString(username)
+	if n < policy.usernameMinLength || n > policy.usernameMaxLength {
+		return &FieldError{"username", "invalid_length",
+			fmt.Sprintf("Имя пользователя должно содержать от %d до %d символов", policy.usernameMinLength, policy.usernameMaxLength)}
+	}
+	for i, r := range username {
+		letterOrDigit := r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9'
+		if i == 0 && !letterOrDigit {
+			return &FieldError{"username", "invalid_start", "Имя пользователя должно начинаться с латинской буквы или цифры"}
+		}
+		if !letterOrDigit && r != '_' && r != '.' && r != '-' {
+			return &FieldError{"username", "invalid_characters", "Имя пользователя может содержать только латинские буквы, цифры и символы _ . -"}
+		}
+	}
+	if policy.reservedUsernames[strings.ToLower(username)] {
+		return &FieldError{"username", "reserved", "Это имя пользователя зарезервировано"}
+	}
+	return nil
+}
+
+// ValidateEmail проверяет, что строка — один адрес по RFC 5322 без отображаемого имени
+func ValidateEmail(email string) *FieldError {
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Name != "" || addr.Address != email || len(email) > 254 {
+		return &FieldError{"email", "invalid", "Неверный адрес почты"}
+	}
+	domain := email[strings.LastIndex(email, "@")+1:]
+	if !strings.Contains(domain, ".") || strings.HasPrefix(domain, ".") || strings.HasSuffix(domain, ".") {
+		return &FieldError{"email", "invalid", "Неверный адрес почты"}
+	}
+	return nil
+}
+
+// ValidatePassword проверяет длину пароля, список утёкших и распространённых паролей
+// и совпадение с именем пользователя или адресом почты (их можно не передавать)
+func ValidatePassword(password, username, email string) *FieldError {
+	n := utf8.RuneCountInString(password)
+	if n < policy.passwordMinLength {
+		return &FieldError{"password", "too_short", fmt.Sprintf("Пароль должен содержать не меньше %d символов", policy.passwordMinLength)}
+	}
+	if n > policy.passwordMaxLength {
+		return &FieldError{"password", "too_long", fmt.Sprintf("Пароль должен содержать не больше %d символов", policy.passwordMaxLength)}
+	}
+	lower := strings.ToLower(password)
+	if policy.denylist[lower] {
+		return &FieldError{"password", "too_common", "Этот пароль слишком распространён или встречался в утечках"}
+	}
+	if username != "" && strings.Contains(lower, strings.ToLower(username)) ||
+		email != "" && lower == strings.ToLower(email) {
+		return &FieldError{"password", "contains_user_data", "Пароль не должен содержать имя пользователя или адрес почты"}
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package authorization_tools
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Throttle учитывает обращение по ключу key: за окно window допускается не больше limit обращений.
+// Если лимит исчерпан, возвращает время до начала следующего окна. Счётчик хранится в базе,
+// поэтому переживает перезапуск сервера, а увеличивается одним запросом, поэтому одновременные
+// обращения не теряются.
+func Throttle(key string, limit int, window time.Duration, db *sql.DB) (time.Duration, error) {
+	now := time.Now()
+	windowStart := now.Add(-window).Unix()
+
+	var hits int
+	var startedAt int64
+	err := db.QueryRow(`
+		INSERT INTO request_limits (key, hits, window_started_at) VALUES (?, 1, ?)
+		ON CONFLICT (key) DO UPDATE SET
+			hits = CASE WHEN window_started_at <= ? THEN 1 ELSE hits + 1 END,
+			window_started_at = CASE WHEN window_started_at <= ? THEN excluded.window_started_at ELSE window_started_at END
+		RETURNING hits, window_started_at`,
+		key, now.Unix(), windowStart, windowStart).Scan(&hits, &startedAt)
+	if err != nil {
+		return 0, err
+	}
+	if hits <= limit {
+		return 0, nil
+	}
+	return time.Unix(startedAt, 0).Add(window).Sub(now), nil
+}
+
+// CleanupRequestLimits удаляет счётчики, окно которых давно закончилось
+func CleanupRequestLimits(db *sql.DB) (int, error) {
+	res, err := db.Exec(`DELETE FROM request_limits WHERE window_started_at < ?`, time.Now().Add(-24*time.Hour).Unix())
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
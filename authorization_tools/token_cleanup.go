@@ -0,0 +1,38 @@
+package authorization_tools
+
+import (
+	"database/sql"
+	"time"
+)
+
+// CleanupExpiredTokens удаляет истёкшие refresh токены и записи истории ротации,
+// которые уже не нужны для обнаружения повторного использования, а также отметки
+// об использованных токенах входа: истёкший токен и так не примут.
+// Отозванные токены удаляются сразу при отзыве, поэтому отдельно их искать не нужно.
+// Возвращает количество удалённых сессий и записей истории.
+func CleanupExpiredTokens(db *sql.DB) (int, int, error) {
+	now := time.Now()
+
+	sessions, err := deleteExpired(db, "refresh_tokens", now)
+	if err != nil {
+		return 0, 0, err
+	}
+	history, err := deleteExpired(db, "refresh_token_history", now)
+	if err != nil {
+		return sessions, 0, err
+	}
+	if _, err := deleteExpired(db, "used_login_challenges", now); err != nil {
+		return sessions, history, err
+	}
+	return sessions, history, nil
+}
+
+// deleteExpired удаляет строки таблицы, у которых expires_at (unix-время) не позже now
+func deleteExpired(db *sql.DB, table string, now time.Time) (int, error) {
+	res, err := db.Exec("DELETE FROM "+table+" WHERE expires_at <= ?", now.Unix())
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
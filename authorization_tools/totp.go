@@ -0,0 +1,373 @@
+package authorization_tools
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"gorutines/crypt_tools"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Параметры TOTP (RFC 6238) совпадают со значениями по умолчанию у приложений-аутентификаторов
+const (
+	totpPeriod = 30
+	totpDigits = 6
+	// Допускаем расхождение часов клиента и сервера на один период в каждую сторону
+	totpSkew = 1
+
+	recoveryCodeCount = 10
+	// Первые символы кода восстановления не секретны и хранятся открыто: по ним находится
+	// единственный хеш для проверки. Секрет — остальные восемь символов.
+	recoveryLookupLength = 4
+)
+
+var (
+	ErrTOTPNotEnrolled     = errors.New("двухфакторная аутентификация не настроена")
+	ErrTOTPAlreadyEnabled  = errors.New("двухфакторная аутентификация уже включена")
+	ErrInvalidTOTPCode     = errors.New("неверный код подтверждения")
+	ErrInvalidRecoveryCode = errors.New("неверный или уже использованный код восстановления")
+	ErrTOTPKeyMissing      = errors.New("не задан ключ шифрования секретов двухфакторной аутентификации (TOTP_ENCRYPTION_KEY)")
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// totpKey шифрует секреты TOTP в базе: по утёкшей копии базы нельзя получить коды пользователей.
+// Пока ключ не задан, двухфакторную аутентификацию нельзя настроить.
+var totpKey []byte
+
+// encryptedTOTPPrefix отличает зашифрованный секрет от открытого, сохранённого до шифрования
+const encryptedTOTPPrefix = "enc1:"
+
+// LoadTOTPKey читает ключ шифрования секретов TOTP из TOTP_ENCRYPTION_KEY (32 байта в hex)
+func LoadTOTPKey() error {
+	raw := os.Getenv("TOTP_ENCRYPTION_KEY")
+	if raw == "" {
+		totpKey = nil
+		return nil
+	}
+	key, err := hex.DecodeString(raw)
+	if err != nil || len(key) != 32 {
+		return errors.New("TOTP_ENCRYPTION_KEY должен содержать 32 байта в hex, например вывод openssl rand -hex 32")
+	}
+	totpKey = key
+	return nil
+}
+
+// sealTOTPSecret шифрует секрет пользователя userID. Id проверяется при расшифровке,
+// поэтому зашифрованный секрет нельзя переставить другому пользователю.
+func sealTOTPSecret(userID int, secret string) (string, error) {
+	if totpKey == nil {
+		return "", ErrTOTPKeyMissing
+	}
+	sealed, err := crypt_tools.EncryptWithKey(secret, totpKey, []byte(strconv.Itoa(userID)))
+	if err != nil {
+		return "", err
+	}
+	return encryptedTOTPPrefix + sealed, nil
+}
+
+func openTOTPSecret(userID int, stored string) (string, error) {
+	sealed, ok := strings.CutPrefix(stored, encryptedTOTPPrefix)
+	if !ok {
+		return "", errors.New("секрет TOTP хранится незашифрованным")
+	}
+	if totpKey == nil {
+		return "", ErrTOTPKeyMissing
+	}
+	return crypt_tools.DecryptWithKey(sealed, totpKey, []byte(strconv.Itoa(userID)))
+}
+
+// EncryptTOTPSecrets шифрует секреты, сохранённые открытым текстом до появления шифрования.
+// Если такие секреты есть, а ключ не задан, возвращает ErrTOTPKeyMissing.
+func EncryptTOTPSecrets(db *sql.DB) error {
+	rows, err := db.Query(`SELECT id, totp_secret FROM users WHERE totp_secret IS NOT NULL AND totp_secret NOT LIKE ?`,
+		encryptedTOTPPrefix+"%")
+	if err != nil {
+		return err
+	}
+	type plainSecret struct {
+		userID int
+		secret string
+	}
+	var plain []plainSecret
+	for rows.Next() {
+		var p plainSecret
+		if err := rows.Scan(&p.userID, &p.secret); err != nil {
+			rows.Close()
+			return err
+		}
+		plain = append(plain, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, p := range plain {
+		sealed, err := sealTOTPSecret(p.userID, p.secret)
+		if err != nil {
+			return err
+		}
+		if _, err := db.Exec(`UPDATE users SET totp_secret = ? WHERE id = ?`, sealed, p.userID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// totpCode вычисляет код для номера периода counter (RFC 4226, HMAC-SHA1)
+func totpCode(secret []byte, counter uint64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// matchTOTP возвращает номер периода, которому соответствует код
+func matchTOTP(secret, code string, now time.Time) (int64, bool) {
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil {
+		return 0, false
+	}
+	code = strings.TrimSpace(code)
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if hmac.Equal([]byte(totpCode(key, uint64(step))), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+func totpIssuer() string {
+	if issuer := os.Getenv("TOTP_ISSUER"); issuer != "" {
+		return issuer
+	}
+	return tokenIssuer
+}
+
+// EnrollTOTP создаёт новый секрет для пользователя и возвращает его вместе с otpauth URI.
+// Пока секрет не подтверждён кодом (ConfirmTOTP), вход по-прежнему однофакторный.
+func EnrollTOTP(userID int, username string, db *sql.DB) (string, string, error) {
+	var enabledAt sql.NullTime
+	if err := db.QueryRow(`SELECT totp_enabled_at FROM users WHERE id = ?`, userID).Scan(&enabledAt); err != nil {
+		return "", "", err
+	}
+	if enabledAt.Valid {
+		return "", "", ErrTOTPAlreadyEnabled
+	}
+
+	key := make([]byte, 20)
+	if _, err := rand.Read(key); err != nil {
+		return "", "", err
+	}
+	secret := totpEncoding.EncodeToString(key)
+	sealed, err := sealTOTPSecret(userID, secret)
+	if err != nil {
+		return "", "", err
+	}
+	if _, err := db.Exec(`UPDATE users SET totp_secret = ?, totp_last_step = NULL WHERE id = ?`, sealed, userID); err != nil {
+		return "", "", err
+	}
+
+	issuer := totpIssuer()
+	uri := url.URL{
+		Scheme: "otpauth",
+		Host:   "totp",
+		Path:   "/" + issuer + ":" + username,
+		RawQuery: url.Values{
+			"secret":    {secret},
+			"issuer":    {issuer},
+			"algorithm": {"SHA1"},
+			"digits":    {fmt.Sprint(totpDigits)},
+			"period":    {fmt.Sprint(totpPeriod)},
+		}.Encode(),
+	}
+	return secret, uri.String(), nil
+}
+
+// ConfirmTOTP включает двухфакторную аутентификацию, если код подходит к выданному секрету,
+// и возвращает новые коды восстановления. Коды показываются пользователю один раз.
+func ConfirmTOTP(userID int, code string, db *sql.DB) ([]string, error) {
+	var secret sql.NullString
+	var enabledAt sql.NullTime
+	err := db.QueryRow(`SELECT totp_secret, totp_enabled_at FROM users WHERE id = ?`, userID).Scan(&secret, &enabledAt)
+	if err != nil {
+		return nil, err
+	}
+	if enabledAt.Valid {
+		return nil, ErrTOTPAlreadyEnabled
+	}
+	if !secret.Valid {
+		return nil, ErrTOTPNotEnrolled
+	}
+	plainSecret, err := openTOTPSecret(userID, secret.String)
+	if err != nil {
+		return nil, err
+	}
+	step, ok := matchTOTP(plainSecret, code, time.Now())
+	if !ok {
+		return nil, ErrInvalidTOTPCode
+	}
+
+	codes := make([]string, recoveryCodeCount)
+	lookups := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 8)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		c := strings.ToLower(totpEncoding.EncodeToString(b))
+		lookups[i] = c[:recoveryLookupLength]
+		codes[i] = lookups[i] + "-" + c[4:8] + "-" + c[8:12]
+
+		hash, err := HashPassword(codes[i])
+		if err != nil {
+			return nil, err
+		}
+		hashes[i] = hash
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`UPDATE users SET totp_enabled_at = ?, totp_last_step = ? WHERE id = ?`, time.Now(), step, userID); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(`DELETE FROM recovery_codes WHERE user_id = ?`, userID); err != nil {
+		return nil, err
+	}
+	for i, h := range hashes {
+		if _, err := tx.Exec(`INSERT INTO recovery_codes (user_id, lookup, code_hash) VALUES (?, ?, ?)`, userID, lookups[i], h); err != nil {
+			return nil, err
+		}
+	}
+	return codes, tx.Commit()
+}
+
+// IsTOTPEnabled сообщает, требуется ли пользователю второй фактор при входе
+func IsTOTPEnabled(userID int, db *sql.DB) (bool, error) {
+	var enabledAt sql.NullTime
+	err := db.QueryRow(`SELECT totp_enabled_at FROM users WHERE id = ?`, userID).Scan(&enabledAt)
+	return enabledAt.Valid, err
+}
+
+// VerifyTOTP проверяет код из приложения-аутентификатора.
+// Один и тот же код нельзя использовать дважды: запоминается последний принятый период.
+func VerifyTOTP(userID int, code string, db *sql.DB) error {
+	var secret sql.NullString
+	var lastStep sql.NullInt64
+	err := db.QueryRow(`SELECT totp_secret, totp_last_step FROM users WHERE id = ? AND totp_enabled_at IS NOT NULL`, userID).
+		Scan(&secret, &lastStep)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrTOTPNotEnrolled
+	}
+	if err != nil {
+		return err
+	}
+	plainSecret, err := openTOTPSecret(userID, secret.String)
+	if err != nil {
+		return err
+	}
+
+	step, ok := matchTOTP(plainSecret, code, time.Now())
+	if !ok || (lastStep.Valid && step <= lastStep.Int64) {
+		return ErrInvalidTOTPCode
+	}
+
+	// Условие в UPDATE не даёт двум параллельным запросам принять один и тот же код
+	res, err := db.Exec(`UPDATE users SET totp_last_step = ? WHERE id = ? AND (totp_last_step IS NULL OR totp_last_step < ?)`,
+		step, userID, step)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrInvalidTOTPCode
+	}
+	return nil
+}
+
+// UseRecoveryCode проверяет код восстановления и помечает его использованным.
+// Хеш проверяется только у кодов с тем же открытым началом, обычно это один код.
+func UseRecoveryCode(userID int, code string, db *sql.DB) error {
+	code = strings.ToLower(strings.TrimSpace(code))
+	if len(code) < recoveryLookupLength {
+		return ErrInvalidRecoveryCode
+	}
+
+	rows, err := db.Query(`SELECT id, code_hash FROM recovery_codes WHERE user_id = ? AND lookup = ? AND used_at IS NULL`,
+		userID, code[:recoveryLookupLength])
+	if err != nil {
+		return err
+	}
+	type storedCode struct {
+		id   int
+		hash string
+	}
+	var stored []storedCode
+	for rows.Next() {
+		var s storedCode
+		if err := rows.Scan(&s.id, &s.hash); err != nil {
+			rows.Close()
+			return err
+		}
+		stored = append(stored, s)
+	}
+	rows.Close()
+
+	for _, s := range stored {
+		ok, _, err := VerifyPassword(code, s.hash)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		res, err := db.Exec(`UPDATE recovery_codes SET used_at = ? WHERE id = ? AND used_at IS NULL`, time.Now(), s.id)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return ErrInvalidRecoveryCode
+		}
+		return nil
+	}
+	return ErrInvalidRecoveryCode
+}
+
+// DisableTOTP отключает второй фактор и удаляет коды восстановления
+func DisableTOTP(userID int, db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`UPDATE users SET totp_secret = NULL, totp_enabled_at = NULL, totp_last_step = NULL WHERE id = ?`, userID)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM recovery_codes WHERE user_id = ?`, userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,66 @@
+package crypt_tools
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+)
+
+// newKeyGCM создаёт AES-256-GCM для готового 32-байтового ключа
+func newKeyGCM(key []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("ключ должен быть длиной 32 байта")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// EncryptWithKey шифрует текст AES-256-GCM готовым ключом. В отличие от EncryptAES ключ
+// не выводится из пароля, поэтому шифрование быстрое и подходит для секретов, хранящихся в базе.
+// additionalData не шифруется, но без него текст не расшифровать: так шифротекст
+// нельзя перенести в чужую запись.
+func EncryptWithKey(plainText string, key, additionalData []byte) (string, error) {
+	aesGCM, err := newKeyGCM(key)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, aesGCM.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+
+	// nonce хранится перед зашифрованными данными
+	result := aesGCM.Seal(nonce, nonce, []byte(plainText), additionalData)
+	return base64.StdEncoding.EncodeToString(result), nil
+}
+
+// DecryptWithKey расшифровывает текст, зашифрованный функцией EncryptWithKey
+func DecryptWithKey(cipherTextB64 string, key, additionalData []byte) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(cipherTextB64)
+	if err != nil {
+		return "", err
+	}
+
+	aesGCM, err := newKeyGCM(key)
+	if err != nil {
+		return "", err
+	}
+
+	nonceSize := aesGCM.NonceSize()
+	if len(data) < nonceSize {
+		return "", fmt.Errorf("недопустимая длина данных")
+	}
+
+	plainText, err := aesGCM.Open(nil, data[:nonceSize], data[nonceSize:], additionalData)
+	if err != nil {
+		return "", err
+	}
+	return string(plainText), nil
+}
@@ -0,0 +1,296 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"gorutines/authorization_tools"
+	"gorutines/webhook_tools"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Политика удаления учётных записей задаётся при запуске сервера
+var (
+	accountDeletionGrace = 7 * 24 * time.Hour
+	// anonymizeDeletedAccounts — сохранять сообщения удалённого пользователя у собеседников,
+	// заменив его имя на обезличенное. Иначе сообщения удаляются вместе с учётной записью.
+	anonymizeDeletedAccounts = true
+)
+
+func SetAccountDeletionPolicy(grace time.Duration, anonymize bool) {
+	accountDeletionGrace = grace
+	anonymizeDeletedAccounts = anonymize
+}
+
+// DeleteAccount — удаление своей учётной записи (тело запроса: {"password": "..."}).
+// Учётная запись удаляется по истечении срока ожидания, до этого её можно восстановить
+// через /me/restore. Сессии завершаются сразу.
+func DeleteAccount(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, ok := currentSession(c, db)
+		if !ok {
+			return
+		}
+
+		var request struct {
+			Password string `json:"password" binding:"required"`
+		}
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if !verifyCredentials(c, db, user.Username, request.Password) {
+			return
+		}
+
+		if accountDeletionGrace <= 0 {
+			disconnectUser(user.Username)
+			if err := purgeAccount(db, user.ID); err != nil {
+				log.Println("Ошибка при удалении учетной записи:", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Не удалось удалить учетную запись"})
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"message": user.Username + " deleted"})
+			return
+		}
+
+		at := time.Now().Add(accountDeletionGrace)
+		if err := authorization_tools.ScheduleAccountDeletion(user.ID, at, db); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка базы данных"})
+			return
+		}
+		disconnectUser(user.Username)
+		disconnectOwnedBots(db, user.Username)
+
+		if err := authorization_tools.LogAuthEvent(db, user.Username, "account_deletion_scheduled", c.ClientIP(), ""); err != nil {
+			log.Println("Ошибка записи события авторизации:", err)
+		}
+
+		var email string
+		if err := db.QueryRow("SELECT email FROM users WHERE id = ?", user.ID).Scan(&email); err == nil {
+			body := "Учетная запись " + user.Username + " будет удалена " + at.Format("02.01.2006 15:04 MST") + ".\n\n" +
+				"Если вы передумали, восстановите её до этого времени: POST " + publicBaseURL + "/me/restore с именем и паролем."
+			if err := mailer.Send(email, "Удаление учетной записи", body); err != nil {
+				log.Printf("Ошибка отправки письма на %s: %v", email, err)
+			}
+		}
+
+		c.JSON(http.StatusAccepted, gin.H{"deletion_scheduled_at": at})
+	}
+}
+
+// RestoreAccount — отмена удаления учётной записи (тело запроса: {"username": "...", "password": "..."}).
+// Токенов у пользователя к этому моменту нет, поэтому он подтверждает себя паролем.
+func RestoreAccount(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var credentials struct {
+			Username string `json:"username" binding:"required"`
+			Password string `json:"password" binding:"required"`
+		}
+		if err := c.ShouldBindJSON(&credentials); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if !verifyCredentials(c, db, credentials.Username, credentials.Password) {
+			return
+		}
+
+		userID, err := authorization_tools.GetUserID(credentials.Username, db)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		err = authorization_tools.CancelAccountDeletion(userID, db)
+		if errors.Is(err, authorization_tools.ErrDeletionNotScheduled) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка базы данных"})
+			return
+		}
+
+		if err := authorization_tools.LogAuthEvent(db, credentials.Username, "account_deletion_cancelled", c.ClientIP(), ""); err != nil {
+			log.Println("Ошибка записи события авторизации:", err)
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Удаление отменено, войдите заново"})
+	}
+}
+
+// PurgeDeletedAccounts удаляет учётные записи, срок ожидания которых истёк.
+// Вызывается планировщиком, возвращает количество удалённых.
+func PurgeDeletedAccounts(db *sql.DB) (int, error) {
+	due, err := authorization_tools.DueAccountDeletions(db)
+	if err != nil {
+		return 0, err
+	}
+	for i, id := range due {
+		if err := purgeAccount(db, id); err != nil {
+			return i, fmt.Errorf("учетная запись %d: %w", id, err)
+		}
+	}
+	return len(due), nil
+}
+
+// sqlStep — один запрос из последовательности, выполняемой в транзакции
+type sqlStep struct {
+	query string
+	args  []interface{}
+}
+
+// purgeAccount окончательно удаляет данные пользователя. В зависимости от политики сообщения
+// остаются у собеседников от обезличенного автора либо удаляются.
+func purgeAccount(db *sql.DB, userID int) error {
+	var username string
+	if err := db.QueryRow("SELECT username FROM users WHERE id = ?", userID).Scan(&username); err != nil {
+		return err
+	}
+	disconnectUser(username)
+
+	// Боты без владельца не нужны
+	bots, err := authorization_tools.OwnedBots(userID, db)
+	if err != nil {
+		return err
+	}
+	for _, botID := range bots {
+		if err := purgeAccount(db, botID); err != nil {
+			return fmt.Errorf("бот %d: %w", botID, err)
+		}
+	}
+
+	// Загруженные, но так и не отправленные вложения
+	if err := deleteAttachmentsWhere(db, "uploader = ? AND message_id IS NULL", username); err != nil {
+		return err
+	}
+
+	if err := deleteDataExportsWhere(db, "user_id = ?", userID); err != nil {
+		return err
+	}
+
+	// Сообщения удаляются в той же транзакции, что и остальные данные; файлы вложений
+	// и уведомления об удалении — только после её фиксации
+	type removedMessage struct {
+		fromID, toID int
+		event        MessageChangeEvent
+	}
+	var removedMessages []removedMessage
+	var removedFiles []string
+	if !anonymizeDeletedAccounts {
+		rows, err := db.Query(`
+			SELECT m.id, m.from_user_id, m.to_user_id, fu.username, tu.username
+			FROM messages m
+			JOIN users fu ON fu.id = m.from_user_id
+			JOIN users tu ON tu.id = m.to_user_id
+			WHERE m.from_user_id = ? OR m.to_user_id = ?`, userID, userID)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			m := removedMessage{event: MessageChangeEvent{Action: webhook_tools.EventDeleteMessage}}
+			if err := rows.Scan(&m.event.MessageID, &m.fromID, &m.toID, &m.event.From, &m.event.To); err != nil {
+				rows.Close()
+				return err
+			}
+			removedMessages = append(removedMessages, m)
+		}
+		rows.Close()
+
+		removedFiles, err = attachmentFilesWhere(db,
+			"message_id IN (SELECT id FROM messages WHERE from_user_id = ? OR to_user_id = ?)", userID, userID)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Обезличенное имя содержит символ, недопустимый при регистрации, поэтому не может быть занято
+	tombstone := fmt.Sprintf("deleted#%d", userID)
+	// Пароль, который никто не знает: вход в обезличенную запись невозможен
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return err
+	}
+	unusableHash, err := authorization_tools.HashPassword(hex.EncodeToString(secret))
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	cleanup := []sqlStep{
+		{"DELETE FROM drafts WHERE username = ? OR peer = ?", []interface{}{username, username}},
+		{"DELETE FROM blocks WHERE blocker = ? OR blocked = ?", []interface{}{username, username}},
+		{"DELETE FROM refresh_token_history WHERE user_id = ?", []interface{}{userID}},
+		{"DELETE FROM login_attempts WHERE key = ?", []interface{}{"user:" + username}},
+		{"DELETE FROM api_keys WHERE user_id = ?", []interface{}{userID}},
+		{"DELETE FROM webhooks WHERE owner_id = ?", []interface{}{userID}},
+		{"DELETE FROM incoming_hooks WHERE owner_id = ? OR sender_id = ? OR target_id = ?", []interface{}{userID, userID, userID}},
+		{"DELETE FROM reminders WHERE user_id = ? OR peer_id = ?", []interface{}{userID, userID}},
+		{"DELETE FROM mutes WHERE user_id = ? OR peer_id = ?", []interface{}{userID, userID}},
+		{"DELETE FROM bot_commands WHERE bot_id = ?", []interface{}{userID}},
+		{"UPDATE attachments SET uploader = ? WHERE uploader = ?", []interface{}{tombstone, username}},
+		{"UPDATE reports SET reporter = ? WHERE reporter = ?", []interface{}{tombstone, username}},
+		{"UPDATE reports SET message_from = ? WHERE message_from_id = ? OR message_from = ?", []interface{}{tombstone, userID, username}},
+		{"UPDATE reports SET message_to = ? WHERE message_to = ?", []interface{}{tombstone, username}},
+		{"UPDATE reports SET resolved_by = ? WHERE resolved_by = ?", []interface{}{tombstone, username}},
+		{"UPDATE moderation_log SET moderator = ? WHERE moderator = ?", []interface{}{tombstone, username}},
+		{"UPDATE moderation_log SET target_user = ? WHERE target_user = ?", []interface{}{tombstone, username}},
+		// Журнал входов хранит имя и адреса пользователя, поэтому удаляется целиком
+		{"DELETE FROM auth_events WHERE username = ?", []interface{}{username}},
+	}
+	if anonymizeDeletedAccounts {
+		// Запись пользователя остаётся, чтобы сообщения собеседников ссылались на неё
+		cleanup = append(cleanup,
+			sqlStep{`UPDATE users SET username = ?, email = ?, password = ?, role = 'deleted',
+				display_name = NULL, avatar_url = NULL, email_verified_at = NULL,
+				totp_secret = NULL, totp_enabled_at = NULL, totp_last_step = NULL,
+				deletion_scheduled_at = NULL, deleted_at = ?, bot_owner_id = NULL
+			WHERE id = ?`, []interface{}{tombstone, tombstone, unusableHash, time.Now(), userID}},
+			sqlStep{"DELETE FROM refresh_tokens WHERE user_id = ?", []interface{}{userID}},
+			sqlStep{"DELETE FROM recovery_codes WHERE user_id = ?", []interface{}{userID}},
+			sqlStep{"DELETE FROM email_verifications WHERE user_id = ?", []interface{}{userID}},
+			sqlStep{"DELETE FROM password_resets WHERE user_id = ?", []interface{}{userID}},
+		)
+	} else {
+		// Вложения удаляются каскадом вместе с сообщениями, сессии, коды восстановления
+		// и прочее — вместе с пользователем
+		cleanup = append(cleanup,
+			sqlStep{"DELETE FROM messages WHERE from_user_id = ? OR to_user_id = ?", []interface{}{userID, userID}},
+			sqlStep{"DELETE FROM users WHERE id = ?", []interface{}{userID}},
+		)
+	}
+
+	for _, step := range cleanup {
+		if _, err := tx.Exec(step.query, step.args...); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	deleteStoredFiles(removedFiles)
+	for _, m := range removedMessages {
+		SendDeleteMessageNotification(m.event.MessageID)
+		notifyWebhooks(db, webhook_tools.EventDeleteMessage, m.fromID, m.toID, m.event)
+	}
+
+	if anonymizeDeletedAccounts {
+		notifyProfileUpdated(db, ProfileUpdatedEvent{
+			Action:      "profile_updated",
+			UserID:      userID,
+			OldUsername: username,
+			Username:    tombstone,
+		})
+	}
+	log.Printf("Учетная запись %s (%d) удалена", username, userID)
+	return nil
+}
@@ -0,0 +1,54 @@
+package handlers
+
+import (
+	"database/sql"
+	"github.com/gin-gonic/gin"
+	"gorutines/authorization_tools"
+	"log"
+	"net/http"
+)
+
+// currentAdmin проверяет, что запрос сделан администратором
+func currentAdmin(c *gin.Context, db *sql.DB) (string, bool) {
+	username, ok := currentUser(c, db)
+	if !ok {
+		return "", false
+	}
+
+	role, err := authorization_tools.GetUserRole(username, db)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Пользователь не найден"})
+		return "", false
+	}
+	if role != "admin" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Недостаточно прав"})
+		return "", false
+	}
+	return username, true
+}
+
+// UnlockUser — снятие блокировки входа после неудачных попыток с учётной записи из параметра пути
+func UnlockUser(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		admin, ok := currentAdmin(c, db)
+		if !ok {
+			return
+		}
+
+		username := c.Param("username")
+		unlocked, err := authorization_tools.UnlockAccount(username, db)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка базы данных"})
+			return
+		}
+		if !unlocked {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Неудачных попыток входа нет"})
+			return
+		}
+
+		if err := authorization_tools.LogAuthEvent(db, username, "account_unlocked", c.ClientIP(), "admin="+admin); err != nil {
+			log.Println("Ошибка записи события авторизации:", err)
+		}
+		c.JSON(http.StatusOK, gin.H{"message": username + " unlocked"})
+	}
+}
@@ -0,0 +1,458 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/gabriel-vasile/mimetype"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorutines/storage_tools"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	maxAttachmentSize = 10 << 20 // 10 МБ
+	thumbnailSize     = 320
+)
+
+// allowedAttachmentTypes — MIME-типы, которые можно загружать.
+// Тип определяется по содержимому файла, а не по заголовку от клиента.
+var allowedAttachmentTypes = []string{
+	"image/jpeg",
+	"image/png",
+	"image/gif",
+	"image/webp",
+	"application/pdf",
+	"text/plain",
+	"application/zip",
+}
+
+// attachmentStorage — хранилище файлов вложений, задаётся при запуске сервера
+var attachmentStorage storage_tools.BlobStorage
+
+func SetAttachmentStorage(s storage_tools.BlobStorage) {
+	attachmentStorage = s
+}
+
+// Attachment — метаданные вложения, которые отдаются клиенту
+type Attachment struct {
+	ID           int    `json:"id"`
+	Filename     string `json:"filename"`
+	MimeType     string `json:"mime_type"`
+	Size         int64  `json:"size"`
+	URL          string `json:"url"`
+	ThumbnailURL string `json:"thumbnail_url,omitempty"`
+}
+
+func newAttachment(id int, filename, mimeType string, size int64, hasThumbnail bool) Attachment {
+	a := Attachment{
+		ID:       id,
+		Filename: filename,
+		MimeType: mimeType,
+		Size:     size,
+		URL:      attachmentPath(id, false),
+	}
+	if hasThumbnail {
+		a.ThumbnailURL = attachmentPath(id, true)
+	}
+	return a
+}
+
+// UploadAttachment — загрузка файла (поле формы file). Вложение привязывается
+// к сообщению позже, когда клиент передаёт его id в attachment_ids при send_message.
+func UploadAttachment(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		username, ok := currentUser(c, db)
+		if !ok {
+			return
+		}
+
+		// Запас на заголовки multipart-формы
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxAttachmentSize+1<<20)
+
+		fileHeader, err := c.FormFile("file")
+		if err != nil {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Файл слишком большой"})
+				return
+			}
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Файл не передан"})
+			return
+		}
+		if fileHeader.Size == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Файл пуст"})
+			return
+		}
+		if fileHeader.Size > maxAttachmentSize {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Файл слишком большой"})
+			return
+		}
+
+		file, err := fileHeader.Open()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		defer file.Close()
+
+		mtype, err := mimetype.DetectReader(file)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Не удалось определить тип файла"})
+			return
+		}
+		if !mimetype.EqualsAny(mtype.String(), allowedAttachmentTypes...) {
+			c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "Недопустимый тип файла: " + mtype.String()})
+			return
+		}
+		mimeType := strings.Split(mtype.String(), ";")[0]
+
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		key := uuid.NewString()
+		if err := attachmentStorage.Put(key, file); err != nil {
+			log.Println("Ошибка сохранения вложения:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Не удалось сохранить файл"})
+			return
+		}
+
+		// Миниатюра не обязательна: если изображение не удалось разобрать, вложение всё равно сохраняется.
+		// Для форматов без декодера (webp) миниатюры просто нет.
+		var thumbnailKey sql.NullString
+		if strings.HasPrefix(mimeType, "image/") {
+			if _, err := file.Seek(0, io.SeekStart); err == nil {
+				thumb, _, err := storage_tools.Thumbnail(file, thumbnailSize)
+				if err == nil {
+					err = attachmentStorage.Put(key+"_thumb", bytes.NewReader(thumb))
+				}
+				if errors.Is(err, storage_tools.ErrUnsupportedImage) {
+					// миниатюра не нужна
+				} else if err != nil {
+					log.Printf("Не удалось создать миниатюру для %s: %v", key, err)
+				} else {
+					thumbnailKey = sql.NullString{String: key + "_thumb", Valid: true}
+				}
+			}
+		}
+
+		res, err := db.Exec(`INSERT INTO attachments (uploader, storage_key, thumbnail_key, filename, mime_type, size) VALUES (?, ?, ?, ?, ?, ?)`,
+			username, key, thumbnailKey, fileHeader.Filename, mimeType, fileHeader.Size)
+		if err != nil {
+			log.Println("Ошибка при сохранении вложения в базе:", err)
+			attachmentStorage.Delete(key)
+			if thumbnailKey.Valid {
+				attachmentStorage.Delete(thumbnailKey.String)
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка базы данных"})
+			return
+		}
+		id, _ := res.LastInsertId()
+
+		c.JSON(http.StatusCreated, newAttachment(int(id), fileHeader.Filename, mimeType, fileHeader.Size, thumbnailKey.Valid))
+	}
+}
+
+// downloadSigningKey подписывает ссылки на вложения. Ключ создаётся при запуске:
+// ссылки живут несколько минут, и после перезапуска их достаточно запросить заново.
+var downloadSigningKey = func() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return key
+}()
+
+const downloadLinkTTL = 5 * time.Minute
+
+func downloadSignature(path string, expires int64) string {
+	mac := hmac.New(sha256.New, downloadSigningKey)
+	mac.Write([]byte(path + "\n" + strconv.FormatInt(expires, 10)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signedDownloadURL подписывает путь вместе со сроком действия, поэтому подпись
+// подходит только к одному вложению (или его миниатюре) и только до expiresAt
+func signedDownloadURL(path string, expiresAt time.Time) string {
+	expires := expiresAt.Unix()
+	return fmt.Sprintf("%s?expires=%d&signature=%s", path, expires, downloadSignature(path, expires))
+}
+
+func checkDownloadSignature(path, expires, signature string) bool {
+	exp, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().Unix() > exp {
+		return false
+	}
+	return hmac.Equal([]byte(signature), []byte(downloadSignature(path, exp)))
+}
+
+// storedAttachment — запись о вложении вместе с участниками диалога, к сообщению которого оно привязано
+type storedAttachment struct {
+	uploader, storageKey, filename, mimeType string
+	thumbnailKey, fromUser, toUser           sql.NullString
+	size                                     int64
+}
+
+// findAttachment загружает вложение. Возвращает sql.ErrNoRows, если его нет.
+func findAttachment(db *sql.DB, id int) (storedAttachment, error) {
+	var a storedAttachment
+	err := db.QueryRow(`
+		SELECT a.uploader, a.storage_key, a.thumbnail_key, a.filename, a.mime_type, a.size, fu.username, tu.username
+		FROM attachments a
+		LEFT JOIN messages m ON m.id = a.message_id
+		LEFT JOIN users fu ON fu.id = m.from_user_id
+		LEFT JOIN users tu ON tu.id = m.to_user_id
+		WHERE a.id = ?`, id).
+		Scan(&a.uploader, &a.storageKey, &a.thumbnailKey, &a.filename, &a.mimeType, &a.size, &a.fromUser, &a.toUser)
+	return a, err
+}
+
+// visibleTo — вложение доступно загрузившему его пользователю и участникам диалога
+func (a storedAttachment) visibleTo(username string) bool {
+	return username == a.uploader || username == a.fromUser.String || username == a.toUser.String
+}
+
+// DownloadAttachment отдаёт файл вложения (или его миниатюру, если thumbnail == true).
+// Скачать вложение может только загрузивший его пользователь и участники диалога.
+// Браузер не может добавить заголовок к <img src>, поэтому вместо токена можно передать
+// подпись из GET /attachments/:id/link.
+func DownloadAttachment(db *sql.DB, thumbnail bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Неверный id вложения"})
+			return
+		}
+
+		signed := c.Query("signature") != ""
+		var username string
+		if signed {
+			if !checkDownloadSignature(attachmentPath(id, thumbnail), c.Query("expires"), c.Query("signature")) {
+				c.JSON(http.StatusForbidden, gin.H{"error": "Ссылка недействительна или истекла"})
+				return
+			}
+		} else {
+			var ok bool
+			if username, ok = currentUser(c, db); !ok {
+				return
+			}
+		}
+
+		a, err := findAttachment(db, id)
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Вложение не найдено"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка базы данных"})
+			return
+		}
+
+		// Чужим пользователям отвечаем так же, как на несуществующее вложение
+		if !signed && !a.visibleTo(username) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Вложение не найдено"})
+			return
+		}
+
+		key, size, mimeType := a.storageKey, a.size, a.mimeType
+		if thumbnail {
+			if !a.thumbnailKey.Valid {
+				c.JSON(http.StatusNotFound, gin.H{"error": "Миниатюра отсутствует"})
+				return
+			}
+			key = a.thumbnailKey.String
+			size = -1
+		}
+
+		reader, err := attachmentStorage.Get(key)
+		if err != nil {
+			log.Printf("Ошибка чтения вложения %d: %v", id, err)
+			c.JSON(http.StatusNotFound, gin.H{"error": "Файл не найден"})
+			return
+		}
+		defer reader.Close()
+
+		if thumbnail {
+			// Миниатюры PNG и GIF сохраняются в PNG, остальные — в JPEG
+			if mimeType == "image/png" || mimeType == "image/gif" {
+				mimeType = "image/png"
+			} else {
+				mimeType = "image/jpeg"
+			}
+		}
+
+		c.DataFromReader(http.StatusOK, size, mimeType, reader, map[string]string{
+			"Content-Disposition":    fmt.Sprintf("inline; filename=%q", a.filename),
+			"X-Content-Type-Options": "nosniff",
+		})
+	}
+}
+
+// AttachmentLink выдаёт подписанные ссылки на вложение и его миниатюру. Они действуют
+// downloadLinkTTL и открываются без заголовка Authorization, поэтому токен не попадает в адрес.
+func AttachmentLink(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		username, ok := currentUser(c, db)
+		if !ok {
+			return
+		}
+
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Неверный id вложения"})
+			return
+		}
+		a, err := findAttachment(db, id)
+		if errors.Is(err, sql.ErrNoRows) || (err == nil && !a.visibleTo(username)) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Вложение не найдено"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка базы данных"})
+			return
+		}
+
+		expiresAt := time.Now().Add(downloadLinkTTL)
+		response := gin.H{
+			"url":        signedDownloadURL(attachmentPath(id, false), expiresAt),
+			"expires_at": expiresAt,
+		}
+		if a.thumbnailKey.Valid {
+			response["thumbnail_url"] = signedDownloadURL(attachmentPath(id, true), expiresAt)
+		}
+		c.JSON(http.StatusOK, response)
+	}
+}
+
+func attachmentPath(id int, thumbnail bool) string {
+	if thumbnail {
+		return fmt.Sprintf("/attachments/%d/thumbnail", id)
+	}
+	return fmt.Sprintf("/attachments/%d", id)
+}
+
+// checkAttachments проверяет, что все вложения загружены отправителем и ещё не привязаны к сообщению
+func checkAttachments(db *sql.DB, username string, ids []int) error {
+	for _, id := range ids {
+		var count int
+		err := db.QueryRow(`SELECT COUNT(*) FROM attachments WHERE id = ? AND uploader = ? AND message_id IS NULL`, id, username).Scan(&count)
+		if err != nil {
+			return err
+		}
+		if count == 0 {
+			return fmt.Errorf("вложение %d недоступно для отправки", id)
+		}
+	}
+	return nil
+}
+
+// linkAttachments привязывает загруженные вложения к сохранённому сообщению
+func linkAttachments(db *sql.DB, messageID int, username string, ids []int) error {
+	for _, id := range ids {
+		_, err := db.Exec(`UPDATE attachments SET message_id = ? WHERE id = ? AND uploader = ? AND message_id IS NULL`, messageID, id, username)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadAttachments возвращает вложения указанных сообщений, сгруппированные по id сообщения
+func loadAttachments(db *sql.DB, messageIDs []int) (map[int][]Attachment, error) {
+	result := make(map[int][]Attachment)
+	if len(messageIDs) == 0 {
+		return result, nil
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(messageIDs)), ",")
+	args := make([]interface{}, len(messageIDs))
+	for i, id := range messageIDs {
+		args[i] = id
+	}
+
+	rows, err := db.Query(`
+		SELECT id, message_id, filename, mime_type, size, thumbnail_key IS NOT NULL
+		FROM attachments
+		WHERE message_id IN (`+placeholders+`)
+		ORDER BY id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			id, messageID      int
+			filename, mimeType string
+			size               int64
+			hasThumbnail       bool
+		)
+		if err := rows.Scan(&id, &messageID, &filename, &mimeType, &size, &hasThumbnail); err != nil {
+			return nil, err
+		}
+		result[messageID] = append(result[messageID], newAttachment(id, filename, mimeType, size, hasThumbnail))
+	}
+	return result, rows.Err()
+}
+
+// deleteMessageAttachments удаляет файлы и записи вложений удалённого сообщения
+func deleteMessageAttachments(db *sql.DB, messageID int) error {
+	return deleteAttachmentsWhere(db, "message_id = ?", messageID)
+}
+
+// deleteAttachmentsWhere удаляет файлы и записи вложений, подходящих под условие
+func deleteAttachmentsWhere(db *sql.DB, condition string, args ...interface{}) error {
+	keys, err := attachmentFilesWhere(db, condition, args...)
+	if err != nil {
+		return err
+	}
+	deleteStoredFiles(keys)
+
+	_, err = db.Exec(`DELETE FROM attachments WHERE `+condition, args...)
+	return err
+}
+
+// attachmentFilesWhere — ключи файлов и миниатюр вложений, подходящих под условие
+func attachmentFilesWhere(db *sql.DB, condition string, args ...interface{}) ([]string, error) {
+	rows, err := db.Query(`SELECT storage_key, thumbnail_key FROM attachments WHERE `+condition, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var key string
+		var thumbnailKey sql.NullString
+		if err := rows.Scan(&key, &thumbnailKey); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+		if thumbnailKey.Valid {
+			keys = append(keys, thumbnailKey.String)
+		}
+	}
+	return keys, rows.Err()
+}
+
+// deleteStoredFiles удаляет файлы из хранилища; ошибки только записываются в журнал
+func deleteStoredFiles(keys []string) {
+	for _, key := range keys {
+		if err := attachmentStorage.Delete(key); err != nil {
+			log.Printf("Ошибка удаления файла %s: %v", key, err)
+		}
+	}
+}
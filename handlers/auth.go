@@ -0,0 +1,217 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"gorutines/authorization_tools"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+var errSessionRevoked = errors.New("сессия завершена")
+
+// authUser — пользователь, прошедший проверку access токена или API-ключа
+type authUser struct {
+	ID        int
+	Username  string
+	SessionID int
+
+	// Для ботов, вошедших по API-ключу: id ключа и разрешённые ему области действия
+	KeyID  int
+	Scopes []string
+}
+
+// isBot сообщает, что запрос сделан ботом по API-ключу
+func (u authUser) isBot() bool {
+	return u.KeyID != 0
+}
+
+// can сообщает, разрешено ли действие: пользователю по JWT разрешено всё, ключу — его области
+func (u authUser) can(scope string) bool {
+	return !u.isBot() || authorization_tools.HasScope(u.Scopes, scope)
+}
+
+// apiKeyRoutes — маршруты, доступные по API-ключу, и нужная для них область действия
+// (пустая строка — любая). Остальные маршруты, в том числе сессии, профиль и управление
+// ботами, доступны только по JWT.
+var apiKeyRoutes = map[string]string{
+	"GET /me":                        "",
+	"GET /get-chats":                 authorization_tools.ScopeMessagesRead,
+	"GET /get-messages":              authorization_tools.ScopeMessagesRead,
+	"GET /search":                    authorization_tools.ScopeMessagesRead,
+	"GET /attachments/:id":           authorization_tools.ScopeMessagesRead,
+	"GET /attachments/:id/thumbnail": authorization_tools.ScopeMessagesRead,
+	"GET /attachments/:id/link":      authorization_tools.ScopeMessagesRead,
+	"POST /attachments":              authorization_tools.ScopeMessagesWrite,
+	"GET /commands":                  "",
+	"POST /commands":                 authorization_tools.ScopeMessagesWrite,
+	"DELETE /commands/:name":         authorization_tools.ScopeMessagesWrite,
+}
+
+// authenticateToken проверяет access токен и то, что его сессия не была отозвана.
+// Пользователь определяется по id из sub, поэтому смена имени не делает токен чужим.
+// Вместо access токена можно передать API-ключ бота.
+func authenticateToken(tokenString string, db *sql.DB) (authUser, error) {
+	if authorization_tools.IsAPIKey(tokenString) {
+		userID, username, keyID, scopes, err := authorization_tools.AuthenticateAPIKey(tokenString, db)
+		if err != nil {
+			return authUser{}, err
+		}
+		return authUser{ID: userID, Username: username, KeyID: keyID, Scopes: scopes}, nil
+	}
+
+	status, err := authorization_tools.ValidateAccessToken(tokenString)
+	if err != nil {
+		return authUser{}, err
+	}
+	if !status {
+		return authUser{}, errors.New("Unauthorized")
+	}
+
+	claims, err := authorization_tools.GetClaims(tokenString)
+	if err != nil {
+		return authUser{}, err
+	}
+	userID, username, err := authorization_tools.UserFromClaims(claims, db)
+	if err != nil {
+		return authUser{}, err
+	}
+
+	// Токены, выпущенные до появления сессий, не содержат sid — их нужно обновить через /refresh
+	sid, ok := claims["sid"].(float64)
+	if !ok {
+		return authUser{}, errSessionRevoked
+	}
+	sessionID := int(sid)
+
+	exists, err := authorization_tools.SessionExists(userID, sessionID, db)
+	if err != nil {
+		return authUser{}, err
+	}
+	if !exists {
+		return authUser{}, errSessionRevoked
+	}
+	return authUser{ID: userID, Username: username, SessionID: sessionID}, nil
+}
+
+// currentUser проверяет access токен из заголовка Authorization и возвращает имя пользователя.
+// Если токен не прошёл проверку, ответ клиенту уже отправлен и ok == false.
+func currentUser(c *gin.Context, db *sql.DB) (string, bool) {
+	user, ok := currentSession(c, db)
+	return user.Username, ok
+}
+
+// currentSession — то же, что currentUser, но возвращает id пользователя и сессии
+func currentSession(c *gin.Context, db *sql.DB) (authUser, bool) {
+	tokenString, err := authorization_tools.ExtractToken(c.GetHeader("Authorization"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return authUser{}, false
+	}
+
+	user, err := authenticateToken(tokenString, db)
+	if errors.Is(err, authorization_tools.ErrAPIKeyDisabled) {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return authUser{}, false
+	}
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return authUser{}, false
+	}
+
+	if user.isBot() {
+		scope, allowed := apiKeyRoutes[c.Request.Method+" "+c.FullPath()]
+		if !allowed {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Метод недоступен по API-ключу"})
+			return authUser{}, false
+		}
+		if scope != "" && !user.can(scope) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "API-ключу не разрешено: " + scope})
+			return authUser{}, false
+		}
+	}
+	return user, true
+}
+
+// sessionInfo собирает сведения об устройстве клиента для списка сессий
+func sessionInfo(c *gin.Context, deviceName string) authorization_tools.SessionInfo {
+	return authorization_tools.SessionInfo{
+		DeviceName: deviceName,
+		UserAgent:  c.Request.UserAgent(),
+		IP:         c.ClientIP(),
+	}
+}
+
+// handleRefreshTokenError отвечает клиенту на ошибку проверки refresh токена.
+// При повторном использовании токена его семья уже отозвана: закрываем соединения
+// этой сессии и записываем событие в журнал.
+func handleRefreshTokenError(c *gin.Context, db *sql.DB, err error) {
+	var reuseErr *authorization_tools.RefreshTokenReuseError
+	if !errors.As(err, &reuseErr) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	disconnectSession(reuseErr.Username, reuseErr.FamilyID)
+	details := fmt.Sprintf("family_id=%d, user_agent=%s", reuseErr.FamilyID, c.Request.UserAgent())
+	if logErr := authorization_tools.LogAuthEvent(db, reuseErr.Username, "refresh_token_reuse", c.ClientIP(), details); logErr != nil {
+		log.Println("Ошибка записи события безопасности:", logErr)
+	}
+	log.Printf("Повторное использование refresh токена пользователя %s, сессия %d отозвана", reuseErr.Username, reuseErr.FamilyID)
+
+	c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+}
+
+// errInvalidCredentials — единый ответ на неизвестное имя и неверный пароль
+const errInvalidCredentials = "Ошибка учетной записи"
+
+// beginLoginAttempt учитывает попытку подбора пароля или кода до проверки. Если вход под этим именем
+// или с этого адреса временно заблокирован, отвечает 429 и возвращает false.
+func beginLoginAttempt(c *gin.Context, db *sql.DB, username string) bool {
+	wait, err := authorization_tools.BeginLoginAttempt(username, c.ClientIP(), db)
+	if err != nil {
+		log.Println("Ошибка учёта попытки входа:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка базы данных"})
+		return false
+	}
+	if wait <= 0 {
+		return true
+	}
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	c.JSON(http.StatusTooManyRequests, gin.H{"error": "Слишком много неудачных попыток, попробуйте позже"})
+	return false
+}
+
+// loginAttemptPassed возвращает попытку, учтённую beginLoginAttempt, если пароль или код верны
+func loginAttemptPassed(c *gin.Context, db *sql.DB, username string) {
+	if err := authorization_tools.LoginAttemptSucceeded(username, c.ClientIP(), db); err != nil {
+		log.Println("Ошибка учёта попытки входа:", err)
+	}
+}
+
+// verifyCredentials проверяет пароль с защитой от подбора. Ответ не зависит от того,
+// существует ли пользователь. Если проверка не прошла, ответ клиенту уже отправлен.
+// Счётчик неудач здесь не сбрасывается: при входе с двухфакторной аутентификацией
+// верный пароль ещё не завершает вход, сброс делает startSession.
+func verifyCredentials(c *gin.Context, db *sql.DB, username, password string) bool {
+	if !beginLoginAttempt(c, db, username) {
+		return false
+	}
+
+	valid, err := authorization_tools.CheckPassword(username, password, db)
+	if err != nil {
+		log.Println("Ошибка проверки пароля:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка базы данных"})
+		return false
+	}
+	if !valid {
+		c.JSON(http.StatusBadRequest, gin.H{"error": errInvalidCredentials})
+		return false
+	}
+	loginAttemptPassed(c, db, username)
+	return true
+}
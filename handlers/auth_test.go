@@ -0,0 +1,106 @@
+package handlers
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Пороги из authorization_tools: неудачи, которые допускаются без блокировки
+const accountFreeAttempts, ipFreeAttempts = 5, 20
+
+func TestLoginLockout(t *testing.T) {
+	db := newTestDB(t)
+	SetMailer(&captureMailer{}, "")
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/users", CreateUsers(db))
+	router.POST("/login", Login(db))
+
+	const password = "Quiet-harb0r-passphrase"
+	if code, body := doJSON(t, router, "POST", "/users", "", gin.H{
+		"username": "bob", "email": "bob@example.com", "password": password,
+	}); code != http.StatusOK && code != http.StatusCreated {
+		t.Fatalf("регистрация: %d %v", code, body)
+	}
+	login := func(username, password string) int {
+		t.Helper()
+		code, _ := doJSON(t, router, "POST", "/login", "", gin.H{"username": username, "password": password})
+		return code
+	}
+
+	t.Run("порог учётной записи", func(t *testing.T) {
+		// Пять неудач допускаются без задержки, шестая включает блокировку
+		for i := 1; i <= accountFreeAttempts+1; i++ {
+			if code := login("bob", "wrong-password"); code != http.StatusBadRequest {
+				t.Fatalf("неудачная попытка %d: %d, ожидался 400", i, code)
+			}
+		}
+		req := httptest.NewRequest("POST", "/login", strings.NewReader(`{"username": "bob", "password": "`+password+`"}`))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusTooManyRequests {
+			t.Fatalf("вход с верным паролем во время блокировки: %d, ожидался 429", w.Code)
+		}
+		if seconds, err := strconv.Atoi(w.Header().Get("Retry-After")); err != nil || seconds < 1 || seconds > 30 {
+			t.Errorf("Retry-After = %q, ожидалось от 1 до 30 секунд", w.Header().Get("Retry-After"))
+		}
+
+		if _, err := db.Exec(`DELETE FROM login_attempts WHERE key = 'user:bob'`); err != nil {
+			t.Fatal(err)
+		}
+		if code := login("bob", password); code != http.StatusOK {
+			t.Errorf("вход после снятия блокировки: %d", code)
+		}
+	})
+
+	t.Run("параллельные попытки", func(t *testing.T) {
+		if _, err := db.Exec(`DELETE FROM login_attempts`); err != nil {
+			t.Fatal(err)
+		}
+		const parallel = 20
+		codes := make(chan int, parallel)
+		var wg sync.WaitGroup
+		for i := 0; i < parallel; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				codes <- login("bob", "wrong-password")
+			}()
+		}
+		wg.Wait()
+		close(codes)
+
+		checked := 0
+		for code := range codes {
+			if code == http.StatusBadRequest {
+				checked++
+			} else if code != http.StatusTooManyRequests {
+				t.Errorf("параллельная попытка: %d", code)
+			}
+		}
+		if checked > accountFreeAttempts+1 {
+			t.Errorf("пароль проверен %d раз, допускается не больше %d", checked, accountFreeAttempts+1)
+		}
+	})
+
+	t.Run("порог адреса", func(t *testing.T) {
+		if _, err := db.Exec(`DELETE FROM login_attempts`); err != nil {
+			t.Fatal(err)
+		}
+		// Разные имена с одного адреса: блокируется адрес, а не учётные записи
+		for i := 1; i <= ipFreeAttempts+1; i++ {
+			if code := login("guess"+strconv.Itoa(i), "wrong-password"); code != http.StatusBadRequest {
+				t.Fatalf("неудачная попытка %d: %d, ожидался 400", i, code)
+			}
+		}
+		if code := login("bob", password); code != http.StatusTooManyRequests {
+			t.Errorf("вход с заблокированного адреса: %d, ожидался 429", code)
+		}
+	})
+}
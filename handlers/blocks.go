@@ -0,0 +1,140 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+)
+
+// BlockedUser — запись в списке заблокированных пользователей
+type BlockedUser struct {
+	Username  string `json:"username"`
+	CreatedAt string `json:"created_at"`
+}
+
+// isBlocked сообщает, заблокировал ли хотя бы один из пользователей другого.
+// Блокировка действует в обе стороны: заблокированные не видят событий друг друга.
+func isBlocked(db *sql.DB, a, b string) (bool, error) {
+	var count int
+	err := db.QueryRow(`
+		SELECT COUNT(*) FROM blocks
+		WHERE (blocker = ? AND blocked = ?) OR (blocker = ? AND blocked = ?)`, a, b, b, a).Scan(&count)
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// BlockUser — блокировка пользователя (тело запроса: {"username": "..."})
+func BlockUser(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		username, ok := currentUser(c, db)
+		if !ok {
+			return
+		}
+
+		var request struct {
+			Username string `json:"username" binding:"required"`
+		}
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if request.Username == username {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Нельзя заблокировать самого себя"})
+			return
+		}
+
+		var id int
+		err := db.QueryRow("SELECT id FROM users WHERE username = ?", request.Username).Scan(&id)
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Пользователь не найден"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка базы данных"})
+			return
+		}
+
+		_, err = db.Exec(`INSERT OR IGNORE INTO blocks (blocker, blocked) VALUES (?, ?)`, username, request.Username)
+		if err != nil {
+			log.Println("Ошибка при блокировке пользователя:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка базы данных"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": request.Username + " blocked"})
+	}
+}
+
+// UnblockUser — снятие блокировки с пользователя из параметра пути
+func UnblockUser(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		username, ok := currentUser(c, db)
+		if !ok {
+			return
+		}
+
+		blocked := c.Param("username")
+		res, err := db.Exec(`DELETE FROM blocks WHERE blocker = ? AND blocked = ?`, username, blocked)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка базы данных"})
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Пользователь не заблокирован"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": blocked + " unblocked"})
+	}
+}
+
+// GetBlockedUsers — список пользователей, заблокированных текущим пользователем
+func GetBlockedUsers(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		username, ok := currentUser(c, db)
+		if !ok {
+			return
+		}
+
+		rows, err := db.Query(`SELECT blocked, created_at FROM blocks WHERE blocker = ? ORDER BY created_at DESC`, username)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка базы данных"})
+			return
+		}
+		defer rows.Close()
+
+		blocked := []BlockedUser{}
+		for rows.Next() {
+			var b BlockedUser
+			if err := rows.Scan(&b.Username, &b.CreatedAt); err != nil {
+				continue
+			}
+			blocked = append(blocked, b)
+		}
+		c.JSON(http.StatusOK, blocked)
+	}
+}
+
+// blockedPeers возвращает всех пользователей, связанных с username блокировкой в любую сторону
+func blockedPeers(db *sql.DB, username string) (map[string]bool, error) {
+	rows, err := db.Query(`
+		SELECT blocked FROM blocks WHERE blocker = ?
+		UNION
+		SELECT blocker FROM blocks WHERE blocked = ?`, username, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	peers := make(map[string]bool)
+	for rows.Next() {
+		var peer string
+		if err := rows.Scan(&peer); err != nil {
+			return nil, err
+		}
+		peers[peer] = true
+	}
+	return peers, rows.Err()
+}
@@ -0,0 +1,264 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"gorutines/authorization_tools"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const maxBotsPerOwner = 10
+
+// Bot — бот в списке ботов владельца
+type Bot struct {
+	ID          int    `json:"id"`
+	Username    string `json:"username"`
+	DisplayName string `json:"display_name"`
+}
+
+// CreateBot — регистрация бота текущим пользователем (тело запроса: {"username": "...", "display_name": "..."})
+func CreateBot(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		owner, ok := currentSession(c, db)
+		if !ok {
+			return
+		}
+
+		var request struct {
+			Username    string `json:"username" binding:"required"`
+			DisplayName string `json:"display_name"`
+		}
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		request.Username = strings.TrimSpace(request.Username)
+		request.DisplayName = strings.TrimSpace(request.DisplayName)
+		if validationFailed(c, authorization_tools.ValidateUsername(request.Username)) {
+			return
+		}
+
+		count, err := authorization_tools.CountBots(owner.ID, db)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка базы данных"})
+			return
+		}
+		if count >= maxBotsPerOwner {
+			c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Нельзя создать больше %d ботов", maxBotsPerOwner)})
+			return
+		}
+
+		id, err := authorization_tools.CreateBot(owner.ID, request.Username, request.DisplayName, db)
+		if err != nil {
+			if uniqueViolation(c, err) {
+				return
+			}
+			log.Println("Ошибка при создании бота:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка базы данных"})
+			return
+		}
+
+		if err := authorization_tools.LogAuthEvent(db, owner.Username, "bot_created", c.ClientIP(), "bot="+request.Username); err != nil {
+			log.Println("Ошибка записи события авторизации:", err)
+		}
+		c.JSON(http.StatusCreated, Bot{ID: id, Username: request.Username, DisplayName: request.DisplayName})
+	}
+}
+
+// GetBots — список ботов текущего пользователя
+func GetBots(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		owner, ok := currentSession(c, db)
+		if !ok {
+			return
+		}
+
+		rows, err := db.Query(`SELECT id, username, COALESCE(display_name, '') FROM users WHERE bot_owner_id = ? ORDER BY id`, owner.ID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка базы данных"})
+			return
+		}
+		defer rows.Close()
+
+		bots := []Bot{}
+		for rows.Next() {
+			var b Bot
+			if err := rows.Scan(&b.ID, &b.Username, &b.DisplayName); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка базы данных"})
+				return
+			}
+			bots = append(bots, b)
+		}
+		c.JSON(http.StatusOK, bots)
+	}
+}
+
+// DeleteBot удаляет бота вместе с его ключами, как при удалении учётной записи
+func DeleteBot(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		owner, ok := currentSession(c, db)
+		if !ok {
+			return
+		}
+		botID, ok := ownedBot(c, db, owner.ID)
+		if !ok {
+			return
+		}
+
+		if err := purgeAccount(db, botID); err != nil {
+			log.Println("Ошибка при удалении бота:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Не удалось удалить бота"})
+			return
+		}
+		if err := authorization_tools.LogAuthEvent(db, owner.Username, "bot_deleted", c.ClientIP(), "bot="+c.Param("username")); err != nil {
+			log.Println("Ошибка записи события авторизации:", err)
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "bot deleted"})
+	}
+}
+
+// CreateAPIKey выпускает ключ бота (тело запроса: {"name": "...", "scopes": ["messages:read", ...]}).
+// Ключ возвращается только в этом ответе.
+func CreateAPIKey(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		owner, ok := currentSession(c, db)
+		if !ok {
+			return
+		}
+		botID, ok := ownedBot(c, db, owner.ID)
+		if !ok {
+			return
+		}
+
+		var request struct {
+			Name   string   `json:"name" binding:"required"`
+			Scopes []string `json:"scopes"`
+		}
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		scopes, err := authorization_tools.ValidateScopes(request.Scopes)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		key, info, err := authorization_tools.CreateAPIKey(botID, request.Name, scopes, db)
+		if err != nil {
+			log.Println("Ошибка при создании API-ключа:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка базы данных"})
+			return
+		}
+
+		details := fmt.Sprintf("bot=%s, key_id=%d", c.Param("username"), info.ID)
+		if err := authorization_tools.LogAuthEvent(db, owner.Username, "api_key_created", c.ClientIP(), details); err != nil {
+			log.Println("Ошибка записи события авторизации:", err)
+		}
+		c.JSON(http.StatusCreated, gin.H{"key": key, "api_key": info})
+	}
+}
+
+// GetAPIKeys — список ключей бота без самих ключей
+func GetAPIKeys(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		owner, ok := currentSession(c, db)
+		if !ok {
+			return
+		}
+		botID, ok := ownedBot(c, db, owner.ID)
+		if !ok {
+			return
+		}
+
+		keys, err := authorization_tools.ListAPIKeys(botID, db)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка базы данных"})
+			return
+		}
+		c.JSON(http.StatusOK, keys)
+	}
+}
+
+// RevokeAPIKey отзывает ключ бота и закрывает открытые по нему соединения
+func RevokeAPIKey(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		owner, ok := currentSession(c, db)
+		if !ok {
+			return
+		}
+		botID, ok := ownedBot(c, db, owner.ID)
+		if !ok {
+			return
+		}
+
+		keyID, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Неверный id ключа"})
+			return
+		}
+		found, err := authorization_tools.RevokeAPIKey(botID, keyID, db)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка базы данных"})
+			return
+		}
+		if !found {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Ключ не найден"})
+			return
+		}
+		disconnectAPIKey(c.Param("username"), keyID)
+
+		details := fmt.Sprintf("bot=%s, key_id=%d", c.Param("username"), keyID)
+		if err := authorization_tools.LogAuthEvent(db, owner.Username, "api_key_revoked", c.ClientIP(), details); err != nil {
+			log.Println("Ошибка записи события авторизации:", err)
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "api key revoked"})
+	}
+}
+
+// ownedBot находит бота из параметра :username среди ботов владельца.
+// Чужие боты неотличимы от несуществующих.
+func ownedBot(c *gin.Context, db *sql.DB, ownerID int) (int, bool) {
+	botID, err := authorization_tools.BotOwnedBy(ownerID, c.Param("username"), db)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Бот не найден"})
+		return 0, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка базы данных"})
+		return 0, false
+	}
+	return botID, true
+}
+
+// disconnectOwnedBots закрывает соединения ботов пользователя: их ключи не действуют,
+// пока владелец заблокирован или ожидает удаления
+func disconnectOwnedBots(db *sql.DB, owner string) {
+	rows, err := db.Query(`
+		SELECT b.username FROM users b
+		JOIN users o ON o.id = b.bot_owner_id
+		WHERE o.username = ?`, owner)
+	if err != nil {
+		log.Printf("Ошибка получения ботов %s: %v", owner, err)
+		return
+	}
+	var bots []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			log.Printf("Ошибка получения ботов %s: %v", owner, err)
+			break
+		}
+		bots = append(bots, name)
+	}
+	rows.Close()
+
+	for _, name := range bots {
+		disconnectUser(name)
+	}
+}
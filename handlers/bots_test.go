@@ -0,0 +1,67 @@
+package handlers
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAPIKeyScopes(t *testing.T) {
+	db := newTestDB(t)
+	SetMailer(&captureMailer{}, "")
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/users", CreateUsers(db))
+	router.POST("/login", Login(db))
+	router.POST("/bots", CreateBot(db))
+	router.POST("/bots/:username/keys", CreateAPIKey(db))
+	router.GET("/me", GetProfile(db))
+	router.GET("/sessions", GetSessions(db))
+	router.POST("/attachments", UploadAttachment(db))
+	router.GET("/ws", func(c *gin.Context) { WebSocketHandler(c, db) })
+
+	const password = "Quiet-harb0r-passphrase"
+	if code, body := doJSON(t, router, "POST", "/users", "", gin.H{
+		"username": "owner", "email": "owner@example.com", "password": password,
+	}); code != http.StatusOK && code != http.StatusCreated {
+		t.Fatalf("регистрация: %d %v", code, body)
+	}
+	code, body := doJSON(t, router, "POST", "/login", "", gin.H{"username": "owner", "password": password})
+	if code != http.StatusOK {
+		t.Fatalf("вход: %d %v", code, body)
+	}
+	accessToken, _ := body["accessToken"].(string)
+
+	if code, body := doJSON(t, router, "POST", "/bots", accessToken, gin.H{"username": "helper"}); code != http.StatusCreated {
+		t.Fatalf("создание бота: %d %v", code, body)
+	}
+	code, body = doJSON(t, router, "POST", "/bots/helper/keys", accessToken, gin.H{
+		"name": "reader", "scopes": []string{"messages:read"},
+	})
+	if code != http.StatusCreated {
+		t.Fatalf("создание ключа: %d %v", code, body)
+	}
+	key, _ := body["key"].(string)
+
+	for _, tc := range []struct {
+		name, method, path string
+		want               int
+	}{
+		{"маршрут без области действия", "GET", "/me", http.StatusOK},
+		{"маршрут только для JWT", "GET", "/sessions", http.StatusForbidden},
+		{"не хватает messages:write", "POST", "/attachments", http.StatusForbidden},
+	} {
+		if code, body := doJSON(t, router, tc.method, tc.path, key, nil); code != tc.want {
+			t.Errorf("%s: %s %s = %d %v, ожидался %d", tc.name, tc.method, tc.path, code, body, tc.want)
+		}
+	}
+
+	t.Run("ключ в адресе /ws", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/ws?token="+key, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("подключение с ключом в ?token=: %d, ожидался 400", w.Code)
+		}
+	})
+}
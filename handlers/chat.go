@@ -5,14 +5,16 @@ import (
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"gorutines/authorization_tools"
+	"gorutines/webhook_tools"
 	"net/http"
 )
 
 // ChatPreview — структура для списка чатов
 type ChatPreview struct {
-	Username    string `json:"username"`     // Имя собеседника
-	LastMessage string `json:"last_message"` // Последнее сообщение
-	Timestamp   string `json:"timestamp"`    // Время последнего сообщения
+	Username    string `json:"username"`        // Имя собеседника
+	LastMessage string `json:"last_message"`    // Последнее сообщение
+	Timestamp   string `json:"timestamp"`       // Время последнего сообщения
+	Draft       string `json:"draft,omitempty"` // Неотправленный черновик
 }
 
 type ChatMessage struct {
@@ -21,49 +23,35 @@ type ChatMessage struct {
 	ToUser    string `json:"to"`
 	Content   string `json:"content"`
 	Timestamp string `json:"timestamp"`
+
+	Attachments []Attachment `json:"attachments,omitempty"`
 }
 
 // GetUserChats — загрузка списка чатов для пользователя
 func GetUserChats(db *sql.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		// Получаем токен и извлекаем username
-		tokenString, err := authorization_tools.ExtractToken(c.GetHeader("Authorization"))
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-			return
-		}
-
-		status, err := authorization_tools.ValidateAccessToken(tokenString)
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-			return
-		}
-		if !status {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		// Получаем токен и извлекаем пользователя
+		user, ok := currentSession(c, db)
+		if !ok {
 			return
 		}
+		username := user.Username
 
-		claims, err := authorization_tools.GetClaims(tokenString)
-		if err != nil {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Неверный токен"})
-			return
-		}
-		username := claims["username"].(string)
-
-		// SQL-запрос: Найти все чаты пользователя и последние сообщения
+		// SQL-запрос: Найти все чаты пользователя и последние сообщения.
+		// Сообщения хранят id участников, имя собеседника берём из users.
 		query := `
-			SELECT 
-				CASE 
-					WHEN from_user = ? THEN to_user 
-					ELSE from_user 
-				END AS username, 
-				content, created_at 
-			FROM messages 
-			WHERE from_user = ? OR to_user = ? 
-			GROUP BY username
+			SELECT u.username, m.content, MAX(m.created_at) AS created_at
+			FROM messages m
+			JOIN users u ON u.id = CASE
+				WHEN m.from_user_id = ? THEN m.to_user_id
+				ELSE m.from_user_id
+			END
+			WHERE m.from_user_id = ? OR m.to_user_id = ?
+			GROUP BY u.id
+			HAVING u.username NOT IN (SELECT blocked FROM blocks WHERE blocker = ?)
 			ORDER BY created_at DESC;`
 
-		rows, err := db.Query(query, username, username, username)
+		rows, err := db.Query(query, user.ID, user.ID, user.ID, username)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка базы данных"})
 			return
@@ -79,6 +67,22 @@ func GetUserChats(db *sql.DB) gin.HandlerFunc {
 			chats = append(chats, chat)
 		}
 
+		drafts, err := loadDrafts(db, username)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка базы данных"})
+			return
+		}
+		for i := range chats {
+			if draft, ok := drafts[chats[i].Username]; ok {
+				chats[i].Draft = draft
+				delete(drafts, chats[i].Username)
+			}
+		}
+		// Черновики для собеседников, с которыми ещё нет переписки
+		for peer, draft := range drafts {
+			chats = append(chats, ChatPreview{Username: peer, Draft: draft})
+		}
+
 		c.JSON(http.StatusOK, chats)
 	}
 }
@@ -86,44 +90,33 @@ func GetUserChats(db *sql.DB) gin.HandlerFunc {
 // GetChatMessages — загрузка сообщений с определённым пользователем
 func GetChatMessages(db *sql.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		tokenString, err := authorization_tools.ExtractToken(c.GetHeader("Authorization"))
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		user, ok := currentSession(c, db)
+		if !ok {
 			return
 		}
 
-		status, err := authorization_tools.ValidateAccessToken(tokenString)
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-			return
-		}
-		if !status {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
-			return
-		}
-
-		claims, err := authorization_tools.GetClaims(tokenString)
-		if err != nil {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Неверный токен"})
-			return
-		}
-		currentUser := claims["username"].(string)
-
 		// Получаем имя собеседника из параметров запроса
 		otherUser := c.Query("user")
 		if otherUser == "" {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "Не указан пользователь"})
 			return
 		}
+		otherID, err := authorization_tools.GetUserID(otherUser, db)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Пользователь не найден"})
+			return
+		}
 
 		// SQL-запрос: Получаем все сообщения между пользователями
 		query := `
-			SELECT id, from_user, to_user, content, created_at 
-			FROM messages 
-			WHERE (from_user = ? AND to_user = ?) OR (from_user = ? AND to_user = ?) 
-			ORDER BY created_at ASC;`
-
-		rows, err := db.Query(query, currentUser, otherUser, otherUser, currentUser)
+			SELECT m.id, fu.username, tu.username, m.content, m.created_at
+			FROM messages m
+			JOIN users fu ON fu.id = m.from_user_id
+			JOIN users tu ON tu.id = m.to_user_id
+			WHERE (m.from_user_id = ? AND m.to_user_id = ?) OR (m.from_user_id = ? AND m.to_user_id = ?)
+			ORDER BY m.created_at ASC;`
+
+		rows, err := db.Query(query, user.ID, otherID, otherID, user.ID)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка базы данных"})
 			return
@@ -139,49 +132,93 @@ func GetChatMessages(db *sql.DB) gin.HandlerFunc {
 			messages = append(messages, msg)
 		}
 
+		ids := make([]int, len(messages))
+		for i, msg := range messages {
+			ids[i] = msg.ID
+		}
+		attachments, err := loadAttachments(db, ids)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка базы данных"})
+			return
+		}
+		for i := range messages {
+			messages[i].Attachments = attachments[messages[i].ID]
+		}
+
 		c.JSON(http.StatusOK, messages)
 	}
 }
 
-func DeleteMessage(db *sql.DB, messageID int, username string) error {
-	var author string
-	err := db.QueryRow("SELECT from_user FROM messages WHERE id = ?", messageID).Scan(&author)
+func DeleteMessage(db *sql.DB, messageID int, userID int) error {
+	var author int
+	err := db.QueryRow("SELECT from_user_id FROM messages WHERE id = ?", messageID).Scan(&author)
 	if err != nil {
 		return fmt.Errorf("ошибка при получении автора сообщения: %v", err)
 	}
 
 	// Проверяем, является ли текущий пользователь автором
-	if author != username {
-		return fmt.Errorf("пользователь %s пытался удалить чужое сообщение", username)
+	if author != userID {
+		return fmt.Errorf("пользователь %d пытался удалить чужое сообщение", userID)
+	}
+
+	if err := removeMessage(db, messageID); err != nil {
+		return err
+	}
+	fmt.Printf("Сообщение %d удалено пользователем %d\n", messageID, userID)
+
+	return nil
+}
+
+// DeleteMessageAsModerator удаляет любое сообщение без проверки авторства
+func DeleteMessageAsModerator(db *sql.DB, messageID int, moderator string) error {
+	if err := removeMessage(db, messageID); err != nil {
+		return err
+	}
+	fmt.Printf("Сообщение %d удалено модератором %s\n", messageID, moderator)
+
+	return nil
+}
+
+// removeMessage удаляет сообщение вместе с вложениями и уведомляет WebSocket-клиентов и вебхуки
+func removeMessage(db *sql.DB, messageID int) error {
+	// Участников нужно узнать до удаления, иначе вебхукам нечего будет отправить
+	fromID, toID, from, to, participantsErr := messageParticipants(db, messageID)
+
+	if err := deleteMessageAttachments(db, messageID); err != nil {
+		return fmt.Errorf("ошибка при удалении вложений сообщения %d: %v", messageID, err)
 	}
 
 	// Удаляем сообщение
-	_, err = db.Exec("DELETE FROM messages WHERE id = ?", messageID)
+	_, err := db.Exec("DELETE FROM messages WHERE id = ?", messageID)
 	if err != nil {
 		return fmt.Errorf("ошибка при удалении сообщения %d: %v", messageID, err)
 	}
 
 	// Отправляем уведомление WebSocket-клиентам
 	SendDeleteMessageNotification(messageID)
-	fmt.Printf("Сообщение %d удалено пользователем %s\n", messageID, username)
+	if participantsErr == nil {
+		notifyWebhooks(db, webhook_tools.EventDeleteMessage, fromID, toID, MessageChangeEvent{
+			Action: webhook_tools.EventDeleteMessage, MessageID: messageID, From: from, To: to,
+		})
+	}
 
 	return nil
 }
 
-func EditMessage(db *sql.DB, messageID int, username string, newContent string) error {
-	var author string
-	err := db.QueryRow("SELECT from_user FROM messages WHERE id = ?", messageID).Scan(&author)
+func EditMessage(db *sql.DB, messageID int, userID int, newContent string) error {
+	var author int
+	err := db.QueryRow("SELECT from_user_id FROM messages WHERE id = ?", messageID).Scan(&author)
 	if err != nil {
 		return fmt.Errorf("ошибка при получении автора сообщения: %v", err)
 	}
 
 	// Проверяем, является ли текущий пользователь автором
-	if author != username {
-		return fmt.Errorf("пользователь %s пытался удалить чужое сообщение", username)
+	if author != userID {
+		return fmt.Errorf("пользователь %d пытался удалить чужое сообщение", userID)
 	}
 
-	query := `UPDATE messages SET content = ? WHERE id = ? AND from_user = ?`
-	res, err := db.Exec(query, newContent, messageID, username)
+	query := `UPDATE messages SET content = ? WHERE id = ? AND from_user_id = ?`
+	res, err := db.Exec(query, newContent, messageID, userID)
 	if err != nil {
 		return fmt.Errorf("ошибка обновления сообщения: %v", err)
 	}
@@ -192,5 +229,13 @@ func EditMessage(db *sql.DB, messageID int, username string, newContent string)
 
 	// Отправляем всем клиентам событие об изменении сообщения
 	SendEditMessageNotification(messageID, newContent)
+
+	fromID, toID, from, to, err := messageParticipants(db, messageID)
+	if err != nil {
+		return fmt.Errorf("ошибка при получении участников сообщения: %v", err)
+	}
+	notifyWebhooks(db, webhook_tools.EventEditMessage, fromID, toID, MessageChangeEvent{
+		Action: webhook_tools.EventEditMessage, MessageID: messageID, From: from, To: to, NewContent: newContent,
+	})
 	return nil
 }
@@ -0,0 +1,184 @@
+package handlers
+
+import (
+	"encoding/json"
+	"github.com/gorilla/websocket"
+	"log"
+	"sync"
+	"time"
+)
+
+// client — одно WebSocket-соединение пользователя.
+// У пользователя может быть несколько соединений одновременно (телефон, ноутбук).
+type client struct {
+	userID    int
+	username  string // меняется при смене имени, читать через name() вне clientsMu
+	sessionID int    // сессия (refresh токен), по access токену которой открыто соединение
+	apiKeyID  int    // ключ, по которому подключился бот (0 — пользователь по JWT)
+	scopes    []string
+	conn      *websocket.Conn
+	writeMu   sync.Mutex // gorilla/websocket не допускает параллельную запись в соединение
+}
+
+func (cl *client) name() string {
+	clientsMu.RLock()
+	defer clientsMu.RUnlock()
+	return cl.username
+}
+
+// isBot сообщает, что соединение открыто ботом по API-ключу
+func (cl *client) isBot() bool {
+	return cl.apiKeyID != 0
+}
+
+// can сообщает, разрешено ли действие в этом соединении
+func (cl *client) can(scope string) bool {
+	return authUser{KeyID: cl.apiKeyID, Scopes: cl.scopes}.can(scope)
+}
+
+func (cl *client) send(data []byte) error {
+	cl.writeMu.Lock()
+	defer cl.writeMu.Unlock()
+	return cl.conn.WriteMessage(websocket.TextMessage, data)
+}
+
+// clients хранит активные WebSocket-соединения: ключ — имя пользователя
+var clients = make(map[string]map[*client]bool)
+var clientsMu sync.RWMutex
+
+func addClient(cl *client) {
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	if clients[cl.username] == nil {
+		clients[cl.username] = make(map[*client]bool)
+	}
+	clients[cl.username][cl] = true
+}
+
+// removeClient закрывает соединение и убирает его из списка активных
+func removeClient(cl *client) {
+	cl.conn.Close()
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	delete(clients[cl.username], cl)
+	if len(clients[cl.username]) == 0 {
+		delete(clients, cl.username)
+	}
+}
+
+// userClients возвращает копию списка соединений пользователя, чтобы писать в них без блокировки
+func userClients(username string) []*client {
+	clientsMu.RLock()
+	defer clientsMu.RUnlock()
+	list := make([]*client, 0, len(clients[username]))
+	for cl := range clients[username] {
+		list = append(list, cl)
+	}
+	return list
+}
+
+func allClients() []*client {
+	clientsMu.RLock()
+	defer clientsMu.RUnlock()
+	var list []*client
+	for _, conns := range clients {
+		for cl := range conns {
+			list = append(list, cl)
+		}
+	}
+	return list
+}
+
+// renameClients переносит соединения пользователя под новое имя после смены username
+func renameClients(oldName, newName string) {
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	conns := clients[oldName]
+	if conns == nil {
+		return
+	}
+	delete(clients, oldName)
+	if clients[newName] == nil {
+		clients[newName] = make(map[*client]bool)
+	}
+	for cl := range conns {
+		cl.username = newName
+		clients[newName][cl] = true
+	}
+}
+
+// sendToClients отправляет данные в каждое соединение, закрывая те, запись в которые не удалась
+func sendToClients(list []*client, data []byte) {
+	for _, cl := range list {
+		if err := cl.send(data); err != nil {
+			log.Printf("Ошибка отправки пользователю %s: %v", cl.name(), err)
+			removeClient(cl)
+		}
+	}
+}
+
+// sendToUser отправляет данные во все соединения пользователя, кроме except (может быть nil)
+func sendToUser(username string, data []byte, except *client) {
+	list := userClients(username)
+	for i, cl := range list {
+		if cl == except {
+			list = append(list[:i], list[i+1:]...)
+			break
+		}
+	}
+	sendToClients(list, data)
+}
+
+// ErrorEvent — сообщение клиенту о том, что его действие не выполнено
+type ErrorEvent struct {
+	Action string `json:"action"`
+	Error  string `json:"error"`
+}
+
+// sendError отправляет ошибку только в то соединение, из которого пришло действие
+func sendError(cl *client, message string) {
+	data, err := json.Marshal(ErrorEvent{Action: "error", Error: message})
+	if err != nil {
+		log.Printf("Ошибка маршалинга JSON: %v", err)
+		return
+	}
+	if err := cl.send(data); err != nil {
+		log.Printf("Ошибка отправки пользователю %s: %v", cl.name(), err)
+	}
+}
+
+// disconnectUser закрывает все WebSocket-соединения пользователя.
+// Цикл чтения каждого соединения завершится с ошибкой и уберёт его из списка.
+func disconnectUser(username string) {
+	for _, cl := range userClients(username) {
+		cl.close("session revoked")
+	}
+}
+
+// disconnectSession закрывает соединения, открытые в рамках одной сессии пользователя
+func disconnectSession(username string, sessionID int) {
+	for _, cl := range userClients(username) {
+		if cl.sessionID == sessionID {
+			cl.close("session revoked")
+		}
+	}
+}
+
+// disconnectAPIKey закрывает соединения бота, открытые по отозванному ключу
+func disconnectAPIKey(username string, keyID int) {
+	for _, cl := range userClients(username) {
+		if cl.apiKeyID == keyID {
+			cl.close("api key revoked")
+		}
+	}
+}
+
+// close сообщает клиенту причину закрытия и закрывает соединение
+func (cl *client) close(reason string) {
+	cl.writeMu.Lock()
+	cl.conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.ClosePolicyViolation, reason),
+		time.Now().Add(time.Second))
+	cl.writeMu.Unlock()
+	removeClient(cl)
+}
@@ -0,0 +1,236 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// maxReminderDelay — насколько далеко можно поставить напоминание
+	maxReminderDelay = 365 * 24 * time.Hour
+	// maxMuteDuration — на сколько можно отключить уведомления; без срока — /mute без аргумента
+	maxMuteDuration = 365 * 24 * time.Hour
+)
+
+var errCommandDurationTooLong = errors.New("слишком большая длительность")
+
+// RegisterBuiltinCommands регистрирует встроенные команды: /help, /me, /shrug, /remind, /mute
+func RegisterBuiltinCommands() error {
+	for _, cmd := range []Command{
+		{Name: "help", Description: "список команд", Run: helpCommand},
+		{Name: "me", Usage: "<действие>", Description: "сообщение о действии от третьего лица", Run: meCommand},
+		{Name: "shrug", Usage: "[текст]", Description: `добавляет ¯\_(ツ)_/¯`, Run: shrugCommand},
+		{Name: "remind", Usage: "<через сколько: 30m, 2h, 1d> <текст>", Description: "напоминание себе", Run: remindCommand},
+		{Name: "mute", Usage: "[на сколько | off]", Description: "отключить уведомления о сообщениях собеседника", Run: muteCommand},
+	} {
+		if err := RegisterCommand(cmd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func helpCommand(ctx *CommandContext) error {
+	var lines []string
+	for _, cmd := range sortedCommands() {
+		lines = append(lines, commandHelpLine(cmd.Name, cmd.Usage, cmd.Description))
+	}
+
+	botCommands, err := listBotCommands(ctx.DB, ctx.Message.ToID)
+	if err != nil {
+		return err
+	}
+	if len(botCommands) > 0 {
+		lines = append(lines, "Команды "+ctx.Message.To+":")
+		for _, cmd := range botCommands {
+			lines = append(lines, commandHelpLine(cmd.Name, cmd.Usage, cmd.Description))
+		}
+	}
+	ctx.Reply(strings.Join(lines, "\n"))
+	return nil
+}
+
+func commandHelpLine(name, usage, description string) string {
+	line := "/" + name
+	if usage != "" {
+		line += " " + usage
+	}
+	if description != "" {
+		line += " — " + description
+	}
+	return line
+}
+
+func meCommand(ctx *CommandContext) error {
+	if ctx.Args == "" {
+		return errors.New("напишите действие, например: /me машет рукой")
+	}
+	ctx.Send("* " + ctx.Message.From + " " + ctx.Args)
+	return nil
+}
+
+func shrugCommand(ctx *CommandContext) error {
+	ctx.Send(strings.TrimSpace(ctx.Args + ` ¯\_(ツ)_/¯`))
+	return nil
+}
+
+// parseCommandDuration разбирает длительность в формате Go (90s, 30m, 1h30m) или в днях (2d).
+// Длительность больше max — ошибка errCommandDurationTooLong.
+func parseCommandDuration(s string, max time.Duration) (time.Duration, error) {
+	var d time.Duration
+	var err error
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		var n int
+		n, err = strconv.Atoi(days)
+		// Дни сравниваются до умножения: иначе большое число переполнит Duration
+		if err == nil && n > int(max/(24*time.Hour)) {
+			return 0, errCommandDurationTooLong
+		}
+		d = time.Duration(n) * 24 * time.Hour
+	} else {
+		d, err = time.ParseDuration(s)
+	}
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("неверная длительность %q, примеры: 30m, 2h, 1d", s)
+	}
+	if d > max {
+		return 0, errCommandDurationTooLong
+	}
+	return d, nil
+}
+
+// ReminderEvent — напоминание, поставленное командой /remind
+type ReminderEvent struct {
+	Action    string    `json:"action"`
+	ID        int       `json:"id"`
+	Peer      string    `json:"peer"` // собеседник, в переписке с которым поставлено напоминание
+	Text      string    `json:"text"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func remindCommand(ctx *CommandContext) error {
+	when, text, _ := strings.Cut(ctx.Args, " ")
+	text = strings.TrimSpace(text)
+	if when == "" || text == "" {
+		return errors.New("использование: /remind 30m позвонить маме")
+	}
+	delay, err := parseCommandDuration(when, maxReminderDelay)
+	if errors.Is(err, errCommandDurationTooLong) {
+		return errors.New("напоминание можно поставить не больше чем на год вперёд")
+	}
+	if err != nil {
+		return err
+	}
+
+	at := time.Now().Add(delay)
+	_, err = ctx.DB.Exec(`INSERT INTO reminders (user_id, peer_id, text, remind_at, created_at) VALUES (?, ?, ?, ?, ?)`,
+		ctx.Message.FromID, ctx.Message.ToID, text, at.Unix(), time.Now())
+	if err != nil {
+		return err
+	}
+	ctx.Reply("Напомню " + at.Format("02.01.2006 15:04 MST") + ": " + text)
+	return nil
+}
+
+// DeliverDueReminders отправляет наступившие напоминания. Напоминание пользователю
+// не в сети остаётся в базе и будет доставлено, когда он подключится.
+func DeliverDueReminders(db *sql.DB) (int, error) {
+	rows, err := db.Query(`
+		SELECT r.id, u.username, p.username, r.text, r.created_at
+		FROM reminders r
+		JOIN users u ON u.id = r.user_id
+		JOIN users p ON p.id = r.peer_id
+		WHERE r.remind_at <= ?
+		ORDER BY r.remind_at`, time.Now().Unix())
+	if err != nil {
+		return 0, err
+	}
+	type dueReminder struct {
+		username string
+		event    ReminderEvent
+	}
+	var due []dueReminder
+	for rows.Next() {
+		r := dueReminder{event: ReminderEvent{Action: "reminder"}}
+		if err := rows.Scan(&r.event.ID, &r.username, &r.event.Peer, &r.event.Text, &r.event.CreatedAt); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		due = append(due, r)
+	}
+	rows.Close()
+
+	delivered := 0
+	for _, r := range due {
+		list := userClients(r.username)
+		if len(list) == 0 {
+			continue
+		}
+		data, err := json.Marshal(r.event)
+		if err != nil {
+			log.Printf("Ошибка маршалинга JSON: %v", err)
+			continue
+		}
+		sendToClients(list, data)
+		if _, err := db.Exec(`DELETE FROM reminders WHERE id = ?`, r.event.ID); err != nil {
+			return delivered, err
+		}
+		delivered++
+	}
+	return delivered, nil
+}
+
+func muteCommand(ctx *CommandContext) error {
+	msg := ctx.Message
+	if msg.FromID == msg.ToID {
+		return errors.New("нельзя отключить уведомления о своих сообщениях")
+	}
+
+	if ctx.Args == "off" {
+		if _, err := ctx.DB.Exec(`DELETE FROM mutes WHERE user_id = ? AND peer_id = ?`, msg.FromID, msg.ToID); err != nil {
+			return err
+		}
+		ctx.Reply("Уведомления о сообщениях " + msg.To + " снова включены")
+		return nil
+	}
+
+	until := sql.NullInt64{}
+	reply := "Уведомления о сообщениях " + msg.To + " отключены. Включить: /mute off"
+	if ctx.Args != "" {
+		d, err := parseCommandDuration(ctx.Args, maxMuteDuration)
+		if errors.Is(err, errCommandDurationTooLong) {
+			return errors.New("на срок больше года уведомления отключаются без срока: /mute")
+		}
+		if err != nil {
+			return err
+		}
+		at := time.Now().Add(d)
+		until = sql.NullInt64{Int64: at.Unix(), Valid: true}
+		reply = "Уведомления о сообщениях " + msg.To + " отключены до " + at.Format("02.01.2006 15:04 MST")
+	}
+	_, err := ctx.DB.Exec(`
+		INSERT INTO mutes (user_id, peer_id, until) VALUES (?, ?, ?)
+		ON CONFLICT (user_id, peer_id) DO UPDATE SET until = excluded.until`,
+		msg.FromID, msg.ToID, until)
+	if err != nil {
+		return err
+	}
+	ctx.Reply(reply)
+	return nil
+}
+
+// isMuted сообщает, что пользователь userID отключил уведомления о сообщениях peerID
+func isMuted(db *sql.DB, userID, peerID int) (bool, error) {
+	var n int
+	err := db.QueryRow(`
+		SELECT COUNT(*) FROM mutes
+		WHERE user_id = ? AND peer_id = ? AND (until IS NULL OR until > ?)`,
+		userID, peerID, time.Now().Unix()).Scan(&n)
+	return n > 0, err
+}
@@ -0,0 +1,354 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Command — команда, которую вызывают сообщением вида "/name аргументы" в send_message.
+// Команда может изменить и отправить сообщение (ctx.Send), ответить только в соединение
+// отправителя (ctx.Reply) или выполнить действие. Ошибка Run показывается отправителю.
+type Command struct {
+	Name        string
+	Usage       string // аргументы для /help, например "<через сколько> <текст>"
+	Description string
+	Run         func(ctx *CommandContext) error
+}
+
+// CommandContext — вызов команды
+type CommandContext struct {
+	DB      *sql.DB
+	Message *Message // сообщение с командой; From, To и их id уже заполнены
+	Args    string   // текст после имени команды
+
+	client *client
+	send   bool
+}
+
+// Send отправляет собеседнику сообщение с текстом content вместо команды
+func (ctx *CommandContext) Send(content string) {
+	ctx.Message.Content = content
+	ctx.send = true
+}
+
+// Reply отвечает только в соединение, из которого вызвана команда. Ответ не сохраняется.
+func (ctx *CommandContext) Reply(text string) {
+	sendCommandResponse(ctx.client, CommandResponseEvent{Action: "command_response", Text: text})
+}
+
+// CommandResponseEvent — ответ на команду, видимый только вызвавшему её соединению
+type CommandResponseEvent struct {
+	Action string `json:"action"`
+	From   string `json:"from,omitempty"` // бот, если ответил бот
+	Text   string `json:"text"`
+}
+
+// BotCommandEvent — вызов команды бота, отправляется в соединения бота.
+// Бот отвечает действием command_reply с тем же command_id.
+type BotCommandEvent struct {
+	Action    string `json:"action"`
+	CommandID string `json:"command_id"`
+	Command   string `json:"command"`
+	Args      string `json:"args"`
+	From      string `json:"from"`
+}
+
+var commandNamePattern = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+
+var (
+	errInvalidCommandName = errors.New("имя команды — от 1 до 32 латинских букв в нижнем регистре, цифр, _ и -")
+	errCommandTaken       = errors.New("команда с таким именем уже есть")
+)
+
+var (
+	commandsMu sync.RWMutex
+	commands   = make(map[string]Command)
+)
+
+// RegisterCommand добавляет серверную команду. Боты, работающие по API-ключу,
+// регистрируют свои команды через POST /commands.
+func RegisterCommand(cmd Command) error {
+	if !commandNamePattern.MatchString(cmd.Name) {
+		return errInvalidCommandName
+	}
+	commandsMu.Lock()
+	defer commandsMu.Unlock()
+	if _, exists := commands[cmd.Name]; exists {
+		return fmt.Errorf("%w: /%s", errCommandTaken, cmd.Name)
+	}
+	commands[cmd.Name] = cmd
+	return nil
+}
+
+func lookupCommand(name string) (Command, bool) {
+	commandsMu.RLock()
+	defer commandsMu.RUnlock()
+	cmd, ok := commands[name]
+	return cmd, ok
+}
+
+func sortedCommands() []Command {
+	commandsMu.RLock()
+	defer commandsMu.RUnlock()
+	list := make([]Command, 0, len(commands))
+	for _, cmd := range commands {
+		list = append(list, cmd)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// runCommand выполняет команду из сообщения msg, текст которого начинается с "/".
+// Возвращает true, если сообщение нужно отправить дальше обычным путём.
+// "//текст" отправляется как "/текст" без вызова команды.
+func runCommand(db *sql.DB, cl *client, msg *Message) bool {
+	if strings.HasPrefix(msg.Content, "//") {
+		msg.Content = msg.Content[1:]
+		return true
+	}
+
+	name, args := strings.TrimPrefix(msg.Content, "/"), ""
+	if i := strings.IndexFunc(name, unicode.IsSpace); i >= 0 {
+		name, args = name[:i], strings.TrimSpace(name[i:])
+	}
+	name = strings.ToLower(name)
+
+	if cmd, ok := lookupCommand(name); ok {
+		ctx := &CommandContext{DB: db, Message: msg, Args: args, client: cl}
+		if err := cmd.Run(ctx); err != nil {
+			sendError(cl, "/"+name+": "+err.Error())
+			return false
+		}
+		return ctx.send
+	}
+
+	found, err := dispatchBotCommand(db, cl, msg, name, args)
+	if err != nil {
+		log.Printf("Ошибка вызова команды /%s бота %s: %v", name, msg.To, err)
+		sendError(cl, "Не удалось выполнить команду /"+name)
+		return false
+	}
+	if !found {
+		sendError(cl, "Неизвестная команда /"+name+". Список команд — /help, отправить текст с / в начале — //")
+	}
+	return false
+}
+
+func sendCommandResponse(cl *client, event CommandResponseEvent) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Ошибка маршалинга JSON: %v", err)
+		return
+	}
+	if err := cl.send(data); err != nil {
+		log.Printf("Ошибка отправки пользователю %s: %v", cl.name(), err)
+	}
+}
+
+const (
+	// botCommandTTL — сколько бот может отвечать на вызов команды
+	botCommandTTL = 5 * time.Minute
+	// maxCommandReplyLength — наибольшая длина ответа бота в символах
+	maxCommandReplyLength = 4000
+)
+
+// pendingBotCommand — вызов команды бота, ожидающий ответа
+type pendingBotCommand struct {
+	botID   int
+	caller  *client
+	expires time.Time
+}
+
+var (
+	pendingBotCommandsMu sync.Mutex
+	pendingBotCommands   = make(map[string]pendingBotCommand)
+)
+
+// dispatchBotCommand передаёт команду боту-собеседнику, если он её зарегистрировал
+func dispatchBotCommand(db *sql.DB, cl *client, msg *Message, name, args string) (bool, error) {
+	var n int
+	err := db.QueryRow(`SELECT COUNT(*) FROM bot_commands WHERE bot_id = ? AND name = ?`, msg.ToID, name).Scan(&n)
+	if err != nil || n == 0 {
+		return false, err
+	}
+
+	blocked, err := isBlocked(db, msg.From, msg.To)
+	if err != nil {
+		return true, err
+	}
+	if blocked {
+		sendError(cl, "Нельзя вызвать команду: пользователь заблокирован")
+		return true, nil
+	}
+	bots := userClients(msg.To)
+	if len(bots) == 0 {
+		sendError(cl, "Бот "+msg.To+" не в сети")
+		return true, nil
+	}
+
+	commandID := uuid.NewString()
+	now := time.Now()
+	pendingBotCommandsMu.Lock()
+	for id, p := range pendingBotCommands {
+		if now.After(p.expires) {
+			delete(pendingBotCommands, id)
+		}
+	}
+	pendingBotCommands[commandID] = pendingBotCommand{botID: msg.ToID, caller: cl, expires: now.Add(botCommandTTL)}
+	pendingBotCommandsMu.Unlock()
+
+	data, err := json.Marshal(BotCommandEvent{
+		Action: "command", CommandID: commandID, Command: name, Args: args, From: msg.From,
+	})
+	if err != nil {
+		return true, err
+	}
+	sendToClients(bots, data)
+	return true, nil
+}
+
+// replyToBotCommand доставляет ответ бота на вызов команды в соединение, из которого её вызвали.
+// На каждый вызов принимается один ответ.
+func replyToBotCommand(bot *client, commandID, text string) error {
+	if utf8.RuneCountInString(text) > maxCommandReplyLength {
+		return fmt.Errorf("ответ на команду длиннее %d символов", maxCommandReplyLength)
+	}
+
+	pendingBotCommandsMu.Lock()
+	p, ok := pendingBotCommands[commandID]
+	if ok && p.botID == bot.userID {
+		delete(pendingBotCommands, commandID)
+	}
+	pendingBotCommandsMu.Unlock()
+	if !ok || p.botID != bot.userID || time.Now().After(p.expires) {
+		return errors.New("вызов команды не найден или устарел")
+	}
+	sendCommandResponse(p.caller, CommandResponseEvent{Action: "command_response", From: bot.name(), Text: text})
+	return nil
+}
+
+// BotCommand — команда, зарегистрированная ботом. Её можно вызвать в переписке с этим ботом.
+type BotCommand struct {
+	Name        string `json:"name"`
+	Usage       string `json:"usage,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+func listBotCommands(db *sql.DB, botID int) ([]BotCommand, error) {
+	rows, err := db.Query(`SELECT name, usage, description FROM bot_commands WHERE bot_id = ? ORDER BY name`, botID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []BotCommand{}
+	for rows.Next() {
+		var cmd BotCommand
+		if err := rows.Scan(&cmd.Name, &cmd.Usage, &cmd.Description); err != nil {
+			return nil, err
+		}
+		list = append(list, cmd)
+	}
+	return list, rows.Err()
+}
+
+// currentBot — текущий пользователь, если запрос сделан ботом по API-ключу
+func currentBot(c *gin.Context, db *sql.DB) (authUser, bool) {
+	user, ok := currentSession(c, db)
+	if !ok {
+		return authUser{}, false
+	}
+	if !user.isBot() {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Команды регистрируют боты по API-ключу"})
+		return authUser{}, false
+	}
+	return user, true
+}
+
+// RegisterBotCommand — регистрация или изменение команды бота
+// (тело запроса: {"name": "deploy", "usage": "<окружение>", "description": "..."}).
+// Вызов команды приходит боту событием command, ответ отправляется действием command_reply.
+func RegisterBotCommand(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		bot, ok := currentBot(c, db)
+		if !ok {
+			return
+		}
+
+		var cmd BotCommand
+		if err := c.ShouldBindJSON(&cmd); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		cmd.Name = strings.ToLower(strings.TrimSpace(cmd.Name))
+		if !commandNamePattern.MatchString(cmd.Name) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": errInvalidCommandName.Error()})
+			return
+		}
+		if _, builtin := lookupCommand(cmd.Name); builtin {
+			c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("%v: /%s", errCommandTaken, cmd.Name)})
+			return
+		}
+
+		_, err := db.Exec(`
+			INSERT INTO bot_commands (bot_id, name, usage, description) VALUES (?, ?, ?, ?)
+			ON CONFLICT (bot_id, name) DO UPDATE SET usage = excluded.usage, description = excluded.description`,
+			bot.ID, cmd.Name, strings.TrimSpace(cmd.Usage), strings.TrimSpace(cmd.Description))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка базы данных"})
+			return
+		}
+		c.JSON(http.StatusOK, cmd)
+	}
+}
+
+// GetBotCommands — команды, зарегистрированные текущим ботом
+func GetBotCommands(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		bot, ok := currentBot(c, db)
+		if !ok {
+			return
+		}
+
+		list, err := listBotCommands(db, bot.ID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка базы данных"})
+			return
+		}
+		c.JSON(http.StatusOK, list)
+	}
+}
+
+// DeleteBotCommand удаляет команду текущего бота
+func DeleteBotCommand(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		bot, ok := currentBot(c, db)
+		if !ok {
+			return
+		}
+
+		res, err := db.Exec(`DELETE FROM bot_commands WHERE bot_id = ? AND name = ?`, bot.ID, c.Param("name"))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка базы данных"})
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Команда не найдена"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "command deleted"})
+	}
+}
@@ -0,0 +1,164 @@
+package handlers
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// wsEvents читает события из соединения, пока check не вернёт true. Возвращает false по таймауту.
+func wsEvents(t *testing.T, conn *websocket.Conn, timeout time.Duration, check func(event map[string]interface{}) bool) bool {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+	for {
+		var event map[string]interface{}
+		if err := conn.ReadJSON(&event); err != nil {
+			return false
+		}
+		if check(event) {
+			return true
+		}
+	}
+}
+
+func TestSlashCommands(t *testing.T) {
+	db := newTestDB(t)
+	SetMailer(&captureMailer{}, "")
+	if err := RegisterBuiltinCommands(); err != nil && !errors.Is(err, errCommandTaken) {
+		t.Fatal(err)
+	}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/users", CreateUsers(db))
+	router.POST("/login", Login(db))
+	router.POST("/bots", CreateBot(db))
+	router.POST("/bots/:username/keys", CreateAPIKey(db))
+	router.POST("/commands", RegisterBotCommand(db))
+	router.GET("/ws", func(c *gin.Context) { WebSocketHandler(c, db) })
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	const password = "Quiet-harb0r-passphrase"
+	tokens := make(map[string]string)
+	for _, name := range []string{"alice", "bob"} {
+		if code, body := doJSON(t, router, "POST", "/users", "", gin.H{
+			"username": name, "email": name + "@example.com", "password": password,
+		}); code != http.StatusOK && code != http.StatusCreated {
+			t.Fatalf("регистрация %s: %d %v", name, code, body)
+		}
+		code, body := doJSON(t, router, "POST", "/login", "", gin.H{"username": name, "password": password})
+		if code != http.StatusOK {
+			t.Fatalf("вход %s: %d %v", name, code, body)
+		}
+		tokens[name], _ = body["accessToken"].(string)
+	}
+
+	dial := func(header http.Header, query string) *websocket.Conn {
+		t.Helper()
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws"+query, header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+	alice := dial(nil, "?token="+tokens["alice"])
+	bob := dial(nil, "?token="+tokens["bob"])
+
+	send := func(conn *websocket.Conn, event gin.H) {
+		t.Helper()
+		if err := conn.WriteJSON(event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	received := func(conn *websocket.Conn, content string) bool {
+		t.Helper()
+		return wsEvents(t, conn, 2*time.Second, func(event map[string]interface{}) bool {
+			return event["content"] == content
+		})
+	}
+	errorEvent := func(conn *websocket.Conn, substr string) bool {
+		t.Helper()
+		return wsEvents(t, conn, 2*time.Second, func(event map[string]interface{}) bool {
+			text, _ := event["error"].(string)
+			return event["action"] == "error" && strings.Contains(text, substr)
+		})
+	}
+
+	t.Run("встроенная команда", func(t *testing.T) {
+		send(alice, gin.H{"action": "send_message", "to": "bob", "content": "/shrug ok"})
+		if !received(bob, `ok ¯\_(ツ)_/¯`) {
+			t.Error("сообщение от /shrug не доставлено")
+		}
+	})
+
+	t.Run("экранирование //", func(t *testing.T) {
+		send(alice, gin.H{"action": "send_message", "to": "bob", "content": "//shrug не команда"})
+		if !received(bob, "/shrug не команда") {
+			t.Error("текст с // не доставлен как обычное сообщение с одним /")
+		}
+	})
+
+	t.Run("неизвестная команда", func(t *testing.T) {
+		send(alice, gin.H{"action": "send_message", "to": "bob", "content": "/nosuch"})
+		if !errorEvent(alice, "Неизвестная команда /nosuch") {
+			t.Error("нет ошибки о неизвестной команде")
+		}
+	})
+
+	t.Run("длительность /mute", func(t *testing.T) {
+		// 213504 дня переполняют time.Duration и без проверки дали бы около 25 минут
+		send(alice, gin.H{"action": "send_message", "to": "bob", "content": "/mute 213504d"})
+		if !errorEvent(alice, "/mute:") {
+			t.Error("огромная длительность /mute не отклонена")
+		}
+	})
+
+	t.Run("команда бота", func(t *testing.T) {
+		if code, body := doJSON(t, router, "POST", "/bots", tokens["alice"], gin.H{"username": "deployer"}); code != http.StatusCreated {
+			t.Fatalf("создание бота: %d %v", code, body)
+		}
+		code, body := doJSON(t, router, "POST", "/bots/deployer/keys", tokens["alice"], gin.H{
+			"name": "main", "scopes": []string{"messages:read", "messages:write"},
+		})
+		if code != http.StatusCreated {
+			t.Fatalf("создание ключа: %d %v", code, body)
+		}
+		key, _ := body["key"].(string)
+		if code, body := doJSON(t, router, "POST", "/commands", key, gin.H{"name": "deploy"}); code != http.StatusOK {
+			t.Fatalf("регистрация команды: %d %v", code, body)
+		}
+		bot := dial(http.Header{"Authorization": {"Bearer " + key}}, "")
+
+		send(alice, gin.H{"action": "send_message", "to": "deployer", "content": "/deploy prod"})
+		var commandID string
+		if !wsEvents(t, bot, 2*time.Second, func(event map[string]interface{}) bool {
+			commandID, _ = event["command_id"].(string)
+			return event["action"] == "command" && event["command"] == "deploy" && event["args"] == "prod"
+		}) {
+			t.Fatal("бот не получил вызов команды")
+		}
+
+		send(bot, gin.H{"action": "command_reply", "command_id": commandID, "text": strings.Repeat("x", maxCommandReplyLength+1)})
+		if !errorEvent(bot, "длиннее") {
+			t.Error("слишком длинный ответ бота не отклонён")
+		}
+		send(bot, gin.H{"action": "command_reply", "command_id": commandID, "text": "готово"})
+		if !wsEvents(t, alice, 2*time.Second, func(event map[string]interface{}) bool {
+			return event["action"] == "command_response" && event["text"] == "готово"
+		}) {
+			t.Error("ответ бота не доставлен")
+		}
+		send(bot, gin.H{"action": "command_reply", "command_id": commandID, "text": "ещё раз"})
+		if !errorEvent(bot, "не найден") {
+			t.Error("второй ответ на тот же вызов принят")
+		}
+	})
+}
@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"time"
+)
+
+// DraftEvent — уведомление другим устройствам пользователя об изменении черновика
+type DraftEvent struct {
+	Action    string `json:"action"` // draft_updated или draft_cleared
+	To        string `json:"to"`     // собеседник, которому пишется черновик
+	Content   string `json:"content,omitempty"`
+	UpdatedAt string `json:"updated_at,omitempty"`
+}
+
+// SaveDraft сохраняет черновик сообщения пользователя для диалога с peer.
+// Пустой черновик равносилен его удалению.
+func SaveDraft(db *sql.DB, username, peer, content string) error {
+	if content == "" {
+		return ClearDraft(db, username, peer)
+	}
+	query := `
+		INSERT INTO drafts (username, peer, content, updated_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT (username, peer) DO UPDATE SET content = excluded.content, updated_at = excluded.updated_at`
+	_, err := db.Exec(query, username, peer, content, time.Now())
+	return err
+}
+
+func ClearDraft(db *sql.DB, username, peer string) error {
+	_, err := db.Exec(`DELETE FROM drafts WHERE username = ? AND peer = ?`, username, peer)
+	return err
+}
+
+// loadDrafts возвращает черновики пользователя (кроме диалогов с заблокированными): ключ — собеседник
+func loadDrafts(db *sql.DB, username string) (map[string]string, error) {
+	rows, err := db.Query(`
+		SELECT peer, content FROM drafts
+		WHERE username = ? AND peer NOT IN (SELECT blocked FROM blocks WHERE blocker = ?)`, username, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	drafts := make(map[string]string)
+	for rows.Next() {
+		var peer, content string
+		if err := rows.Scan(&peer, &content); err != nil {
+			return nil, err
+		}
+		drafts[peer] = content
+	}
+	return drafts, rows.Err()
+}
+
+// syncDraft отправляет состояние черновика на остальные устройства пользователя
+func syncDraft(from *client, peer, content string) {
+	event := DraftEvent{Action: "draft_cleared", To: peer}
+	if content != "" {
+		event = DraftEvent{
+			Action:    "draft_updated",
+			To:        peer,
+			Content:   content,
+			UpdatedAt: time.Now().Format(time.RFC3339),
+		}
+	}
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Ошибка маршалинга JSON: %v", err)
+		return
+	}
+	sendToUser(from.name(), data, from)
+}
@@ -0,0 +1,114 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"gorutines/authorization_tools"
+	"gorutines/mail_tools"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// mailer и адрес сервера для ссылок в письмах задаются при запуске сервера
+var (
+	mailer        mail_tools.Mailer = mail_tools.NewFileMailer("")
+	publicBaseURL                   = "http://localhost:8080"
+)
+
+// verificationResendCooldown — как часто пользователь может запрашивать письмо подтверждения повторно
+const verificationResendCooldown = time.Minute
+
+// requireEmailVerification — не пускать в Login, пока почта не подтверждена
+var requireEmailVerification bool
+
+func SetMailer(m mail_tools.Mailer, baseURL string) {
+	mailer = m
+	if baseURL != "" {
+		publicBaseURL = strings.TrimRight(baseURL, "/")
+	}
+}
+
+func SetRequireEmailVerification(required bool) {
+	requireEmailVerification = required
+}
+
+// sendVerificationEmail выдаёт токен подтверждения и отправляет ссылку на адрес.
+// Ошибка только логируется: письмо можно запросить повторно.
+func sendVerificationEmail(db *sql.DB, userID int, email string) {
+	token, err := authorization_tools.CreateEmailVerification(userID, email, db)
+	if err != nil {
+		log.Println("Ошибка при создании токена подтверждения почты:", err)
+		return
+	}
+
+	link := publicBaseURL + "/verify-email?token=" + url.QueryEscape(token)
+	body := "Чтобы подтвердить адрес почты, перейдите по ссылке:\n\n" + link +
+		"\n\nЕсли вы не регистрировались, просто проигнорируйте это письмо."
+	if err := mailer.Send(email, "Подтверждение адреса почты", body); err != nil {
+		log.Printf("Ошибка отправки письма на %s: %v", email, err)
+	}
+}
+
+// VerifyEmail — переход по ссылке из письма (параметр token)
+func VerifyEmail(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := c.Query("token")
+		if token == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Не указан токен"})
+			return
+		}
+
+		username, err := authorization_tools.VerifyEmail(token, db)
+		if errors.Is(err, authorization_tools.ErrVerificationTokenInvalid) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			log.Println("Ошибка при подтверждении почты:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка базы данных"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Почта подтверждена", "username": username})
+	}
+}
+
+// ResendVerificationEmail — повторная отправка письма (тело запроса: {"email": "..."}).
+// Ответ не зависит от того, зарегистрирован ли адрес.
+func ResendVerificationEmail(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var request struct {
+			Email string `json:"email" binding:"required"`
+		}
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		var userID int
+		var verifiedAt sql.NullTime
+		err := db.QueryRow("SELECT id, email_verified_at FROM users WHERE email = ? COLLATE NOCASE", request.Email).Scan(&userID, &verifiedAt)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка базы данных"})
+			return
+		}
+		if err == nil && !verifiedAt.Valid {
+			// Не чаще одного письма в минуту на пользователя. Об ограничении не сообщаем:
+			// ответ не должен выдавать, зарегистрирован ли адрес.
+			wait, err := authorization_tools.Throttle("verify:"+strconv.Itoa(userID), 1, verificationResendCooldown, db)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка базы данных"})
+				return
+			}
+			if wait == 0 {
+				// Письмо отправляется в фоне, чтобы по времени ответа нельзя было узнать, есть ли адрес
+				go sendVerificationEmail(db, userID, request.Email)
+			}
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Если адрес зарегистрирован и не подтверждён, письмо отправлено"})
+	}
+}
@@ -0,0 +1,622 @@
+package handlers
+
+import (
+	"archive/zip"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorutines/authorization_tools"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// dataExportTTL — сколько готовый архив доступен для скачивания
+	dataExportTTL = 7 * 24 * time.Hour
+	// maxParallelExports — сколько архивов собирается одновременно
+	maxParallelExports = 2
+)
+
+// exportSlots ограничивает число одновременно собираемых архивов
+var exportSlots = make(chan struct{}, maxParallelExports)
+
+// DataExport — состояние выгрузки персональных данных
+type DataExport struct {
+	ID          int        `json:"id"`
+	Status      string     `json:"status"` // pending, running, ready, failed
+	Size        int64      `json:"size,omitempty"`
+	Error       string     `json:"error,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	DownloadURL string     `json:"download_url,omitempty"`
+}
+
+// RequestDataExport — запуск выгрузки всех данных пользователя в архив.
+// Пока предыдущая выгрузка не собрана, возвращается она же.
+func RequestDataExport(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, ok := currentSession(c, db)
+		if !ok {
+			return
+		}
+
+		id, created, err := startDataExport(db, user.ID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка базы данных"})
+			return
+		}
+		if created {
+			go runDataExport(db, id)
+
+			if err := authorization_tools.LogAuthEvent(db, user.Username, "data_export_requested", c.ClientIP(), ""); err != nil {
+				log.Println("Ошибка записи события авторизации:", err)
+			}
+		}
+
+		export, err := loadDataExport(db, id, user.ID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка базы данных"})
+			return
+		}
+		c.Header("Location", fmt.Sprintf("/me/export/%d", id))
+		c.JSON(http.StatusAccepted, export)
+	}
+}
+
+// startDataExport ставит в очередь новую выгрузку или возвращает незавершённую.
+// Незавершённая выгрузка у пользователя может быть только одна (частичный уникальный индекс),
+// поэтому одновременные запросы не запустят две.
+func startDataExport(db *sql.DB, userID int) (id int, created bool, err error) {
+	for {
+		res, err := db.Exec(`INSERT INTO data_exports (user_id, status, created_at) VALUES (?, 'pending', ?) ON CONFLICT DO NOTHING`,
+			userID, time.Now())
+		if err != nil {
+			return 0, false, err
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			newID, err := res.LastInsertId()
+			return int(newID), true, err
+		}
+
+		err = db.QueryRow(`SELECT id FROM data_exports WHERE user_id = ? AND status IN ('pending', 'running')`, userID).Scan(&id)
+		if !errors.Is(err, sql.ErrNoRows) {
+			return id, false, err
+		}
+		// Незавершённая выгрузка успела завершиться между запросами — пробуем снова
+	}
+}
+
+// GetDataExport — состояние выгрузки; у готовой выгрузки есть download_url
+func GetDataExport(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, ok := currentSession(c, db)
+		if !ok {
+			return
+		}
+
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Неверный id выгрузки"})
+			return
+		}
+		export, err := loadDataExport(db, id, user.ID)
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Выгрузка не найдена"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка базы данных"})
+			return
+		}
+		c.JSON(http.StatusOK, export)
+	}
+}
+
+// DataExportLink выдаёт одноразовую ссылку на готовый архив, которую можно открыть в браузере
+// без заголовка Authorization. Ссылка действует несколько минут и только для этой выгрузки.
+func DataExportLink(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, ok := currentSession(c, db)
+		if !ok {
+			return
+		}
+
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Неверный id выгрузки"})
+			return
+		}
+		export, err := loadDataExport(db, id, user.ID)
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Выгрузка не найдена"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка базы данных"})
+			return
+		}
+		if export.Status != "ready" {
+			c.JSON(http.StatusConflict, gin.H{"error": "Архив ещё не готов", "status": export.Status})
+			return
+		}
+
+		token, expiresAt, err := authorization_tools.CreateExportDownloadToken(id, user.ID, db)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка базы данных"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"url":        fmt.Sprintf("%s?download_token=%s", export.DownloadURL, token),
+			"expires_at": expiresAt,
+		})
+	}
+}
+
+// DownloadDataExport отдаёт готовый архив по заголовку Authorization
+// либо по одноразовому токену из DataExportLink в параметре download_token.
+func DownloadDataExport(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Неверный id выгрузки"})
+			return
+		}
+
+		var userID int
+		if token := c.Query("download_token"); token != "" {
+			userID, err = authorization_tools.ConsumeExportDownloadToken(id, token, db)
+			if errors.Is(err, authorization_tools.ErrExportDownloadTokenInvalid) {
+				c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+				return
+			}
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка базы данных"})
+				return
+			}
+		} else {
+			user, ok := currentSession(c, db)
+			if !ok {
+				return
+			}
+			userID = user.ID
+		}
+
+		var status, username string
+		var storageKey sql.NullString
+		var size sql.NullInt64
+		var expiresAt sql.NullTime
+		err = db.QueryRow(`
+			SELECT e.status, e.storage_key, e.size, e.expires_at, u.username
+			FROM data_exports e JOIN users u ON u.id = e.user_id
+			WHERE e.id = ? AND e.user_id = ?`, id, userID).
+			Scan(&status, &storageKey, &size, &expiresAt, &username)
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Выгрузка не найдена"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка базы данных"})
+			return
+		}
+		if status != "ready" {
+			c.JSON(http.StatusConflict, gin.H{"error": "Архив ещё не готов", "status": status})
+			return
+		}
+		if expiresAt.Valid && time.Now().After(expiresAt.Time) {
+			c.JSON(http.StatusGone, gin.H{"error": "Срок хранения архива истёк, запросите выгрузку заново"})
+			return
+		}
+
+		reader, err := attachmentStorage.Get(storageKey.String)
+		if err != nil {
+			log.Printf("Ошибка чтения выгрузки %d: %v", id, err)
+			c.JSON(http.StatusNotFound, gin.H{"error": "Файл не найден"})
+			return
+		}
+		defer reader.Close()
+
+		filename := fmt.Sprintf("export-%s-%d.zip", username, id)
+		c.DataFromReader(http.StatusOK, size.Int64, "application/zip", reader, map[string]string{
+			"Content-Disposition": fmt.Sprintf("attachment; filename=%q", filename),
+		})
+	}
+}
+
+func loadDataExport(db *sql.DB, id, userID int) (DataExport, error) {
+	var e DataExport
+	var size sql.NullInt64
+	var exportErr sql.NullString
+	var completedAt, expiresAt sql.NullTime
+	err := db.QueryRow(`
+		SELECT id, status, size, error, created_at, completed_at, expires_at
+		FROM data_exports WHERE id = ? AND user_id = ?`, id, userID).
+		Scan(&e.ID, &e.Status, &size, &exportErr, &e.CreatedAt, &completedAt, &expiresAt)
+	if err != nil {
+		return e, err
+	}
+	e.Size = size.Int64
+	e.Error = exportErr.String
+	if completedAt.Valid {
+		e.CompletedAt = &completedAt.Time
+	}
+	if expiresAt.Valid {
+		e.ExpiresAt = &expiresAt.Time
+	}
+	if e.Status == "ready" {
+		e.DownloadURL = fmt.Sprintf("/me/export/%d/download", e.ID)
+	}
+	return e, nil
+}
+
+// ResumeDataExports перезапускает выгрузки, прерванные остановкой сервера
+func ResumeDataExports(db *sql.DB) error {
+	rows, err := db.Query(`SELECT id FROM data_exports WHERE status IN ('pending', 'running')`)
+	if err != nil {
+		return err
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+
+	for _, id := range ids {
+		go runDataExport(db, id)
+	}
+	return rows.Err()
+}
+
+// CleanupDataExports удаляет архивы с истёкшим сроком хранения и возвращает их количество
+func CleanupDataExports(db *sql.DB) (int, error) {
+	rows, err := db.Query(`SELECT id, expires_at FROM data_exports WHERE expires_at IS NOT NULL`)
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	var expired []int
+	for rows.Next() {
+		var id int
+		var expiresAt time.Time
+		if err := rows.Scan(&id, &expiresAt); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if now.After(expiresAt) {
+			expired = append(expired, id)
+		}
+	}
+	rows.Close()
+
+	for i, id := range expired {
+		if err := deleteDataExportsWhere(db, "id = ?", id); err != nil {
+			return i, err
+		}
+	}
+	return len(expired), nil
+}
+
+// deleteDataExportsWhere удаляет архивы и записи выгрузок, подходящих под условие
+func deleteDataExportsWhere(db *sql.DB, condition string, args ...interface{}) error {
+	rows, err := db.Query(`SELECT storage_key FROM data_exports WHERE storage_key IS NOT NULL AND `+condition, args...)
+	if err != nil {
+		return err
+	}
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			rows.Close()
+			return err
+		}
+		keys = append(keys, key)
+	}
+	rows.Close()
+
+	for _, key := range keys {
+		if err := attachmentStorage.Delete(key); err != nil {
+			log.Printf("Ошибка удаления файла %s: %v", key, err)
+		}
+	}
+
+	_, err = db.Exec(`DELETE FROM data_exports WHERE `+condition, args...)
+	return err
+}
+
+// runDataExport собирает архив и сохраняет результат в data_exports
+func runDataExport(db *sql.DB, exportID int) {
+	exportSlots <- struct{}{}
+	defer func() { <-exportSlots }()
+
+	var userID int
+	if err := db.QueryRow(`SELECT user_id FROM data_exports WHERE id = ?`, exportID).Scan(&userID); err != nil {
+		log.Printf("Выгрузка %d: %v", exportID, err)
+		return
+	}
+	if _, err := db.Exec(`UPDATE data_exports SET status = 'running' WHERE id = ?`, exportID); err != nil {
+		log.Printf("Выгрузка %d: %v", exportID, err)
+		return
+	}
+
+	key := "export-" + uuid.NewString() + ".zip"
+	size, err := buildDataExport(db, userID, key)
+	now := time.Now()
+	if err != nil {
+		log.Printf("Ошибка выгрузки данных %d: %v", exportID, err)
+		attachmentStorage.Delete(key)
+		_, err = db.Exec(`UPDATE data_exports SET status = 'failed', error = ?, completed_at = ? WHERE id = ?`,
+			"Не удалось собрать архив", now, exportID)
+		if err != nil {
+			log.Printf("Выгрузка %d: %v", exportID, err)
+		}
+		return
+	}
+
+	_, err = db.Exec(`UPDATE data_exports SET status = 'ready', storage_key = ?, size = ?, completed_at = ?, expires_at = ? WHERE id = ?`,
+		key, size, now, now.Add(dataExportTTL), exportID)
+	if err != nil {
+		log.Printf("Выгрузка %d: %v", exportID, err)
+		attachmentStorage.Delete(key)
+		return
+	}
+
+	var email string
+	if err := db.QueryRow("SELECT email FROM users WHERE id = ?", userID).Scan(&email); err == nil {
+		// Ссылка ведёт на страницу клиента: скачивание требует входа в учетную запись
+		body := "Архив с вашими данными готов. Скачать его можно в течение 7 дней:\n\n" +
+			fmt.Sprintf("%s/data-export?id=%d", publicBaseURL, exportID)
+		if err := mailer.Send(email, "Выгрузка данных", body); err != nil {
+			log.Printf("Ошибка отправки письма на %s: %v", email, err)
+		}
+	}
+}
+
+// exportedAttachment — вложение в архиве: метаданные и путь к файлу внутри архива
+type exportedAttachment struct {
+	ID        int    `json:"id"`
+	MessageID *int   `json:"message_id,omitempty"`
+	Filename  string `json:"filename"`
+	MimeType  string `json:"mime_type"`
+	Size      int64  `json:"size"`
+	File      string `json:"file"`
+
+	storageKey string
+}
+
+// exportedData — содержимое data.json в архиве
+type exportedData struct {
+	ExportedAt  time.Time                     `json:"exported_at"`
+	Profile     Profile                       `json:"profile"`
+	Settings    gin.H                         `json:"settings"`
+	Messages    []ChatMessage                 `json:"messages"`
+	Attachments []exportedAttachment          `json:"attachments"`
+	Sessions    []authorization_tools.Session `json:"sessions"`
+	AuthEvents  []gin.H                       `json:"auth_events"`
+	Drafts      []gin.H                       `json:"drafts"`
+	Blocks      []gin.H                       `json:"blocks"`
+	Reports     []gin.H                       `json:"reports"`
+}
+
+// buildDataExport собирает zip-архив с data.json и файлами вложений и кладёт его в хранилище
+func buildDataExport(db *sql.DB, userID int, key string) (int64, error) {
+	data, err := collectExportData(db, userID)
+	if err != nil {
+		return 0, err
+	}
+
+	tmp, err := os.CreateTemp("", "export-*.zip")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	archive := zip.NewWriter(tmp)
+	w, err := archive.Create("data.json")
+	if err != nil {
+		return 0, err
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(data); err != nil {
+		return 0, err
+	}
+
+	for _, a := range data.Attachments {
+		if err := copyToArchive(archive, a.File, a.storageKey); err != nil {
+			return 0, fmt.Errorf("вложение %d: %w", a.ID, err)
+		}
+	}
+	if err := archive.Close(); err != nil {
+		return 0, err
+	}
+
+	size, err := tmp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return size, attachmentStorage.Put(key, tmp)
+}
+
+func copyToArchive(archive *zip.Writer, name, storageKey string) error {
+	reader, err := attachmentStorage.Get(storageKey)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	w, err := archive.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, reader)
+	return err
+}
+
+// archiveName делает имя файла безопасным для распаковки: без каталогов и скрытых файлов
+func archiveName(id int, filename string) string {
+	filename = strings.NewReplacer("/", "_", `\`, "_", "\x00", "").Replace(filename)
+	filename = strings.TrimLeft(filename, ".")
+	if filename == "" {
+		filename = "file"
+	}
+	return fmt.Sprintf("attachments/%d-%s", id, filename)
+}
+
+func collectExportData(db *sql.DB, userID int) (exportedData, error) {
+	data := exportedData{
+		ExportedAt:  time.Now(),
+		Messages:    []ChatMessage{},
+		Attachments: []exportedAttachment{},
+	}
+
+	profile, err := loadProfile(db, userID)
+	if err != nil {
+		return data, err
+	}
+	data.Profile = profile
+	username := profile.Username
+
+	var role string
+	var emailVerifiedAt, totpEnabledAt sql.NullTime
+	err = db.QueryRow(`SELECT role, email_verified_at, totp_enabled_at FROM users WHERE id = ?`, userID).
+		Scan(&role, &emailVerifiedAt, &totpEnabledAt)
+	if err != nil {
+		return data, err
+	}
+	data.Settings = gin.H{
+		"role":               role,
+		"email_verified":     emailVerifiedAt.Valid,
+		"two_factor_enabled": totpEnabledAt.Valid,
+	}
+
+	rows, err := db.Query(`
+		SELECT m.id, fu.username, tu.username, m.content, m.created_at
+		FROM messages m
+		JOIN users fu ON fu.id = m.from_user_id
+		JOIN users tu ON tu.id = m.to_user_id
+		WHERE m.from_user_id = ? OR m.to_user_id = ?
+		ORDER BY m.created_at ASC`, userID, userID)
+	if err != nil {
+		return data, err
+	}
+	var messageIDs []int
+	for rows.Next() {
+		var m ChatMessage
+		if err := rows.Scan(&m.ID, &m.FromUser, &m.ToUser, &m.Content, &m.Timestamp); err != nil {
+			rows.Close()
+			return data, err
+		}
+		data.Messages = append(data.Messages, m)
+		messageIDs = append(messageIDs, m.ID)
+	}
+	rows.Close()
+
+	attachments, err := loadAttachments(db, messageIDs)
+	if err != nil {
+		return data, err
+	}
+	for i := range data.Messages {
+		data.Messages[i].Attachments = attachments[data.Messages[i].ID]
+	}
+
+	// Файлы вложений из переписки и загруженные, но не отправленные
+	rows, err = db.Query(`
+		SELECT a.id, a.message_id, a.filename, a.mime_type, a.size, a.storage_key
+		FROM attachments a
+		LEFT JOIN messages m ON m.id = a.message_id
+		WHERE (a.message_id IS NULL AND a.uploader = ?) OR m.from_user_id = ? OR m.to_user_id = ?
+		ORDER BY a.id`, username, userID, userID)
+	if err != nil {
+		return data, err
+	}
+	for rows.Next() {
+		var a exportedAttachment
+		var messageID sql.NullInt64
+		if err := rows.Scan(&a.ID, &messageID, &a.Filename, &a.MimeType, &a.Size, &a.storageKey); err != nil {
+			rows.Close()
+			return data, err
+		}
+		if messageID.Valid {
+			id := int(messageID.Int64)
+			a.MessageID = &id
+		}
+		a.File = archiveName(a.ID, a.Filename)
+		data.Attachments = append(data.Attachments, a)
+	}
+	rows.Close()
+
+	data.Sessions, err = authorization_tools.GetSessions(userID, db)
+	if err != nil {
+		return data, err
+	}
+
+	sections := []struct {
+		target  *[]gin.H
+		columns []string
+		query   string
+		args    []interface{}
+	}{
+		{&data.AuthEvents, []string{"event", "ip", "details", "created_at"},
+			`SELECT event, COALESCE(ip, ''), COALESCE(details, ''), created_at FROM auth_events WHERE username = ? ORDER BY id`,
+			[]interface{}{username}},
+		{&data.Drafts, []string{"peer", "content", "updated_at"},
+			`SELECT peer, content, updated_at FROM drafts WHERE username = ? ORDER BY peer`,
+			[]interface{}{username}},
+		{&data.Blocks, []string{"blocked", "created_at"},
+			`SELECT blocked, created_at FROM blocks WHERE blocker = ? ORDER BY created_at`,
+			[]interface{}{username}},
+		{&data.Reports, []string{"message_id", "reason", "status", "created_at"},
+			`SELECT message_id, reason, status, created_at FROM reports WHERE reporter = ? ORDER BY id`,
+			[]interface{}{username}},
+	}
+	for _, s := range sections {
+		if *s.target, err = queryRecords(db, s.columns, s.query, s.args...); err != nil {
+			return data, err
+		}
+	}
+	return data, nil
+}
+
+// queryRecords читает строки результата в записи с заданными именами полей
+func queryRecords(db *sql.DB, columns []string, query string, args ...interface{}) ([]gin.H, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := []gin.H{}
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		pointers := make([]interface{}, len(columns))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		if err := rows.Scan(pointers...); err != nil {
+			return nil, err
+		}
+		record := gin.H{}
+		for i, column := range columns {
+			record[column] = values[i]
+		}
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
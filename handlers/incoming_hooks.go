@@ -0,0 +1,197 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"gorutines/authorization_tools"
+	"gorutines/webhook_tools"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	maxIncomingHooksPerOwner = 10
+	// maxIncomingBody — предельный размер тела запроса входящего вебхука
+	maxIncomingBody = 64 << 10
+)
+
+// CreateIncomingHook — создание входящего вебхука (тело запроса: {"name": "ci", "to": "bob", "bot": "ci-bot"}).
+// Сообщения публикуются в переписку с to от имени текущего пользователя или его бота bot.
+// Токен и адрес для публикации возвращаются только в этом ответе.
+func CreateIncomingHook(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		owner, ok := currentSession(c, db)
+		if !ok {
+			return
+		}
+
+		var request struct {
+			Name string `json:"name" binding:"required"`
+			To   string `json:"to" binding:"required"`
+			Bot  string `json:"bot"`
+		}
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		request.Name = strings.TrimSpace(request.Name)
+
+		senderID, sender := owner.ID, owner.Username
+		if request.Bot != "" {
+			botID, err := authorization_tools.BotOwnedBy(owner.ID, request.Bot, db)
+			if errors.Is(err, sql.ErrNoRows) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "Бот не найден"})
+				return
+			}
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка базы данных"})
+				return
+			}
+			senderID, sender = botID, request.Bot
+		}
+
+		targetID, err := authorization_tools.GetUserID(request.To, db)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Пользователь " + request.To + " не найден"})
+			return
+		}
+
+		token, hook, err := webhook_tools.CreateIncomingHook(owner.ID, senderID, targetID, request.Name, maxIncomingHooksPerOwner, db)
+		if errors.Is(err, webhook_tools.ErrTooManyIncomingHooks) {
+			c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Нельзя создать больше %d входящих вебхуков", maxIncomingHooksPerOwner)})
+			return
+		}
+		if err != nil {
+			log.Println("Ошибка при создании входящего вебхука:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка базы данных"})
+			return
+		}
+		hook.Sender, hook.Target = sender, request.To
+		c.JSON(http.StatusCreated, gin.H{"hook": hook, "token": token, "url": publicBaseURL + "/hooks/" + token})
+	}
+}
+
+// GetIncomingHooks — входящие вебхуки текущего пользователя
+func GetIncomingHooks(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		owner, ok := currentSession(c, db)
+		if !ok {
+			return
+		}
+
+		hooks, err := webhook_tools.ListIncomingHooks(owner.ID, db)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка базы данных"})
+			return
+		}
+		c.JSON(http.StatusOK, hooks)
+	}
+}
+
+// DeleteIncomingHook отзывает входящий вебхук: его адрес перестаёт принимать сообщения
+func DeleteIncomingHook(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		owner, ok := currentSession(c, db)
+		if !ok {
+			return
+		}
+
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Неверный id вебхука"})
+			return
+		}
+		found, err := webhook_tools.DeleteIncomingHook(owner.ID, id, db)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка базы данных"})
+			return
+		}
+		if !found {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Вебхук не найден"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "incoming hook deleted"})
+	}
+}
+
+// PostIncomingHook — публикация сообщения через входящий вебхук. Авторизация — токен в адресе.
+// Тело — простой текст (text/plain) или JSON {"text": "...", "title": "...", "url": "...",
+// "fields": [{"name": "...", "value": "..."}]}. Сообщение доставляется так же, как отправленное через /ws.
+func PostIncomingHook(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		hook, err := webhook_tools.AuthenticateIncomingHook(c.Param("token"), db)
+		if errors.Is(err, webhook_tools.ErrIncomingHookInvalid) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		if errors.Is(err, webhook_tools.ErrIncomingHookDisabled) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Учетная запись заблокирована"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка базы данных"})
+			return
+		}
+
+		if wait := webhook_tools.IncomingRetryAfter(hook.HookID); wait > 0 {
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": "Слишком много сообщений, попробуйте позже"})
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxIncomingBody))
+		if err != nil {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Слишком большое сообщение"})
+			return
+		}
+		var payload webhook_tools.IncomingPayload
+		if c.ContentType() == "text/plain" {
+			payload.Text = string(body)
+		} else if err := json.Unmarshal(body, &payload); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Неверный JSON: " + err.Error()})
+			return
+		}
+		content, err := payload.Render()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		blocked, err := isBlocked(db, hook.Sender, hook.Target)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка базы данных"})
+			return
+		}
+		if blocked {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Нельзя отправить сообщение: пользователь заблокирован"})
+			return
+		}
+
+		msg := Message{
+			From:      hook.Sender,
+			FromID:    hook.SenderID,
+			FromBot:   hook.FromBot,
+			To:        hook.Target,
+			ToID:      hook.TargetID,
+			Content:   content,
+			CreatedAt: time.Now(),
+		}
+		if _, err := SaveMessageToDB(db, &msg); err != nil {
+			log.Println("Ошибка сохранения сообщения входящего вебхука:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка базы данных"})
+			return
+		}
+		go sendPrivateMessage(db, msg)
+		notifyWebhooks(db, webhook_tools.EventSendMessage, msg.FromID, msg.ToID, newSendMessageEvent(msg))
+
+		c.JSON(http.StatusCreated, gin.H{"message_id": msg.ID})
+	}
+}
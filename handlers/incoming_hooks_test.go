@@ -0,0 +1,72 @@
+package handlers
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestIncomingHookRateLimit(t *testing.T) {
+	db := newTestDB(t)
+	SetMailer(&captureMailer{}, "")
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/users", CreateUsers(db))
+	router.POST("/login", Login(db))
+	router.POST("/incoming-hooks", CreateIncomingHook(db))
+	router.POST("/hooks/:token", PostIncomingHook(db))
+
+	const password = "Quiet-harb0r-passphrase"
+	for _, name := range []string{"alice", "bob"} {
+		if code, body := doJSON(t, router, "POST", "/users", "", gin.H{
+			"username": name, "email": name + "@example.com", "password": password,
+		}); code != http.StatusOK && code != http.StatusCreated {
+			t.Fatalf("регистрация %s: %d %v", name, code, body)
+		}
+	}
+	code, body := doJSON(t, router, "POST", "/login", "", gin.H{"username": "alice", "password": password})
+	if code != http.StatusOK {
+		t.Fatalf("вход: %d %v", code, body)
+	}
+	accessToken, _ := body["accessToken"].(string)
+
+	code, body = doJSON(t, router, "POST", "/incoming-hooks", accessToken, gin.H{"name": "ci", "to": "bob"})
+	if code != http.StatusCreated {
+		t.Fatalf("создание вебхука: %d %v", code, body)
+	}
+	token, _ := body["token"].(string)
+
+	post := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/hooks/"+token, strings.NewReader("build passed"))
+		req.Header.Set("Content-Type", "text/plain")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	for i := 0; i < 10; i++ {
+		if w := post(); w.Code != http.StatusCreated {
+			t.Fatalf("сообщение %d из запаса: %d %s", i+1, w.Code, w.Body)
+		}
+	}
+	w := post()
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("сообщение сверх запаса: %d, ожидался 429", w.Code)
+	}
+	if retry, err := strconv.Atoi(w.Header().Get("Retry-After")); err != nil || retry < 1 || retry > 2 {
+		t.Errorf("Retry-After = %q, ожидалось от 1 до 2 секунд", w.Header().Get("Retry-After"))
+	}
+
+	t.Run("число вебхуков", func(t *testing.T) {
+		for i := 1; i < 10; i++ {
+			if code, body := doJSON(t, router, "POST", "/incoming-hooks", accessToken, gin.H{"name": "ci", "to": "bob"}); code != http.StatusCreated {
+				t.Fatalf("вебхук %d: %d %v", i+1, code, body)
+			}
+		}
+		if code, body := doJSON(t, router, "POST", "/incoming-hooks", accessToken, gin.H{"name": "ci", "to": "bob"}); code != http.StatusConflict {
+			t.Errorf("одиннадцатый вебхук: %d %v, ожидался 409", code, body)
+		}
+	})
+}
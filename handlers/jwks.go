@@ -0,0 +1,16 @@
+package handlers
+
+import (
+	"github.com/gin-gonic/gin"
+	"gorutines/authorization_tools"
+	"net/http"
+)
+
+// JWKS публикует открытые ключи подписи, чтобы другие сервисы могли проверять
+// access токены чата без общего секрета
+func JWKS() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Cache-Control", "public, max-age=300")
+		c.JSON(http.StatusOK, gin.H{"keys": authorization_tools.PublicJWKS()})
+	}
+}
@@ -0,0 +1,326 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"gorutines/authorization_tools"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Report — жалоба на сообщение. Текст сообщения сохраняется на момент жалобы,
+// чтобы модератор видел его даже после редактирования или удаления.
+type Report struct {
+	ID               int     `json:"id"`
+	MessageID        int     `json:"message_id"`
+	Reporter         string  `json:"reporter"`
+	Reason           string  `json:"reason"`
+	MessageFrom      string  `json:"message_from"`
+	MessageTo        string  `json:"message_to"`
+	MessageContent   string  `json:"message_content"`
+	MessageCreatedAt string  `json:"message_created_at"`
+	Status           string  `json:"status"`
+	ResolvedBy       *string `json:"resolved_by"`
+	ResolvedAt       *string `json:"resolved_at"`
+	CreatedAt        string  `json:"created_at"`
+}
+
+// ModerationLogEntry — запись журнала решений модераторов
+type ModerationLogEntry struct {
+	ID         int     `json:"id"`
+	ReportID   *int    `json:"report_id"`
+	Moderator  string  `json:"moderator"`
+	Action     string  `json:"action"`
+	TargetUser *string `json:"target_user"`
+	MessageID  *int    `json:"message_id"`
+	Note       *string `json:"note"`
+	CreatedAt  string  `json:"created_at"`
+}
+
+// Статусы жалобы после решения модератора
+var reportActions = map[string]string{
+	"dismiss":        "dismissed",
+	"delete_message": "message_deleted",
+	"suspend_author": "author_suspended",
+}
+
+// currentModerator проверяет, что запрос сделан модератором или администратором
+func currentModerator(c *gin.Context, db *sql.DB) (string, bool) {
+	username, ok := currentUser(c, db)
+	if !ok {
+		return "", false
+	}
+
+	role, err := authorization_tools.GetUserRole(username, db)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Пользователь не найден"})
+		return "", false
+	}
+	if role != "moderator" && role != "admin" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Недостаточно прав"})
+		return "", false
+	}
+	return username, true
+}
+
+// roleRank — старшинство ролей. Модератор не может применять меры к пользователям
+// своей или более старшей роли; у обычных пользователей и ботов старшинство нулевое.
+var roleRank = map[string]int{
+	"moderator": 1,
+	"admin":     2,
+}
+
+// outranks сообщает, что роль moderator старше роли target.
+// Пользователя, которого уже нет, считаем обычным.
+func outranks(db *sql.DB, moderator, target string) (bool, error) {
+	moderatorRole, err := authorization_tools.GetUserRole(moderator, db)
+	if err != nil {
+		return false, err
+	}
+	targetRole, err := authorization_tools.GetUserRole(target, db)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return false, err
+	}
+	return roleRank[moderatorRole] > roleRank[targetRole], nil
+}
+
+// ReportMessage — жалоба получателя на сообщение (тело запроса: {"reason": "..."})
+func ReportMessage(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		username, ok := currentUser(c, db)
+		if !ok {
+			return
+		}
+
+		messageID, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Неверный id сообщения"})
+			return
+		}
+
+		var request struct {
+			Reason string `json:"reason" binding:"required"`
+		}
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		var from, to, content string
+		var fromID int
+		var createdAt sql.NullString
+		err = db.QueryRow(`
+			SELECT m.from_user_id, fu.username, tu.username, m.content, m.created_at
+			FROM messages m
+			JOIN users fu ON fu.id = m.from_user_id
+			JOIN users tu ON tu.id = m.to_user_id
+			WHERE m.id = ?`, messageID).
+			Scan(&fromID, &from, &to, &content, &createdAt)
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Сообщение не найдено"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка базы данных"})
+			return
+		}
+
+		// Пожаловаться можно только на сообщение, адресованное тебе
+		if to != username || from == username {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Сообщение не найдено"})
+			return
+		}
+
+		res, err := db.Exec(`
+			INSERT INTO reports (message_id, reporter, reason, message_from, message_from_id, message_to, message_content, message_created_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+			messageID, username, request.Reason, from, fromID, to, content, createdAt)
+		if err != nil {
+			if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+				c.JSON(http.StatusConflict, gin.H{"error": "Вы уже пожаловались на это сообщение"})
+				return
+			}
+			log.Println("Ошибка при сохранении жалобы:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка базы данных"})
+			return
+		}
+		id, _ := res.LastInsertId()
+
+		c.JSON(http.StatusCreated, gin.H{"id": id, "status": "open"})
+	}
+}
+
+// GetReports — очередь жалоб для модераторов (параметр status, по умолчанию open)
+func GetReports(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, ok := currentModerator(c, db); !ok {
+			return
+		}
+
+		rows, err := db.Query(`
+			SELECT id, message_id, reporter, reason, message_from, message_to, message_content,
+				COALESCE(message_created_at, ''), status, resolved_by, resolved_at, created_at
+			FROM reports
+			WHERE status = ?
+			ORDER BY created_at ASC`, c.DefaultQuery("status", "open"))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка базы данных"})
+			return
+		}
+		defer rows.Close()
+
+		reports := []Report{}
+		for rows.Next() {
+			var r Report
+			if err := rows.Scan(&r.ID, &r.MessageID, &r.Reporter, &r.Reason, &r.MessageFrom, &r.MessageTo,
+				&r.MessageContent, &r.MessageCreatedAt, &r.Status, &r.ResolvedBy, &r.ResolvedAt, &r.CreatedAt); err != nil {
+				log.Println("Ошибка при чтении жалобы:", err)
+				continue
+			}
+			reports = append(reports, r)
+		}
+		c.JSON(http.StatusOK, reports)
+	}
+}
+
+// ResolveReport — решение модератора по жалобе.
+// Тело запроса: {"action": "dismiss" | "delete_message" | "suspend_author", "note": "..."}
+func ResolveReport(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		moderator, ok := currentModerator(c, db)
+		if !ok {
+			return
+		}
+
+		reportID, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Неверный id жалобы"})
+			return
+		}
+
+		var request struct {
+			Action string `json:"action" binding:"required"`
+			Note   string `json:"note"`
+		}
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		status, ok := reportActions[request.Action]
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Неизвестное действие: " + request.Action})
+			return
+		}
+
+		var messageID int
+		var author, currentStatus string
+		// Автор мог сменить имя после жалобы — берём текущее по id, снимок имени оставляем как запасной вариант
+		err = db.QueryRow(`
+			SELECT r.message_id, COALESCE(u.username, r.message_from), r.status
+			FROM reports r
+			LEFT JOIN users u ON u.id = r.message_from_id
+			WHERE r.id = ?`, reportID).
+			Scan(&messageID, &author, &currentStatus)
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Жалоба не найдена"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка базы данных"})
+			return
+		}
+		if currentStatus != "open" {
+			c.JSON(http.StatusConflict, gin.H{"error": "Жалоба уже рассмотрена"})
+			return
+		}
+
+		if request.Action != "dismiss" {
+			allowed, err := outranks(db, moderator, author)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка базы данных"})
+				return
+			}
+			if !allowed {
+				c.JSON(http.StatusForbidden, gin.H{"error": "Нельзя применять меры к пользователю с такой же или более старшей ролью"})
+				return
+			}
+		}
+
+		switch request.Action {
+		case "delete_message":
+			var exists int
+			if err := db.QueryRow("SELECT COUNT(*) FROM messages WHERE id = ?", messageID).Scan(&exists); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка базы данных"})
+				return
+			}
+			// Автор мог уже удалить сообщение сам — жалоба всё равно закрывается
+			if exists > 0 {
+				if err := DeleteMessageAsModerator(db, messageID, moderator); err != nil {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+			}
+		case "suspend_author":
+			if err := authorization_tools.SuspendUser(author, db); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			disconnectUser(author)
+			disconnectOwnedBots(db, author)
+		}
+
+		_, err = db.Exec(`UPDATE reports SET status = ?, resolved_by = ?, resolved_at = CURRENT_TIMESTAMP WHERE id = ?`,
+			status, moderator, reportID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка базы данных"})
+			return
+		}
+
+		if err := logModeration(db, reportID, moderator, request.Action, author, messageID, request.Note); err != nil {
+			log.Println("Ошибка записи в журнал модерации:", err)
+		}
+
+		c.JSON(http.StatusOK, gin.H{"id": reportID, "status": status})
+	}
+}
+
+// GetModerationLog — журнал решений модераторов, новые записи первыми
+func GetModerationLog(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, ok := currentModerator(c, db); !ok {
+			return
+		}
+
+		rows, err := db.Query(`
+			SELECT id, report_id, moderator, action, target_user, message_id, note, created_at
+			FROM moderation_log
+			ORDER BY id DESC`)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка базы данных"})
+			return
+		}
+		defer rows.Close()
+
+		entries := []ModerationLogEntry{}
+		for rows.Next() {
+			var e ModerationLogEntry
+			if err := rows.Scan(&e.ID, &e.ReportID, &e.Moderator, &e.Action, &e.TargetUser, &e.MessageID, &e.Note, &e.CreatedAt); err != nil {
+				log.Println("Ошибка при чтении журнала модерации:", err)
+				continue
+			}
+			entries = append(entries, e)
+		}
+		c.JSON(http.StatusOK, entries)
+	}
+}
+
+func logModeration(db *sql.DB, reportID int, moderator, action, targetUser string, messageID int, note string) error {
+	_, err := db.Exec(`
+		INSERT INTO moderation_log (report_id, moderator, action, target_user, message_id, note)
+		VALUES (?, ?, ?, ?, ?, NULLIF(?, ''))`,
+		reportID, moderator, action, targetUser, messageID, note)
+	return err
+}
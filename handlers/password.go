@@ -0,0 +1,142 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"gorutines/authorization_tools"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Ограничения запросов сброса пароля: с одного адреса клиента и писем на один адрес почты
+const (
+	forgotPasswordIPLimit    = 10
+	forgotPasswordEmailLimit = 3
+	forgotPasswordWindow     = time.Hour
+)
+
+// ForgotPassword — запрос письма со ссылкой для сброса пароля (тело запроса: {"email": "..."}).
+// Ответ не зависит от того, зарегистрирован ли адрес.
+func ForgotPassword(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var request struct {
+			Email string `json:"email" binding:"required"`
+		}
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		// Ограничение по адресу клиента не зависит от того, есть ли такая почта, поэтому о нём можно сообщить
+		wait, err := authorization_tools.Throttle("forgot-ip:"+c.ClientIP(), forgotPasswordIPLimit, forgotPasswordWindow, db)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка базы данных"})
+			return
+		}
+		if wait > 0 {
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": "Слишком много запросов, попробуйте позже"})
+			return
+		}
+
+		response := gin.H{"message": "Если адрес зарегистрирован, на него отправлено письмо со ссылкой для сброса пароля"}
+
+		var userID int
+		var username, email string
+		err = db.QueryRow("SELECT id, username, email FROM users WHERE email = ? COLLATE NOCASE AND role != 'bot'", request.Email).Scan(&userID, &username, &email)
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusOK, response)
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка базы данных"})
+			return
+		}
+
+		// Письмо готовится и отправляется в фоне: по времени ответа нельзя узнать, зарегистрирован ли адрес
+		go sendPasswordResetEmail(db, userID, username, email, c.ClientIP())
+		c.JSON(http.StatusOK, response)
+	}
+}
+
+// sendPasswordResetEmail выдаёт токен сброса и отправляет его на почту, но не больше
+// forgotPasswordEmailLimit писем в час одному пользователю. Ошибки только логируются.
+func sendPasswordResetEmail(db *sql.DB, userID int, username, email, ip string) {
+	wait, err := authorization_tools.Throttle("forgot-email:"+strconv.Itoa(userID), forgotPasswordEmailLimit, forgotPasswordWindow, db)
+	if err != nil {
+		log.Println("Ошибка учёта запроса сброса пароля:", err)
+		return
+	}
+	if wait > 0 {
+		return
+	}
+
+	token, err := authorization_tools.CreatePasswordReset(userID, db)
+	if err != nil {
+		log.Println("Ошибка при создании токена сброса пароля:", err)
+		return
+	}
+
+	link := publicBaseURL + "/reset-password?token=" + url.QueryEscape(token)
+	body := "Чтобы задать новый пароль, перейдите по ссылке:\n\n" + link +
+		"\n\nКод для сброса: " + token +
+		"\n\nСсылка действует один час. Если вы не запрашивали сброс пароля, просто проигнорируйте это письмо."
+	if err := mailer.Send(email, "Сброс пароля", body); err != nil {
+		log.Printf("Ошибка отправки письма на %s: %v", email, err)
+	}
+
+	if err := authorization_tools.LogAuthEvent(db, username, "password_reset_requested", ip, ""); err != nil {
+		log.Println("Ошибка записи события авторизации:", err)
+	}
+}
+
+// ResetPassword — установка нового пароля по токену из письма
+// (тело запроса: {"token": "...", "password": "..."}). Все сессии пользователя завершаются.
+func ResetPassword(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var request struct {
+			Token    string `json:"token" binding:"required"`
+			Password string `json:"password" binding:"required"`
+		}
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		// Пароль проверяется так же, как при регистрации, поэтому сначала нужен владелец токена
+		username, email, err := authorization_tools.PasswordResetUser(request.Token, db)
+		if errors.Is(err, authorization_tools.ErrResetTokenInvalid) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка базы данных"})
+			return
+		}
+		if validationFailed(c, authorization_tools.ValidatePassword(request.Password, username, email)) {
+			return
+		}
+
+		username, err = authorization_tools.ResetPassword(request.Token, request.Password, db)
+		if errors.Is(err, authorization_tools.ErrResetTokenInvalid) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			log.Println("Ошибка при сбросе пароля:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка базы данных"})
+			return
+		}
+
+		disconnectUser(username)
+		if err := authorization_tools.LogAuthEvent(db, username, "password_reset", c.ClientIP(), ""); err != nil {
+			log.Println("Ошибка записи события авторизации:", err)
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Пароль изменён, войдите заново"})
+	}
+}
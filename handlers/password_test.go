@@ -0,0 +1,236 @@
+package handlers
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"gorutines/authorization_tools"
+	"gorutines/models"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+)
+
+// captureMailer запоминает отправленные письма вместо отправки
+type captureMailer struct {
+	mu      sync.Mutex
+	letters []capturedLetter
+}
+
+type capturedLetter struct {
+	to, subject, body string
+}
+
+func (m *captureMailer) Send(to, subject, body string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.letters = append(m.letters, capturedLetter{to, subject, body})
+	return nil
+}
+
+func (m *captureMailer) count() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.letters)
+}
+
+// waitCount ждёт не дольше timeout, пока писем станет n: письма отправляются в фоне
+func (m *captureMailer) waitCount(n int, timeout time.Duration) bool {
+	for deadline := time.Now().Add(timeout); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if m.count() >= n {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *captureMailer) last(subject string) (capturedLetter, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := len(m.letters) - 1; i >= 0; i-- {
+		if m.letters[i].subject == subject {
+			return m.letters[i], true
+		}
+	}
+	return capturedLetter{}, false
+}
+
+// newTestDB создаёт базу в отдельном каталоге: InitDB открывает ./project.db
+func newTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	t.Setenv("JWT_SECRET_KEY", "test")
+	t.Setenv("ARGON2_TIME", "1")
+	t.Setenv("ARGON2_MEMORY_KIB", "8192")
+	for _, load := range []func() error{
+		authorization_tools.LoadKeyring,
+		authorization_tools.LoadPasswordParams,
+		authorization_tools.LoadValidationPolicy,
+	} {
+		if err := load(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	db := models.InitDB()
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func doJSON(t *testing.T, router http.Handler, method, path, bearer string, body interface{}) (int, map[string]interface{}) {
+	t.Helper()
+	data, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(method, path, bytes.NewReader(data))
+	req.Header.Set("Content-Type", "application/json")
+	if bearer != "" {
+		req.Header.Set("Authorization", "Bearer "+bearer)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	var response map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	return w.Code, response
+}
+
+var resetCodePattern = regexp.MustCompile(`Код для сброса: (\S+)`)
+
+func TestForgotAndResetPassword(t *testing.T) {
+	db := newTestDB(t)
+	mails := &captureMailer{}
+	SetMailer(mails, "")
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/users", CreateUsers(db))
+	router.POST("/login", Login(db))
+	router.POST("/refresh", RefreshToken(db))
+	router.POST("/password/forgot", ForgotPassword(db))
+	router.POST("/password/reset", ResetPassword(db))
+
+	const oldPassword, newPassword = "Old-passw0rd-long", "New-passw0rd-long"
+	if code, body := doJSON(t, router, "POST", "/users", "", gin.H{
+		"username": "alice", "email": "alice@example.com", "password": oldPassword,
+	}); code != http.StatusOK && code != http.StatusCreated {
+		t.Fatalf("регистрация: %d %v", code, body)
+	}
+	code, body := doJSON(t, router, "POST", "/login", "", gin.H{"username": "alice", "password": oldPassword})
+	if code != http.StatusOK {
+		t.Fatalf("вход: %d %v", code, body)
+	}
+	refreshToken, _ := body["refreshToken"].(string)
+
+	requestReset := func() string {
+		t.Helper()
+		sent := mails.count()
+		if code, body := doJSON(t, router, "POST", "/password/forgot", "", gin.H{"email": "alice@example.com"}); code != http.StatusOK {
+			t.Fatalf("запрос сброса: %d %v", code, body)
+		}
+		mails.waitCount(sent+1, 2*time.Second)
+		letter, ok := mails.last("Сброс пароля")
+		if !ok || letter.to != "alice@example.com" {
+			t.Fatalf("письмо о сбросе пароля не отправлено")
+		}
+		m := resetCodePattern.FindStringSubmatch(letter.body)
+		if m == nil {
+			t.Fatalf("в письме нет кода сброса: %q", letter.body)
+		}
+		return m[1]
+	}
+
+	// Неизвестный адрес получает тот же ответ, письмо не отправляется
+	sent := mails.count()
+	if code, _ := doJSON(t, router, "POST", "/password/forgot", "", gin.H{"email": "nobody@example.com"}); code != http.StatusOK {
+		t.Errorf("запрос сброса для неизвестного адреса: %d", code)
+	}
+	if mails.waitCount(sent+1, 200*time.Millisecond) {
+		t.Errorf("письмо отправлено на неизвестный адрес")
+	}
+
+	token := requestReset()
+
+	// Новый пароль проверяется по тем же правилам, что при регистрации, и отказ не расходует токен
+	code, body = doJSON(t, router, "POST", "/password/reset", "", gin.H{"token": token, "password": "Alice-passw0rd-long"})
+	if code != http.StatusBadRequest || body["fields"] == nil {
+		t.Errorf("пароль с именем пользователя: %d %v, ожидалась ошибка проверки", code, body)
+	}
+
+	if code, body := doJSON(t, router, "POST", "/password/reset", "", gin.H{"token": token, "password": newPassword}); code != http.StatusOK {
+		t.Fatalf("сброс пароля: %d %v", code, body)
+	}
+
+	t.Run("токен одноразовый", func(t *testing.T) {
+		code, _ := doJSON(t, router, "POST", "/password/reset", "", gin.H{"token": token, "password": "Other-passw0rd-long"})
+		if code != http.StatusBadRequest {
+			t.Errorf("повторный сброс тем же токеном: %d, ожидался 400", code)
+		}
+	})
+
+	t.Run("refresh токены отозваны", func(t *testing.T) {
+		if code, _ := doJSON(t, router, "POST", "/refresh", refreshToken, nil); code == http.StatusOK {
+			t.Errorf("refresh токен, выданный до сброса, всё ещё действует")
+		}
+	})
+
+	t.Run("вход с новым паролем", func(t *testing.T) {
+		if code, body := doJSON(t, router, "POST", "/login", "", gin.H{"username": "alice", "password": newPassword}); code != http.StatusOK {
+			t.Errorf("вход с новым паролем: %d %v", code, body)
+		}
+		if code, _ := doJSON(t, router, "POST", "/login", "", gin.H{"username": "alice", "password": oldPassword}); code == http.StatusOK {
+			t.Errorf("старый пароль всё ещё действует")
+		}
+	})
+
+	t.Run("истёкший токен", func(t *testing.T) {
+		expired := requestReset()
+		if _, err := db.Exec(`UPDATE password_resets SET expires_at = ?`, time.Now().Add(-time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+		code, _ := doJSON(t, router, "POST", "/password/reset", "", gin.H{"token": expired, "password": "Other-passw0rd-long"})
+		if code != http.StatusBadRequest {
+			t.Errorf("сброс истёкшим токеном: %d, ожидался 400", code)
+		}
+		var n int
+		db.QueryRow(`SELECT COUNT(*) FROM password_resets`).Scan(&n)
+		if n != 0 {
+			t.Errorf("истёкший токен не удалён")
+		}
+	})
+
+	t.Run("ограничение запросов", func(t *testing.T) {
+		// Третье письмо за час ещё уходит, дальше запросы молча пропускаются
+		requestReset()
+		sent := mails.count()
+		if code, _ := doJSON(t, router, "POST", "/password/forgot", "", gin.H{"email": "alice@example.com"}); code != http.StatusOK {
+			t.Errorf("запрос сверх лимита писем: %d, ожидался тот же ответ 200", code)
+		}
+		if mails.waitCount(sent+1, 200*time.Millisecond) {
+			t.Errorf("отправлено больше %d писем за час", forgotPasswordEmailLimit)
+		}
+
+		// С одного адреса клиента — не больше forgotPasswordIPLimit запросов, в том числе для неизвестной почты
+		var code int
+		for i := 0; i < forgotPasswordIPLimit && code != http.StatusTooManyRequests; i++ {
+			code, _ = doJSON(t, router, "POST", "/password/forgot", "", gin.H{"email": "nobody@example.com"})
+		}
+		if code != http.StatusTooManyRequests {
+			t.Errorf("запросы сверх лимита адреса: %d, ожидался 429", code)
+		}
+	})
+}
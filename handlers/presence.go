@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+)
+
+// PresenceEvent — пользователь появился в сети или вышел из неё
+type PresenceEvent struct {
+	Action   string `json:"action"`
+	Username string `json:"username"`
+	Online   bool   `json:"online"`
+	Bot      bool   `json:"bot,omitempty"`
+}
+
+// TypingEvent — собеседник набирает сообщение
+type TypingEvent struct {
+	Action string `json:"action"`
+	From   string `json:"from"`
+}
+
+// notifyPresence рассылает статус пользователя всем подключённым, кроме тех,
+// с кем он связан блокировкой
+func notifyPresence(db *sql.DB, username string, online, bot bool) {
+	blocked, err := blockedPeers(db, username)
+	if err != nil {
+		log.Printf("Ошибка получения блокировок %s: %v", username, err)
+		return
+	}
+
+	data, err := json.Marshal(PresenceEvent{Action: "presence", Username: username, Online: online, Bot: bot})
+	if err != nil {
+		log.Printf("Ошибка маршалинга JSON: %v", err)
+		return
+	}
+
+	var recipients []*client
+	for _, cl := range allClients() {
+		if name := cl.name(); name != username && !blocked[name] {
+			recipients = append(recipients, cl)
+		}
+	}
+	sendToClients(recipients, data)
+}
+
+// notifyTyping сообщает получателю, что отправитель набирает сообщение
+func notifyTyping(db *sql.DB, from, to string) {
+	blocked, err := isBlocked(db, from, to)
+	if err != nil {
+		log.Printf("Ошибка проверки блокировки: %v", err)
+		return
+	}
+	if blocked {
+		return
+	}
+
+	data, err := json.Marshal(TypingEvent{Action: "typing", From: from})
+	if err != nil {
+		log.Printf("Ошибка маршалинга JSON: %v", err)
+		return
+	}
+	sendToUser(to, data, nil)
+}
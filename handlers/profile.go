@@ -0,0 +1,240 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"gorutines/authorization_tools"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Profile — публичные данные учётной записи текущего пользователя
+type Profile struct {
+	ID          int    `json:"id"`
+	Username    string `json:"username"`
+	Email       string `json:"email"`
+	DisplayName string `json:"display_name"`
+	AvatarURL   string `json:"avatar_url"`
+}
+
+// ProfileUpdatedEvent — пользователь изменил имя или профиль
+type ProfileUpdatedEvent struct {
+	Action      string `json:"action"`
+	UserID      int    `json:"user_id"`
+	OldUsername string `json:"old_username,omitempty"`
+	Username    string `json:"username"`
+	DisplayName string `json:"display_name"`
+	AvatarURL   string `json:"avatar_url"`
+}
+
+// Таблицы, в которых пользователь хранится по имени, а не по id
+var usernameColumns = []struct{ table, column string }{
+	{"drafts", "username"},
+	{"drafts", "peer"},
+	{"blocks", "blocker"},
+	{"blocks", "blocked"},
+	{"attachments", "uploader"},
+	{"reports", "reporter"},
+	{"reports", "message_from"},
+	{"reports", "message_to"},
+	{"reports", "resolved_by"},
+	{"moderation_log", "moderator"},
+	{"moderation_log", "target_user"},
+	{"auth_events", "username"},
+}
+
+func loadProfile(db *sql.DB, userID int) (Profile, error) {
+	var p Profile
+	var displayName, avatarURL sql.NullString
+	err := db.QueryRow("SELECT id, username, email, display_name, avatar_url FROM users WHERE id = ?", userID).
+		Scan(&p.ID, &p.Username, &p.Email, &displayName, &avatarURL)
+	p.DisplayName = displayName.String
+	p.AvatarURL = avatarURL.String
+	return p, err
+}
+
+// GetProfile — профиль текущего пользователя
+func GetProfile(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, ok := currentSession(c, db)
+		if !ok {
+			return
+		}
+
+		profile, err := loadProfile(db, user.ID)
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Пользователь не найден"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка базы данных"})
+			return
+		}
+		c.JSON(http.StatusOK, profile)
+	}
+}
+
+// UpdateProfile — изменение имени, почты, отображаемого имени и аватара.
+// Передаются только изменяемые поля. После смены имени выдаётся новый access токен
+// для текущей сессии, а подключённые клиенты получают событие profile_updated.
+func UpdateProfile(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, ok := currentSession(c, db)
+		if !ok {
+			return
+		}
+
+		var request struct {
+			Username    *string `json:"username"`
+			Email       *string `json:"email"`
+			DisplayName *string `json:"display_name"`
+			AvatarURL   *string `json:"avatar_url"`
+		}
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		old, err := loadProfile(db, user.ID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка базы данных"})
+			return
+		}
+		profile := old
+
+		var checks []*authorization_tools.FieldError
+		if request.Username != nil && *request.Username != old.Username {
+			profile.Username = strings.TrimSpace(*request.Username)
+			checks = append(checks, authorization_tools.ValidateUsername(profile.Username))
+		}
+		if request.Email != nil && *request.Email != old.Email {
+			profile.Email = strings.TrimSpace(*request.Email)
+			checks = append(checks, authorization_tools.ValidateEmail(profile.Email))
+		}
+		if request.DisplayName != nil {
+			profile.DisplayName = strings.TrimSpace(*request.DisplayName)
+		}
+		if request.AvatarURL != nil {
+			profile.AvatarURL = strings.TrimSpace(*request.AvatarURL)
+			if profile.AvatarURL != "" {
+				u, err := url.Parse(profile.AvatarURL)
+				if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+					checks = append(checks, &authorization_tools.FieldError{
+						Field: "avatar_url", Code: "invalid", Message: "Аватар должен быть http(s) ссылкой"})
+				}
+			}
+		}
+		if validationFailed(c, checks...) {
+			return
+		}
+
+		renamed := profile.Username != old.Username
+		if err := saveProfile(db, old.Username, profile); err != nil {
+			if uniqueViolation(c, err) {
+				return
+			}
+			log.Println("Ошибка при обновлении профиля:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка базы данных"})
+			return
+		}
+
+		if profile.Email != old.Email {
+			sendVerificationEmail(db, profile.ID, profile.Email)
+		}
+
+		response := gin.H{"profile": profile}
+		if renamed {
+			renameClients(old.Username, profile.Username)
+
+			// Старый токен по-прежнему действителен (пользователь определяется по id),
+			// но клиенту нужен токен с актуальным именем
+			accessToken, err := authorization_tools.GenerateAccessToken(user.ID, profile.Username, user.SessionID)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			response["accessToken"] = accessToken
+		}
+
+		event := ProfileUpdatedEvent{
+			Action:      "profile_updated",
+			UserID:      profile.ID,
+			Username:    profile.Username,
+			DisplayName: profile.DisplayName,
+			AvatarURL:   profile.AvatarURL,
+		}
+		if renamed {
+			event.OldUsername = old.Username
+		}
+		notifyProfileUpdated(db, event)
+
+		c.JSON(http.StatusOK, response)
+	}
+}
+
+// saveProfile обновляет пользователя и, при смене имени, все ссылки на него по имени
+func saveProfile(db *sql.DB, oldUsername string, p Profile) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Новый адрес почты нужно подтвердить заново
+	_, err = tx.Exec(`
+		UPDATE users SET username = ?, email = ?, display_name = ?, avatar_url = ?,
+			email_verified_at = CASE WHEN email = ? THEN email_verified_at ELSE NULL END
+		WHERE id = ?`,
+		p.Username, p.Email, p.DisplayName, p.AvatarURL, p.Email, p.ID)
+	if err != nil {
+		return err
+	}
+
+	if p.Username != oldUsername {
+		for _, ref := range usernameColumns {
+			query := "UPDATE " + ref.table + " SET " + ref.column + " = ? WHERE " + ref.column + " = ?"
+			if _, err := tx.Exec(query, p.Username, oldUsername); err != nil {
+				return err
+			}
+		}
+
+		// Неудачные попытки входа переходят к новому имени, иначе смена имени снимала бы блокировку.
+		// Счётчик под новым именем мог набраться, пока оно было свободно, — он к этому пользователю не относится.
+		if _, err := tx.Exec("DELETE FROM login_attempts WHERE key = ?", "user:"+p.Username); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("UPDATE login_attempts SET key = ? WHERE key = ?", "user:"+p.Username, "user:"+oldUsername); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// notifyProfileUpdated рассылает новый профиль всем подключённым, включая другие
+// устройства самого пользователя, кроме связанных с ним блокировкой
+func notifyProfileUpdated(db *sql.DB, event ProfileUpdatedEvent) {
+	blocked, err := blockedPeers(db, event.Username)
+	if err != nil {
+		log.Printf("Ошибка получения блокировок %s: %v", event.Username, err)
+		return
+	}
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Ошибка маршалинга JSON: %v", err)
+		return
+	}
+
+	var recipients []*client
+	for _, cl := range allClients() {
+		if !blocked[cl.name()] {
+			recipients = append(recipients, cl)
+		}
+	}
+	sendToClients(recipients, data)
+}
@@ -0,0 +1,136 @@
+package handlers
+
+import (
+	"database/sql"
+	"github.com/gin-gonic/gin"
+	"html"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	searchDefaultLimit = 20
+	searchMaxLimit     = 100
+)
+
+// SearchResult — найденное сообщение с подсвеченным фрагментом текста
+type SearchResult struct {
+	ID        int    `json:"id"`
+	FromUser  string `json:"from"`
+	ToUser    string `json:"to"`
+	Snippet   string `json:"snippet"` // фрагмент в HTML: текст экранирован, совпадения обёрнуты в <mark>
+	Timestamp string `json:"timestamp"`
+}
+
+// FTS5 обрамляет совпадения этими символами из области для частного использования,
+// а после экранирования текста они заменяются на <mark> и </mark>
+const (
+	snippetMatchStart = "\uE000"
+	snippetMatchEnd   = "\uE001"
+)
+
+var snippetMarkers = strings.NewReplacer(snippetMatchStart, "<mark>", snippetMatchEnd, "</mark>")
+
+// highlightSnippet экранирует фрагмент сообщения и подсвечивает совпадения.
+// Теги из текста сообщения выводятся как текст, а не как разметка.
+func highlightSnippet(snippet string) string {
+	return snippetMarkers.Replace(html.EscapeString(snippet))
+}
+
+// buildMatchQuery превращает пользовательский ввод в безопасный запрос FTS5:
+// каждое слово берётся в кавычки, чтобы операторы FTS5 не ломали синтаксис.
+// Последнее слово ищется по префиксу.
+func buildMatchQuery(q string) string {
+	words := strings.Fields(q)
+	for i, w := range words {
+		words[i] = `"` + strings.ReplaceAll(w, `"`, `""`) + `"`
+	}
+	if len(words) > 0 {
+		words[len(words)-1] += "*"
+	}
+	return strings.Join(words, " ")
+}
+
+// SearchMessages — полнотекстовый поиск по сообщениям текущего пользователя.
+// Параметры: q — строка поиска, with — ограничить поиск диалогом с пользователем,
+// limit и offset — постраничный вывод.
+func SearchMessages(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, ok := currentSession(c, db)
+		if !ok {
+			return
+		}
+
+		match := buildMatchQuery(c.Query("q"))
+		if match == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Пустой поисковый запрос"})
+			return
+		}
+
+		limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(searchDefaultLimit)))
+		if err != nil || limit <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Неверный параметр limit"})
+			return
+		}
+		if limit > searchMaxLimit {
+			limit = searchMaxLimit
+		}
+		offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+		if err != nil || offset < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Неверный параметр offset"})
+			return
+		}
+
+		// Ищем только в диалогах, где пользователь участвует
+		query := `
+			SELECT m.id, fu.username, tu.username,
+				snippet(messages_fts, 0, ?, ?, '…', 10),
+				m.created_at
+			FROM messages_fts
+			JOIN messages m ON m.id = messages_fts.rowid
+			JOIN users fu ON fu.id = m.from_user_id
+			JOIN users tu ON tu.id = m.to_user_id
+			WHERE messages_fts MATCH ?
+				AND (m.from_user_id = ? OR m.to_user_id = ?)`
+		args := []interface{}{snippetMatchStart, snippetMatchEnd, match, user.ID, user.ID}
+
+		if with := c.Query("with"); with != "" {
+			query += ` AND (fu.username = ? OR tu.username = ?)`
+			args = append(args, with, with)
+		}
+
+		// Запрашиваем на одну запись больше, чтобы понять, есть ли следующая страница
+		query += ` ORDER BY rank, m.created_at DESC LIMIT ? OFFSET ?;`
+		args = append(args, limit+1, offset)
+
+		rows, err := db.Query(query, args...)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка базы данных"})
+			return
+		}
+		defer rows.Close()
+
+		results := []SearchResult{}
+		for rows.Next() {
+			var r SearchResult
+			if err := rows.Scan(&r.ID, &r.FromUser, &r.ToUser, &r.Snippet, &r.Timestamp); err != nil {
+				continue
+			}
+			r.Snippet = highlightSnippet(r.Snippet)
+			results = append(results, r)
+		}
+
+		var nextOffset *int
+		if len(results) > limit {
+			results = results[:limit]
+			next := offset + limit
+			nextOffset = &next
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"results":     results,
+			"next_offset": nextOffset,
+		})
+	}
+}
@@ -0,0 +1,199 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"gorutines/authorization_tools"
+	"log"
+	"net/http"
+)
+
+// secondFactor — код из приложения-аутентификатора либо одноразовый код восстановления
+type secondFactor struct {
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+// verify проверяет второй фактор пользователя. Использование кода восстановления попадает в журнал.
+func (f secondFactor) verify(c *gin.Context, db *sql.DB, userID int, username string) error {
+	switch {
+	case f.Code != "":
+		return authorization_tools.VerifyTOTP(userID, f.Code, db)
+	case f.RecoveryCode != "":
+		if err := authorization_tools.UseRecoveryCode(userID, f.RecoveryCode, db); err != nil {
+			return err
+		}
+		if err := authorization_tools.LogAuthEvent(db, username, "recovery_code_used", c.ClientIP(), ""); err != nil {
+			log.Println("Ошибка записи события авторизации:", err)
+		}
+		return nil
+	default:
+		return errors.New("не указан код подтверждения")
+	}
+}
+
+// EnrollTOTP — начало настройки двухфакторной аутентификации: выдаёт секрет и otpauth URI для QR-кода
+func EnrollTOTP(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, ok := currentSession(c, db)
+		if !ok {
+			return
+		}
+
+		secret, uri, err := authorization_tools.EnrollTOTP(user.ID, user.Username, db)
+		if errors.Is(err, authorization_tools.ErrTOTPAlreadyEnabled) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		if errors.Is(err, authorization_tools.ErrTOTPKeyMissing) {
+			log.Println("Ошибка при настройке TOTP:", err)
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Двухфакторная аутентификация не настроена на сервере"})
+			return
+		}
+		if err != nil {
+			log.Println("Ошибка при настройке TOTP:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка базы данных"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"secret": secret, "otpauth_uri": uri})
+	}
+}
+
+// ConfirmTOTP — включение двухфакторной аутентификации по первому коду из приложения
+// (тело запроса: {"code": "123456"}). В ответе коды восстановления, они больше нигде не показываются.
+func ConfirmTOTP(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, ok := currentSession(c, db)
+		if !ok {
+			return
+		}
+
+		var request struct {
+			Code string `json:"code" binding:"required"`
+		}
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		codes, err := authorization_tools.ConfirmTOTP(user.ID, request.Code, db)
+		switch {
+		case errors.Is(err, authorization_tools.ErrTOTPAlreadyEnabled):
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		case errors.Is(err, authorization_tools.ErrTOTPNotEnrolled), errors.Is(err, authorization_tools.ErrInvalidTOTPCode):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		case err != nil:
+			log.Println("Ошибка при подтверждении TOTP:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка базы данных"})
+			return
+		}
+
+		if err := authorization_tools.LogAuthEvent(db, user.Username, "totp_enabled", c.ClientIP(), ""); err != nil {
+			log.Println("Ошибка записи события авторизации:", err)
+		}
+		c.JSON(http.StatusOK, gin.H{"recovery_codes": codes})
+	}
+}
+
+// DisableTOTP — отключение второго фактора (тело запроса: {"password": "...", "code": "..."}
+// либо "recovery_code" вместо "code")
+func DisableTOTP(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, ok := currentSession(c, db)
+		if !ok {
+			return
+		}
+
+		var request struct {
+			Password string `json:"password" binding:"required"`
+			secondFactor
+		}
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		if !verifyCredentials(c, db, user.Username, request.Password) {
+			return
+		}
+		if !beginLoginAttempt(c, db, user.Username) {
+			return
+		}
+		if err := request.verify(c, db, user.ID, user.Username); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		loginAttemptPassed(c, db, user.Username)
+
+		if err := authorization_tools.DisableTOTP(user.ID, db); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка базы данных"})
+			return
+		}
+		if err := authorization_tools.LogAuthEvent(db, user.Username, "totp_disabled", c.ClientIP(), ""); err != nil {
+			log.Println("Ошибка записи события авторизации:", err)
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Двухфакторная аутентификация отключена"})
+	}
+}
+
+// LoginSecondFactor — второй шаг входа: обмен challengeToken из /login и кода на пару токенов
+// (тело запроса: {"challenge_token": "...", "code": "..."} либо "recovery_code" вместо "code")
+func LoginSecondFactor(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var request struct {
+			ChallengeToken string `json:"challenge_token" binding:"required"`
+			secondFactor
+		}
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		claims, err := authorization_tools.ValidateLoginChallenge(request.ChallengeToken)
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+		userID, username, err := authorization_tools.UserFromClaims(claims, db)
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+
+		// Учётную запись могли заблокировать между шагами входа
+		suspended, err := authorization_tools.IsSuspended(username, db)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if suspended {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Учетная запись заблокирована"})
+			return
+		}
+
+		// Подбор кода второго фактора ограничивается теми же счётчиками, что и подбор пароля
+		if !beginLoginAttempt(c, db, username) {
+			return
+		}
+		if err := request.verify(c, db, userID, username); err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+		loginAttemptPassed(c, db, username)
+		err = authorization_tools.ConsumeLoginChallenge(claims, db)
+		if errors.Is(err, authorization_tools.ErrLoginChallengeUsed) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка базы данных"})
+			return
+		}
+
+		deviceName, _ := claims["device_name"].(string)
+		startSession(c, db, userID, username, deviceName)
+	}
+}
@@ -0,0 +1,109 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"gorutines/authorization_tools"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// totpAt вычисляет код приложения-аутентификатора для момента at (RFC 6238, 30 секунд, 6 цифр)
+func totpAt(t *testing.T, secret string, at time.Time) string {
+	t.Helper()
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(at.Unix()/30))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	return fmt.Sprintf("%06d", (binary.BigEndian.Uint32(sum[offset:offset+4])&0x7fffffff)%1000000)
+}
+
+func TestSecondFactorReplay(t *testing.T) {
+	db := newTestDB(t)
+	SetMailer(&captureMailer{}, "")
+	t.Setenv("TOTP_ENCRYPTION_KEY", strings.Repeat("ab", 32))
+	if err := authorization_tools.LoadTOTPKey(); err != nil {
+		t.Fatal(err)
+	}
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/users", CreateUsers(db))
+	router.POST("/login", Login(db))
+	router.POST("/login/2fa", LoginSecondFactor(db))
+	router.POST("/2fa/enroll", EnrollTOTP(db))
+	router.POST("/2fa/confirm", ConfirmTOTP(db))
+
+	const password = "Quiet-harb0r-passphrase"
+	if code, body := doJSON(t, router, "POST", "/users", "", gin.H{
+		"username": "alice", "email": "alice@example.com", "password": password,
+	}); code != http.StatusOK && code != http.StatusCreated {
+		t.Fatalf("регистрация: %d %v", code, body)
+	}
+	code, body := doJSON(t, router, "POST", "/login", "", gin.H{"username": "alice", "password": password})
+	if code != http.StatusOK {
+		t.Fatalf("вход: %d %v", code, body)
+	}
+	accessToken, _ := body["accessToken"].(string)
+
+	code, body = doJSON(t, router, "POST", "/2fa/enroll", accessToken, nil)
+	if code != http.StatusOK {
+		t.Fatalf("настройка: %d %v", code, body)
+	}
+	secret, _ := body["secret"].(string)
+	current := totpAt(t, secret, time.Now())
+	code, body = doJSON(t, router, "POST", "/2fa/confirm", accessToken, gin.H{"code": current})
+	if code != http.StatusOK {
+		t.Fatalf("подтверждение: %d %v", code, body)
+	}
+	codes, _ := body["recovery_codes"].([]interface{})
+	if len(codes) == 0 {
+		t.Fatalf("нет кодов восстановления: %v", body)
+	}
+	recovery, _ := codes[0].(string)
+
+	secondFactor := func(factor gin.H) int {
+		t.Helper()
+		code, body := doJSON(t, router, "POST", "/login", "", gin.H{"username": "alice", "password": password})
+		challenge, _ := body["challengeToken"].(string)
+		if code != http.StatusOK || challenge == "" {
+			t.Fatalf("первый шаг входа: %d %v", code, body)
+		}
+		factor["challenge_token"] = challenge
+		code, _ = doJSON(t, router, "POST", "/login/2fa", "", factor)
+		return code
+	}
+
+	t.Run("код из приложения", func(t *testing.T) {
+		if code := secondFactor(gin.H{"code": current}); code != http.StatusUnauthorized {
+			t.Errorf("код, уже принятый при подтверждении: %d, ожидался 401", code)
+		}
+		next := totpAt(t, secret, time.Now().Add(30*time.Second))
+		if code := secondFactor(gin.H{"code": next}); code != http.StatusOK {
+			t.Fatalf("следующий код: %d", code)
+		}
+		if code := secondFactor(gin.H{"code": next}); code != http.StatusUnauthorized {
+			t.Errorf("повтор принятого кода: %d, ожидался 401", code)
+		}
+	})
+
+	t.Run("код восстановления", func(t *testing.T) {
+		if code := secondFactor(gin.H{"recovery_code": strings.ToUpper(recovery)}); code != http.StatusOK {
+			t.Fatalf("код восстановления: %d", code)
+		}
+		if code := secondFactor(gin.H{"recovery_code": recovery}); code != http.StatusUnauthorized {
+			t.Errorf("повтор кода восстановления: %d, ожидался 401", code)
+		}
+	})
+}
@@ -8,6 +8,7 @@ import (
 	"gorutines/models"
 	"log"
 	"net/http"
+	"strconv"
 )
 
 func GetUsers(db *sql.DB) gin.HandlerFunc {
@@ -44,24 +45,23 @@ func CreateUsers(db *sql.DB) gin.HandlerFunc {
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
-		salt, err := authorization_tools.GenerateSalt(32)
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		if validationFailed(c,
+			authorization_tools.ValidateUsername(user.Username),
+			authorization_tools.ValidateEmail(user.Email),
+			authorization_tools.ValidatePassword(user.Password, user.Username, user.Email),
+		) {
 			return
 		}
 
-		hashPassword, err := authorization_tools.HashPassword(user.Password, salt)
+		hashPassword, err := authorization_tools.HashPassword(user.Password)
 		if err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
 
-		_, err = db.Exec("INSERT INTO users (username, email, password, salt, role) VALUES (?, ?, ?, ?, ?)", user.Username, user.Email, hashPassword, salt, "user")
+		_, err = db.Exec("INSERT INTO users (username, email, password, role) VALUES (?, ?, ?, ?)", user.Username, user.Email, hashPassword, "user")
 		if err != nil {
-			if err.Error() == "UNIQUE constraint failed: users.email" {
-				c.JSON(http.StatusConflict, gin.H{
-					"error": "Пользователь с таким email уже существует",
-				})
+			if uniqueViolation(c, err) {
 				return
 			}
 			log.Println("Ошибка при вставке пользователя: ", err)
@@ -75,6 +75,7 @@ func CreateUsers(db *sql.DB) gin.HandlerFunc {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Не удалось получить ID пользователя"})
 			return
 		}
+		sendVerificationEmail(db, user.ID, user.Email)
 		c.JSON(http.StatusCreated, user.Username)
 	}
 }
@@ -82,8 +83,9 @@ func CreateUsers(db *sql.DB) gin.HandlerFunc {
 func Login(db *sql.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var credentials struct {
-			Username string `json:"username" binding:"required"`
-			Password string `json:"password" binding:"required"`
+			Username   string `json:"username" binding:"required"`
+			Password   string `json:"password" binding:"required"`
+			DeviceName string `json:"device_name"`
 		}
 
 		if err := c.ShouldBindJSON(&credentials); err != nil {
@@ -91,89 +93,172 @@ func Login(db *sql.DB) gin.HandlerFunc {
 			return
 		}
 
-		storedHash, storedSalt, err := authorization_tools.FindUsername(credentials.Username, db)
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		if !verifyCredentials(c, db, credentials.Username, credentials.Password) {
 			return
 		}
 
-		result, err := authorization_tools.VerifyPassword(credentials.Password, storedHash, storedSalt)
+		suspended, err := authorization_tools.IsSuspended(credentials.Username, db)
 		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
-		if !result {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Ошибка учетной записи"})
+		if suspended {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Учетная запись заблокирована"})
 			return
 		}
 
-		accessToken, err := authorization_tools.GenerateAccessToken(credentials.Username)
+		deletionAt, pending, err := authorization_tools.PendingDeletion(credentials.Username, db)
 		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if pending {
+			c.JSON(http.StatusForbidden, gin.H{
+				"error":                 "Учетная запись ожидает удаления, её можно восстановить через POST /me/restore",
+				"deletion_scheduled_at": deletionAt,
+			})
 			return
 		}
 
-		refreshToken, err := authorization_tools.GenerateRefreshToken(credentials.Username)
+		if requireEmailVerification {
+			verified, err := authorization_tools.IsEmailVerified(credentials.Username, db)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			if !verified {
+				c.JSON(http.StatusForbidden, gin.H{"error": "Почта не подтверждена"})
+				return
+			}
+		}
 
+		userID, err := authorization_tools.GetUserID(credentials.Username, db)
 		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
 
-		err = authorization_tools.SetRefreshTokenDB(credentials.Username, refreshToken, db)
+		// С включённым вторым фактором сессия выдаётся только после проверки кода в /login/2fa
+		totpEnabled, err := authorization_tools.IsTOTPEnabled(userID, db)
 		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if totpEnabled {
+			challenge, err := authorization_tools.GenerateLoginChallenge(userID, credentials.Username, credentials.DeviceName)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{
+				"username":       credentials.Username,
+				"mfaRequired":    true,
+				"challengeToken": challenge,
+			})
 			return
 		}
-		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
 
-		c.JSON(http.StatusOK, gin.H{
-			"username":     credentials.Username,
-			"accessToken":  accessToken,
-			"refreshToken": refreshToken,
-		})
+		startSession(c, db, userID, credentials.Username, credentials.DeviceName)
+	}
+}
+
+// startSession создаёт сессию (refresh токен) и отвечает парой токенов.
+// Вход завершён, поэтому счётчик неудачных попыток учётной записи сбрасывается.
+func startSession(c *gin.Context, db *sql.DB, userID int, username string, deviceName string) {
+	if err := authorization_tools.ResetLoginFailures(username, db); err != nil {
+		log.Println("Ошибка сброса счётчика попыток входа:", err)
+	}
+
+	refreshToken, err := authorization_tools.GenerateRefreshToken(userID, username)
+
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	sessionID, err := authorization_tools.SetRefreshTokenDB(username, refreshToken, sessionInfo(c, deviceName), db)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	accessToken, err := authorization_tools.GenerateAccessToken(userID, username, sessionID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
+	c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
+
+	c.JSON(http.StatusOK, gin.H{
+		"username":     username,
+		"accessToken":  accessToken,
+		"refreshToken": refreshToken,
+	})
 }
 
-func DeleteUser(db *sql.DB) gin.HandlerFunc {
+func RefreshToken(db *sql.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		var credentials struct {
-			Username string `json:"username" binding:"required"`
-			Password string `json:"password" binding:"required"`
-		}
-		if err := c.ShouldBindJSON(&credentials); err != nil {
+		token, err := authorization_tools.ExtractToken(c.GetHeader("Authorization"))
+		if err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
 
-		storedHash, storedSalt, err := authorization_tools.FindUsername(credentials.Username, db)
+		status, err := authorization_tools.ValidateRefreshToken(token, db)
 		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			handleRefreshTokenError(c, db, err)
+			return
+		}
+		if !status {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Ошибка проверки токена"})
 			return
 		}
 
-		result, err := authorization_tools.VerifyPassword(credentials.Password, storedHash, storedSalt)
+		claims, err := authorization_tools.GetClaims(token)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		userID, username, err := authorization_tools.UserFromClaims(claims, db)
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+
+		sessionID, err := authorization_tools.GetSessionID(token, db)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		accessToken, err := authorization_tools.GenerateAccessToken(userID, username, sessionID)
 		if err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
-		if !result {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Ошибка учетной записи"})
+
+		refreshToken, err := authorization_tools.GenerateRefreshToken(userID, username)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
 
-		err = authorization_tools.DeleteUser(credentials.Username, db)
+		err = authorization_tools.UpdateRefreshToken(token, refreshToken, sessionInfo(c, ""), db)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
 		c.JSON(http.StatusOK, gin.H{
-			"message": credentials.Username + " deleted",
+			"accessToken":  accessToken,
+			"refreshToken": refreshToken,
 		})
 	}
 }
 
-func RefreshToken(db *sql.DB) gin.HandlerFunc {
+// Logout завершает текущую сессию: отзывает refresh токен из заголовка Authorization
+// и закрывает WebSocket-соединения этой сессии
+func Logout(db *sql.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		token, err := authorization_tools.ExtractToken(c.GetHeader("Authorization"))
 		if err != nil {
@@ -183,7 +268,7 @@ func RefreshToken(db *sql.DB) gin.HandlerFunc {
 
 		status, err := authorization_tools.ValidateRefreshToken(token, db)
 		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			handleRefreshTokenError(c, db, err)
 			return
 		}
 		if !status {
@@ -197,30 +282,100 @@ func RefreshToken(db *sql.DB) gin.HandlerFunc {
 			return
 		}
 
-		accessToken, err := authorization_tools.GenerateAccessToken(claims["username"].(string))
+		_, username, err := authorization_tools.UserFromClaims(claims, db)
 		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
 			return
 		}
 
-		refreshToken, err := authorization_tools.GenerateRefreshToken(claims["username"].(string))
+		sessionID, err := authorization_tools.RevokeRefreshToken(token, db)
 		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
+		disconnectSession(username, sessionID)
+
+		c.JSON(http.StatusOK, gin.H{"message": "logged out"})
+	}
+}
 
-		err = authorization_tools.UpdateRefreshToken(token, refreshToken, db)
+// LogoutAll завершает все сессии пользователя на всех устройствах
+func LogoutAll(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		username, ok := currentUser(c, db)
+		if !ok {
+			return
+		}
+
+		revoked, err := authorization_tools.RevokeAllRefreshTokens(username, db)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
+		disconnectUser(username)
+
 		c.JSON(http.StatusOK, gin.H{
-			"accessToken":  accessToken,
-			"refreshToken": refreshToken,
+			"message":          "logged out from all devices",
+			"revoked_sessions": revoked,
 		})
 	}
 }
 
+// GetSessions — список активных сессий текущего пользователя
+func GetSessions(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, ok := currentSession(c, db)
+		if !ok {
+			return
+		}
+
+		sessions, err := authorization_tools.GetSessions(user.ID, db)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		type sessionView struct {
+			authorization_tools.Session
+			Current bool `json:"current"`
+		}
+		result := make([]sessionView, len(sessions))
+		for i, s := range sessions {
+			result[i] = sessionView{Session: s, Current: s.ID == user.SessionID}
+		}
+		c.JSON(http.StatusOK, result)
+	}
+}
+
+// DeleteSession завершает одну из сессий пользователя и закрывает её WebSocket-соединения
+func DeleteSession(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, ok := currentSession(c, db)
+		if !ok {
+			return
+		}
+
+		sessionID, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Неверный id сессии"})
+			return
+		}
+
+		found, err := authorization_tools.RevokeSession(user.ID, sessionID, db)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if !found {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Сессия не найдена"})
+			return
+		}
+		disconnectSession(user.Username, sessionID)
+
+		c.JSON(http.StatusOK, gin.H{"message": "session revoked"})
+	}
+}
+
 func CryptText() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var credentials struct {
@@ -0,0 +1,39 @@
+package handlers
+
+import (
+	"github.com/gin-gonic/gin"
+	"gorutines/authorization_tools"
+	"net/http"
+	"strings"
+)
+
+// validationFailed отвечает 400 со списком ошибок по полям, если хотя бы одна проверка не прошла:
+// {"error": "...", "fields": [{"field": "password", "code": "too_short", "message": "..."}]}
+func validationFailed(c *gin.Context, checks ...*authorization_tools.FieldError) bool {
+	var fields []authorization_tools.FieldError
+	for _, err := range checks {
+		if err != nil {
+			fields = append(fields, *err)
+		}
+	}
+	if len(fields) == 0 {
+		return false
+	}
+	c.JSON(http.StatusBadRequest, gin.H{"error": "Ошибка проверки данных", "fields": fields})
+	return true
+}
+
+// uniqueViolation отвечает 409 с указанием поля, если имя или почта уже заняты
+func uniqueViolation(c *gin.Context, err error) bool {
+	var field authorization_tools.FieldError
+	switch msg := err.Error(); {
+	case strings.Contains(msg, "UNIQUE constraint failed: users.username"):
+		field = authorization_tools.FieldError{Field: "username", Code: "taken", Message: "Имя пользователя уже занято"}
+	case strings.Contains(msg, "UNIQUE constraint failed: users.email"):
+		field = authorization_tools.FieldError{Field: "email", Code: "taken", Message: "Пользователь с таким email уже существует"}
+	default:
+		return false
+	}
+	c.JSON(http.StatusConflict, gin.H{"error": field.Message, "fields": []authorization_tools.FieldError{field}})
+	return true
+}
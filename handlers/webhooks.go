@@ -0,0 +1,225 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"gorutines/authorization_tools"
+	"gorutines/webhook_tools"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+const (
+	maxWebhooksPerOwner  = 10
+	deliveryLogPageLimit = 100
+)
+
+// MessageChangeEvent — данные вебхука об изменении или удалении сообщения
+type MessageChangeEvent struct {
+	Action     string `json:"action"`
+	MessageID  int    `json:"message_id"`
+	From       string `json:"from"`
+	To         string `json:"to"`
+	NewContent string `json:"new_content,omitempty"`
+}
+
+// notifyWebhooks ставит событие в очередь вебхуков участников переписки и общих вебхуков.
+// Ошибка очереди не должна мешать самому действию, поэтому только записывается в лог.
+func notifyWebhooks(db *sql.DB, event string, fromID, toID int, data interface{}) {
+	if err := webhook_tools.Enqueue(event, []int{fromID, toID}, data, db); err != nil {
+		log.Printf("Ошибка постановки события %s в очередь вебхуков: %v", event, err)
+	}
+}
+
+// messageParticipants возвращает id и имена отправителя и получателя сообщения
+func messageParticipants(db *sql.DB, messageID int) (fromID, toID int, from, to string, err error) {
+	err = db.QueryRow(`
+		SELECT m.from_user_id, m.to_user_id, fu.username, tu.username
+		FROM messages m
+		JOIN users fu ON fu.id = m.from_user_id
+		JOIN users tu ON tu.id = m.to_user_id
+		WHERE m.id = ?`, messageID).Scan(&fromID, &toID, &from, &to)
+	return
+}
+
+// CreateWebhook — регистрация вебхука (тело запроса: {"url": "...", "events": [...], "all_users": false}).
+// Вебхук получает события переписки владельца; all_users — события всех пользователей, только для администраторов.
+// Секрет для проверки подписи возвращается только в этом ответе.
+func CreateWebhook(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, ok := currentSession(c, db)
+		if !ok {
+			return
+		}
+
+		var request struct {
+			URL      string   `json:"url" binding:"required"`
+			Events   []string `json:"events"`
+			AllUsers bool     `json:"all_users"`
+		}
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err := webhook_tools.ValidateURL(request.URL); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		events, err := webhook_tools.ValidateEvents(request.Events)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		if request.AllUsers {
+			role, err := authorization_tools.GetUserRole(user.Username, db)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка базы данных"})
+				return
+			}
+			if role != "admin" {
+				c.JSON(http.StatusForbidden, gin.H{"error": "События всех пользователей доступны только администраторам"})
+				return
+			}
+		}
+
+		count, err := webhook_tools.CountWebhooks(user.ID, db)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка базы данных"})
+			return
+		}
+		if count >= maxWebhooksPerOwner {
+			c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Нельзя создать больше %d вебхуков", maxWebhooksPerOwner)})
+			return
+		}
+
+		webhook, secret, err := webhook_tools.CreateWebhook(user.ID, request.URL, events, request.AllUsers, db)
+		if err != nil {
+			log.Println("Ошибка при создании вебхука:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка базы данных"})
+			return
+		}
+		c.JSON(http.StatusCreated, gin.H{"webhook": webhook, "secret": secret})
+	}
+}
+
+// GetWebhooks — вебхуки текущего пользователя
+func GetWebhooks(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, ok := currentSession(c, db)
+		if !ok {
+			return
+		}
+
+		webhooks, err := webhook_tools.ListWebhooks(user.ID, db)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка базы данных"})
+			return
+		}
+		c.JSON(http.StatusOK, webhooks)
+	}
+}
+
+// DeleteWebhook удаляет вебхук вместе с его очередью доставок
+func DeleteWebhook(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, ok := currentSession(c, db)
+		if !ok {
+			return
+		}
+
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Неверный id вебхука"})
+			return
+		}
+		found, err := webhook_tools.DeleteWebhook(user.ID, id, db)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка базы данных"})
+			return
+		}
+		if !found {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Вебхук не найден"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "webhook deleted"})
+	}
+}
+
+// GetWebhookDeliveries — журнал доставок вебхука, новые первыми.
+// ?status=dead — только недоставленные после всех попыток.
+func GetWebhookDeliveries(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		webhookID, ok := ownedWebhook(c, db)
+		if !ok {
+			return
+		}
+
+		status := c.Query("status")
+		switch status {
+		case "", webhook_tools.StatusPending, webhook_tools.StatusDelivered, webhook_tools.StatusDead:
+		default:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Неверный статус доставки"})
+			return
+		}
+
+		deliveries, err := webhook_tools.ListDeliveries(webhookID, status, deliveryLogPageLimit, db)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка базы данных"})
+			return
+		}
+		c.JSON(http.StatusOK, deliveries)
+	}
+}
+
+// RetryWebhookDelivery возвращает недоставленное событие в очередь
+func RetryWebhookDelivery(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		webhookID, ok := ownedWebhook(c, db)
+		if !ok {
+			return
+		}
+
+		deliveryID, err := strconv.Atoi(c.Param("delivery_id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Неверный id доставки"})
+			return
+		}
+		found, err := webhook_tools.RetryDelivery(webhookID, deliveryID, db)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка базы данных"})
+			return
+		}
+		if !found {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Недоставленное событие не найдено"})
+			return
+		}
+		c.JSON(http.StatusAccepted, gin.H{"message": "delivery queued"})
+	}
+}
+
+// ownedWebhook проверяет, что вебхук из параметра :id принадлежит текущему пользователю
+func ownedWebhook(c *gin.Context, db *sql.DB) (int, bool) {
+	user, ok := currentSession(c, db)
+	if !ok {
+		return 0, false
+	}
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Неверный id вебхука"})
+		return 0, false
+	}
+	owns, err := webhook_tools.OwnsWebhook(user.ID, id, db)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка базы данных"})
+		return 0, false
+	}
+	if !owns {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Вебхук не найден"})
+		return 0, false
+	}
+	return id, true
+}
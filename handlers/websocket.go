@@ -3,13 +3,15 @@ package handlers
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
 	"gorutines/authorization_tools"
+	"gorutines/webhook_tools"
 	"log"
 	"net/http"
-	"sync"
+	"strings"
 	"time"
 )
 
@@ -20,11 +22,14 @@ type Message struct {
 	To        string    `json:"to"`         // получатель
 	Content   string    `json:"content"`    // текст сообщения
 	CreatedAt time.Time `json:"created_at"` // время создания
-}
 
-// clients хранит активные WebSocket-соединения: ключ — идентификатор пользователя
-var clients = make(map[string]*websocket.Conn)
-var clientsMu sync.RWMutex
+	FromID  int  `json:"-"` // id отправителя и получателя, по ним сообщение хранится в базе
+	ToID    int  `json:"-"`
+	FromBot bool `json:"-"` // отправитель — бот
+
+	AttachmentIDs []int        `json:"attachment_ids,omitempty"` // загруженные заранее вложения
+	Attachments   []Attachment `json:"attachments,omitempty"`
+}
 
 // upgrader для перехода от HTTP к WebSocket
 var upgrader = websocket.Upgrader{
@@ -33,30 +38,45 @@ var upgrader = websocket.Upgrader{
 	},
 }
 
-func ExtractUsername(tokenString string) (string, error) {
-	claims, err := authorization_tools.GetClaims(tokenString)
-	if err != nil {
-		return "", fmt.Errorf("не удалось получить claims из токена: %v", err)
-	}
-
-	username, ok := claims["username"].(string)
-	if !ok || username == "" {
-		return "", fmt.Errorf("токен не содержит username")
-	}
-
-	return username, nil
-}
-
 // WebSocketHandler обрабатывает установление WebSocket-соединения и получение сообщений
 // db передаётся для сохранения сообщений в базу
 func WebSocketHandler(c *gin.Context, db *sql.DB) {
+	// Браузер не может задать заголовки при открытии WebSocket, поэтому access токен передаётся в ?token=.
+	// API-ключ бессрочный, а адрес запроса попадает в журналы, поэтому ключ принимается только из заголовка.
 	tokenString := c.Query("token")
+	if c.GetHeader("Authorization") != "" {
+		var err error
+		tokenString, err = authorization_tools.ExtractToken(c.GetHeader("Authorization"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	} else if authorization_tools.IsAPIKey(tokenString) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "API-ключ передаётся только в заголовке Authorization"})
+		return
+	}
 
-	username, err := ExtractUsername(tokenString)
+	user, err := authenticateToken(tokenString, db)
+	if errors.Is(err, authorization_tools.ErrAPIKeyDisabled) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Учетная запись заблокирована"})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Неверный токен"})
 		return
 	}
+	username := user.Username
+
+	suspended, err := authorization_tools.IsSuspended(username, db)
+	if err != nil || suspended {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Учетная запись заблокирована"})
+		return
+	}
+	// Соединение — это поток входящих сообщений, поэтому боту нужно право на их чтение
+	if !user.can(authorization_tools.ScopeMessagesRead) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "API-ключу не разрешено: " + authorization_tools.ScopeMessagesRead})
+		return
+	}
 
 	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
 	if err != nil {
@@ -65,18 +85,24 @@ func WebSocketHandler(c *gin.Context, db *sql.DB) {
 	}
 	fmt.Printf("Пользователь %s подключился\n", username)
 
-	clientsMu.Lock()
-	clients[username] = conn
-	clientsMu.Unlock()
+	cl := &client{userID: user.ID, username: username, sessionID: user.SessionID,
+		apiKeyID: user.KeyID, scopes: user.Scopes, conn: conn}
+	firstConnection := len(userClients(username)) == 0
+	addClient(cl)
+	if firstConnection {
+		go notifyPresence(db, username, true, cl.isBot())
+	}
 
 	for {
 		_, msgBytes, err := conn.ReadMessage()
+		// Имя могло измениться через PATCH /me, пока соединение открыто
+		username = cl.name()
 		if err != nil {
 			fmt.Printf("Ошибка чтения сообщения от %s: %v\n", username, err)
-			conn.Close()
-			clientsMu.Lock()
-			delete(clients, username)
-			clientsMu.Unlock()
+			removeClient(cl)
+			if len(userClients(username)) == 0 {
+				go notifyPresence(db, username, false, cl.isBot())
+			}
 			break
 		}
 
@@ -92,6 +118,14 @@ func WebSocketHandler(c *gin.Context, db *sql.DB) {
 			continue
 		}
 
+		switch action {
+		case "send_message", "edit_message", "delete_message", "command_reply":
+			if !cl.can(authorization_tools.ScopeMessagesWrite) {
+				sendError(cl, "API-ключу не разрешено: "+authorization_tools.ScopeMessagesWrite)
+				continue
+			}
+		}
+
 		switch action {
 		case "send_message":
 			var msg Message
@@ -101,16 +135,81 @@ func WebSocketHandler(c *gin.Context, db *sql.DB) {
 			}
 
 			msg.From = username
+			msg.FromID = cl.userID
+			msg.FromBot = cl.isBot()
 			msg.CreatedAt = time.Now()
 
+			msg.ToID, err = authorization_tools.GetUserID(msg.To, db)
+			if err != nil {
+				sendError(cl, "Пользователь "+msg.To+" не найден")
+				continue
+			}
+
+			// Слэш-команда может заменить текст сообщения или выполниться без отправки
+			if strings.HasPrefix(msg.Content, "/") && !runCommand(db, cl, &msg) {
+				continue
+			}
+
+			if msg.Content == "" && len(msg.AttachmentIDs) == 0 {
+				fmt.Printf("Пустое сообщение от %s\n", username)
+				continue
+			}
+			if err := checkAttachments(db, username, msg.AttachmentIDs); err != nil {
+				fmt.Printf("Ошибка вложений в сообщении от %s: %v\n", username, err)
+				continue
+			}
+
+			blocked, err := isBlocked(db, username, msg.To)
+			if err != nil {
+				fmt.Printf("Ошибка проверки блокировки: %v\n", err)
+				continue
+			}
+			if blocked {
+				sendError(cl, "Нельзя отправить сообщение: пользователь заблокирован")
+				continue
+			}
+
 			// Сохраняем сообщение в БД и обновляем msg.ID
-			_, err := SaveMessageToDB(db, &msg)
+			_, err = SaveMessageToDB(db, &msg)
 			if err != nil {
 				fmt.Printf("Ошибка сохранения сообщения в БД: %v\n", err)
 				continue
 			}
+
+			if len(msg.AttachmentIDs) > 0 {
+				if err := linkAttachments(db, msg.ID, username, msg.AttachmentIDs); err != nil {
+					fmt.Printf("Ошибка привязки вложений к сообщению %d: %v\n", msg.ID, err)
+				}
+				attachments, err := loadAttachments(db, []int{msg.ID})
+				if err != nil {
+					fmt.Printf("Ошибка загрузки вложений сообщения %d: %v\n", msg.ID, err)
+				}
+				msg.Attachments = attachments[msg.ID]
+			}
 			fmt.Printf("Получено сообщение от %s для %s: %s (ID: %d)\n", msg.From, msg.To, msg.Content, msg.ID)
-			go sendPrivateMessage(msg)
+			go sendPrivateMessage(db, msg)
+			notifyWebhooks(db, webhook_tools.EventSendMessage, msg.FromID, msg.ToID, newSendMessageEvent(msg))
+
+			// Отправленное сообщение больше не черновик
+			if err := ClearDraft(db, username, msg.To); err != nil {
+				fmt.Printf("Ошибка удаления черновика: %v\n", err)
+			} else {
+				syncDraft(cl, msg.To, "")
+			}
+
+		case "command_reply":
+			var reply struct {
+				CommandID string `json:"command_id"`
+				Text      string `json:"text"`
+			}
+			if err := json.Unmarshal(msgBytes, &reply); err != nil || reply.Text == "" {
+				sendError(cl, "Нужны command_id и text")
+				continue
+			}
+			if err := replyToBotCommand(cl, reply.CommandID, reply.Text); err != nil {
+				sendError(cl, err.Error())
+				continue
+			}
 
 		case "delete_message":
 			messageIDFloat, ok := event["message_id"].(float64)
@@ -120,7 +219,7 @@ func WebSocketHandler(c *gin.Context, db *sql.DB) {
 			}
 			messageID := int(messageIDFloat)
 
-			if err := DeleteMessage(db, messageID, username); err != nil {
+			if err := DeleteMessage(db, messageID, cl.userID); err != nil {
 				fmt.Println(err)
 				continue
 			}
@@ -138,11 +237,37 @@ func WebSocketHandler(c *gin.Context, db *sql.DB) {
 				continue
 			}
 
-			if err := EditMessage(db, messageID, username, newContent); err != nil {
+			if err := EditMessage(db, messageID, cl.userID, newContent); err != nil {
 				fmt.Println("Ошибка редактирования сообщения:", err)
 				continue
 			}
 
+		case "typing":
+			to, ok := event["to"].(string)
+			if !ok || to == "" {
+				fmt.Println("Неверный формат to")
+				continue
+			}
+			notifyTyping(db, username, to)
+
+		case "save_draft", "clear_draft":
+			peer, ok := event["to"].(string)
+			if !ok || peer == "" {
+				fmt.Println("Неверный формат to")
+				continue
+			}
+
+			content := ""
+			if action == "save_draft" {
+				content, _ = event["content"].(string)
+			}
+
+			if err := SaveDraft(db, username, peer, content); err != nil {
+				fmt.Println("Ошибка сохранения черновика:", err)
+				continue
+			}
+			syncDraft(cl, peer, content)
+
 		default:
 			fmt.Printf("Неизвестный action: %s\n", action)
 		}
@@ -151,8 +276,8 @@ func WebSocketHandler(c *gin.Context, db *sql.DB) {
 
 // SaveMessageToDB сохраняет сообщение в базу через database/sql
 func SaveMessageToDB(db *sql.DB, msg *Message) (int, error) {
-	query := `INSERT INTO messages (from_user, to_user, content, created_at) VALUES (?, ?, ?, ?)`
-	res, err := db.Exec(query, msg.From, msg.To, msg.Content, msg.CreatedAt)
+	query := `INSERT INTO messages (from_user_id, to_user_id, content, created_at) VALUES (?, ?, ?, ?)`
+	res, err := db.Exec(query, msg.FromID, msg.ToID, msg.Content, msg.CreatedAt)
 	if err != nil {
 		return 0, err
 	}
@@ -172,56 +297,54 @@ type SendMessageEvent struct {
 	To        string `json:"to"`
 	Content   string `json:"content"`
 	Created   string `json:"created"`
+	FromBot   bool   `json:"from_bot,omitempty"`
+	Muted     bool   `json:"muted,omitempty"` // получатель отключил уведомления командой /mute
+
+	Attachments []Attachment `json:"attachments,omitempty"`
 }
 
-func sendPrivateMessage(msg Message) {
-	event := SendMessageEvent{
+func newSendMessageEvent(msg Message) SendMessageEvent {
+	return SendMessageEvent{
 		Action:    "send_message",
 		MessageID: msg.ID,
 		From:      msg.From,
 		To:        msg.To,
 		Content:   msg.Content,
 		Created:   msg.CreatedAt.Format(time.RFC3339),
+		FromBot:   msg.FromBot,
+
+		Attachments: msg.Attachments,
 	}
+}
 
+func sendPrivateMessage(db *sql.DB, msg Message) {
+	event := newSendMessageEvent(msg)
 	msgBytes, err := json.Marshal(event)
 	if err != nil {
 		fmt.Printf("Ошибка маршалинга события: %v\n", err)
 		return
 	}
 
-	clientsMu.RLock()
-	recipientConn, recipientExists := clients[msg.To]
-	senderConn, senderExists := clients[msg.From]
-	clientsMu.RUnlock()
-
-	// Отправка получателю
-	if recipientExists {
-		if err := recipientConn.WriteMessage(websocket.TextMessage, msgBytes); err != nil {
-			fmt.Printf("Ошибка отправки получателю %s: %v\n", msg.To, err)
-			recipientConn.Close()
-			clientsMu.Lock()
-			if clients[msg.To] == recipientConn { // Проверяем, не изменился ли клиент
-				delete(clients, msg.To)
-			}
-			clientsMu.Unlock()
-		}
-	} else {
+	// Отправка получателю и всем устройствам отправителя (чтобы он сразу видел своё сообщение)
+	if len(userClients(msg.To)) == 0 {
 		fmt.Printf("Пользователь %s не найден или не подключён\n", msg.To)
 	}
+	if msg.From != msg.To {
+		sendToUser(msg.From, msgBytes, nil)
 
-	// Отправка отправителю (чтобы он сразу видел своё сообщение)
-	if senderExists {
-		if err := senderConn.WriteMessage(websocket.TextMessage, msgBytes); err != nil {
-			fmt.Printf("Ошибка отправки отправителю %s: %v\n", msg.From, err)
-			senderConn.Close()
-			clientsMu.Lock()
-			if clients[msg.From] == senderConn { // Проверяем, не изменился ли клиент
-				delete(clients, msg.From)
+		muted, err := isMuted(db, msg.ToID, msg.FromID)
+		if err != nil {
+			fmt.Printf("Ошибка проверки отключённых уведомлений: %v\n", err)
+		}
+		if muted {
+			event.Muted = true
+			if msgBytes, err = json.Marshal(event); err != nil {
+				fmt.Printf("Ошибка маршалинга события: %v\n", err)
+				return
 			}
-			clientsMu.Unlock()
 		}
 	}
+	sendToUser(msg.To, msgBytes, nil)
 }
 
 type DeleteMessageEvent struct {
@@ -231,9 +354,6 @@ type DeleteMessageEvent struct {
 
 // SendDeleteMessageNotification — отправляет всем WebSocket-клиентам уведомление об удалении сообщения
 func SendDeleteMessageNotification(messageID int) {
-	clientsMu.RLock()
-	defer clientsMu.RUnlock()
-
 	event := DeleteMessageEvent{
 		Action:    "delete_message",
 		MessageID: messageID,
@@ -246,21 +366,11 @@ func SendDeleteMessageNotification(messageID int) {
 	}
 
 	// Отправляем сообщение всем активным клиентам
-	for username, conn := range clients {
-		err := conn.WriteMessage(websocket.TextMessage, data)
-		if err != nil {
-			log.Printf("Ошибка отправки удаления пользователю %s: %v", username, err)
-			conn.Close()
-			delete(clients, username)
-		}
-	}
+	sendToClients(allClients(), data)
 }
 
 // SendEditMessageNotification — отправляет клиентам уведомление об изменении сообщения
 func SendEditMessageNotification(messageID int, newContent string) {
-	clientsMu.RLock()
-	defer clientsMu.RUnlock()
-
 	event := map[string]interface{}{
 		"action":      "edit_message",
 		"message_id":  messageID,
@@ -273,12 +383,5 @@ func SendEditMessageNotification(messageID int, newContent string) {
 		return
 	}
 
-	for username, conn := range clients {
-		err := conn.WriteMessage(websocket.TextMessage, data)
-		if err != nil {
-			log.Printf("Ошибка отправки редактирования пользователю %s: %v", username, err)
-			conn.Close()
-			delete(clients, username)
-		}
-	}
+	sendToClients(allClients(), data)
 }
@@ -0,0 +1,105 @@
+package mail_tools
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Mailer — отправка писем пользователям (подтверждение почты, сброс пароля и т.п.)
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+// SMTPMailer отправляет письма через SMTP сервер
+type SMTPMailer struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+func NewSMTPMailer(host, port, username, password, from string) *SMTPMailer {
+	m := &SMTPMailer{addr: net.JoinHostPort(host, port), from: from}
+	if username != "" {
+		m.auth = smtp.PlainAuth("", username, password, host)
+	}
+	return m
+}
+
+func (m *SMTPMailer) Send(to, subject, body string) error {
+	if strings.ContainsAny(to, "\r\n") || strings.ContainsAny(subject, "\r\n") {
+		return fmt.Errorf("недопустимые символы в заголовках письма")
+	}
+	msg := "From: " + m.from + "\r\n" +
+		"To: " + to + "\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"Date: " + time.Now().Format(time.RFC1123Z) + "\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=UTF-8\r\n" +
+		"\r\n" + body
+	return smtp.SendMail(m.addr, m.auth, m.from, []string{to}, []byte(msg))
+}
+
+// FileMailer дописывает письма в файл вместо отправки, а без файла пишет их в лог.
+// Используется при разработке и в тестах.
+type FileMailer struct {
+	path string
+	mu   sync.Mutex
+}
+
+func NewFileMailer(path string) *FileMailer {
+	return &FileMailer{path: path}
+}
+
+func (m *FileMailer) Send(to, subject, body string) error {
+	msg := fmt.Sprintf("To: %s\nSubject: %s\nDate: %s\n\n%s\n\n", to, subject, time.Now().Format(time.RFC3339), body)
+	if m.path == "" {
+		log.Print("Письмо (не отправлено):\n", msg)
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, err := os.OpenFile(m.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(msg); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// NewMailerFromEnv выбирает реализацию по переменной MAILER:
+// smtp (SMTP_HOST, SMTP_PORT, SMTP_USERNAME, SMTP_PASSWORD, SMTP_FROM),
+// file (MAIL_FILE) или log — по умолчанию.
+func NewMailerFromEnv() (Mailer, error) {
+	switch kind := os.Getenv("MAILER"); kind {
+	case "", "log":
+		return NewFileMailer(""), nil
+	case "file":
+		path := os.Getenv("MAIL_FILE")
+		if path == "" {
+			return nil, fmt.Errorf("MAILER=file требует MAIL_FILE")
+		}
+		return NewFileMailer(path), nil
+	case "smtp":
+		host, from := os.Getenv("SMTP_HOST"), os.Getenv("SMTP_FROM")
+		if host == "" || from == "" {
+			return nil, fmt.Errorf("MAILER=smtp требует SMTP_HOST и SMTP_FROM")
+		}
+		port := os.Getenv("SMTP_PORT")
+		if port == "" {
+			port = "587"
+		}
+		return NewSMTPMailer(host, port, os.Getenv("SMTP_USERNAME"), os.Getenv("SMTP_PASSWORD"), from), nil
+	default:
+		return nil, fmt.Errorf("неизвестный MAILER: %s", kind)
+	}
+}
@@ -2,16 +2,155 @@ package main
 
 import (
 	"github.com/gin-gonic/gin"
+	"github.com/go-co-op/gocron"
+	"github.com/joho/godotenv"
+	"gorutines/authorization_tools"
+	"gorutines/handlers"
+	"gorutines/mail_tools"
 	"gorutines/models"
 	"gorutines/routes"
+	"gorutines/storage_tools"
+	"gorutines/webhook_tools"
 	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 func main() {
+	// .env не обязателен: переменные окружения могут быть заданы и без него
+	if err := godotenv.Load(); err != nil && !os.IsNotExist(err) {
+		log.Fatal("Ошибка при загрузке .env файла: ", err)
+	}
+	if err := authorization_tools.LoadKeyring(); err != nil {
+		log.Fatal(err)
+	}
+	if err := authorization_tools.LoadPasswordParams(); err != nil {
+		log.Fatal(err)
+	}
+	if err := authorization_tools.LoadValidationPolicy(); err != nil {
+		log.Fatal(err)
+	}
+	if err := authorization_tools.LoadTOTPKey(); err != nil {
+		log.Fatal(err)
+	}
+
 	db := models.InitDB()
 	defer db.Close()
 
+	storage, err := storage_tools.NewLocalStorage("./uploads")
+	if err != nil {
+		log.Fatal("Не удалось подготовить хранилище вложений: ", err)
+	}
+	handlers.SetAttachmentStorage(storage)
+	if err := handlers.ResumeDataExports(db); err != nil {
+		log.Fatal("Не удалось возобновить выгрузки данных: ", err)
+	}
+
+	mailer, err := mail_tools.NewMailerFromEnv()
+	if err != nil {
+		log.Fatal("Не удалось настроить отправку почты: ", err)
+	}
+	handlers.SetMailer(mailer, os.Getenv("PUBLIC_BASE_URL"))
+	handlers.SetRequireEmailVerification(os.Getenv("REQUIRE_EMAIL_VERIFICATION") == "true")
+
+	graceDays := 7
+	if raw := os.Getenv("ACCOUNT_DELETION_GRACE_DAYS"); raw != "" {
+		graceDays, err = strconv.Atoi(raw)
+		if err != nil || graceDays < 0 {
+			log.Fatal("ACCOUNT_DELETION_GRACE_DAYS должен быть неотрицательным числом")
+		}
+	}
+	mode := os.Getenv("ACCOUNT_DELETION_MODE")
+	if mode != "" && mode != "anonymize" && mode != "delete" {
+		log.Fatal("ACCOUNT_DELETION_MODE должен быть anonymize или delete")
+	}
+	handlers.SetAccountDeletionPolicy(time.Duration(graceDays)*24*time.Hour, mode != "delete")
+
+	webhook_tools.SetAllowPrivateNetworks(os.Getenv("WEBHOOK_ALLOW_PRIVATE_NETWORKS") == "true")
+	stopWebhooks := webhook_tools.StartDispatcher(db)
+	defer stopWebhooks()
+
+	if err := handlers.RegisterBuiltinCommands(); err != nil {
+		log.Fatal("Не удалось зарегистрировать команды: ", err)
+	}
+
+	scheduler := gocron.NewScheduler(time.Local)
+	_, err = scheduler.Every(1).Hour().Do(func() {
+		sessions, history, err := authorization_tools.CleanupExpiredTokens(db)
+		if err != nil {
+			log.Println("Ошибка очистки истёкших токенов:", err)
+			return
+		}
+		log.Printf("Очистка токенов: удалено сессий %d, записей истории %d", sessions, history)
+
+		limits, err := authorization_tools.CleanupRequestLimits(db)
+		if err != nil {
+			log.Println("Ошибка очистки счётчиков запросов:", err)
+			return
+		}
+		log.Printf("Очистка счётчиков запросов: удалено %d", limits)
+
+		attempts, err := authorization_tools.CleanupLoginAttempts(db)
+		if err != nil {
+			log.Println("Ошибка очистки счётчиков попыток входа:", err)
+			return
+		}
+		log.Printf("Очистка счётчиков попыток входа: удалено %d", attempts)
+
+		exports, err := handlers.CleanupDataExports(db)
+		if err != nil {
+			log.Println("Ошибка очистки выгрузок данных:", err)
+			return
+		}
+		log.Printf("Очистка выгрузок данных: удалено %d", exports)
+
+		deliveries, err := webhook_tools.CleanupDeliveries(1000, db)
+		if err != nil {
+			log.Println("Ошибка очистки журнала вебхуков:", err)
+			return
+		}
+		log.Printf("Очистка журнала вебхуков: удалено %d", deliveries)
+	})
+	if err != nil {
+		log.Fatal("Не удалось запланировать очистку токенов: ", err)
+	}
+	_, err = scheduler.Every(1).Hour().Do(func() {
+		purged, err := handlers.PurgeDeletedAccounts(db)
+		if err != nil {
+			log.Println("Ошибка удаления учетных записей:", err)
+		}
+		if purged > 0 {
+			log.Printf("Удалено учетных записей: %d", purged)
+		}
+	})
+	if err != nil {
+		log.Fatal("Не удалось запланировать удаление учетных записей: ", err)
+	}
+	_, err = scheduler.Every(30).Seconds().Do(func() {
+		if _, err := handlers.DeliverDueReminders(db); err != nil {
+			log.Println("Ошибка доставки напоминаний:", err)
+		}
+	})
+	if err != nil {
+		log.Fatal("Не удалось запланировать напоминания: ", err)
+	}
+	scheduler.StartAsync()
+	defer scheduler.Stop()
+
 	router := gin.Default()
+	// Без списка доверенных прокси X-Forwarded-For задаёт сам клиент, и ограничение попыток входа
+	// по адресу легко обойти. За балансировщиком нужно указать его адреса в TRUSTED_PROXIES.
+	var trustedProxies []string
+	if raw := os.Getenv("TRUSTED_PROXIES"); raw != "" {
+		for _, proxy := range strings.Split(raw, ",") {
+			trustedProxies = append(trustedProxies, strings.TrimSpace(proxy))
+		}
+	}
+	if err := router.SetTrustedProxies(trustedProxies); err != nil {
+		log.Fatal("Неверный список TRUSTED_PROXIES: ", err)
+	}
 	router.Use(routes.CORSMiddleware())
 	routes.RegisterRoutes(router, db)
 
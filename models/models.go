@@ -2,8 +2,10 @@ package models
 
 import (
 	"database/sql"
+	"gorutines/authorization_tools"
 	"log"
 	_ "modernc.org/sqlite" // Пакет драйвера
+	"time"
 )
 
 type Users struct {
@@ -21,7 +23,9 @@ type RefreshToken struct {
 }
 
 func InitDB() *sql.DB {
-	db, err := sql.Open("sqlite", "./project.db")
+	// Прагмы SQLite действуют на одно соединение, поэтому задаются в DSN. busy_timeout нужен
+	// фоновым задачам: без него запись, совпавшая с запросом обработчика, сразу падает с SQLITE_BUSY.
+	db, err := sql.Open("sqlite", "./project.db?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)")
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -32,7 +36,6 @@ func InitDB() *sql.DB {
 	    username TEXT NOT NULL UNIQUE,
 	    email TEXT NOT NULL UNIQUE,
 	    password TEXT NOT NULL,
-	    salt TEXT NOT NULL,
 	    role TEXT NOT NULL
 	)
 	`
@@ -41,6 +44,16 @@ func InitDB() *sql.DB {
 		log.Fatal(err)
 	}
 
+	// Имя и почта уникальны без учёта регистра: Alice и alice — один пользователь.
+	// Столбцы остаются с обычным сравнением, поэтому хватает индексов поверх них.
+	// Если в старой базе уже есть такие совпадения, индекс не создаётся до их разбора.
+	for _, column := range []string{"username", "email"} {
+		_, err = db.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS idx_users_` + column + `_nocase ON users(` + column + ` COLLATE NOCASE)`)
+		if err != nil {
+			log.Printf("Не удалось сделать users.%s уникальным без учёта регистра: %v", column, err)
+		}
+	}
+
 	refreshTokenTable := `
 	CREATE TABLE IF NOT EXISTS refresh_tokens (
 	    id INTEGER PRIMARY KEY AUTOINCREMENT,
@@ -56,11 +69,55 @@ func InitDB() *sql.DB {
 		log.Fatal(err)
 	}
 
+	// Сведения об устройстве сессии, добавлены после первого релиза
+	addColumnIfMissing(db, "refresh_tokens", "device_name", "TEXT")
+	addColumnIfMissing(db, "refresh_tokens", "user_agent", "TEXT")
+	addColumnIfMissing(db, "refresh_tokens", "ip", "TEXT")
+	addColumnIfMissing(db, "refresh_tokens", "last_used_at", "TIMESTAMP")
+
+	// Уже использованные (ротированные) refresh токены. Семья токенов — это сессия,
+	// то есть запись refresh_tokens: при ротации токен в ней заменяется новым,
+	// а старый попадает сюда. Предъявление токена из истории означает его кражу.
+	refreshTokenHistoryTable := `
+	CREATE TABLE IF NOT EXISTS refresh_token_history (
+	    token_hash TEXT PRIMARY KEY,
+	    family_id INTEGER NOT NULL,
+	    user_id INTEGER NOT NULL,
+	    rotated_at TIMESTAMP NOT NULL,
+	    expires_at TIMESTAMP NOT NULL
+	)
+	`
+	_, err = db.Exec(refreshTokenHistoryTable)
+	if err != nil {
+		log.Fatal(err)
+	}
+	migrateExpiryToUnix(db, "refresh_tokens", "id")
+	migrateExpiryToUnix(db, "refresh_token_history", "token_hash")
+
+	authEventsTable := `
+	CREATE TABLE IF NOT EXISTS auth_events (
+	    id INTEGER PRIMARY KEY AUTOINCREMENT,
+	    username TEXT NOT NULL,
+	    event TEXT NOT NULL,
+	    ip TEXT,
+	    details TEXT,
+	    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	)
+	`
+	_, err = db.Exec(authEventsTable)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Профиль пользователя, добавлен после первого релиза
+	addColumnIfMissing(db, "users", "display_name", "TEXT")
+	addColumnIfMissing(db, "users", "avatar_url", "TEXT")
+
 	createTableQuery := `
 	CREATE TABLE IF NOT EXISTS messages (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		from_user TEXT,
-		to_user TEXT,
+		from_user_id INTEGER REFERENCES users(id),
+		to_user_id INTEGER REFERENCES users(id),
 		content TEXT,
 		created_at DATETIME
 	);
@@ -68,6 +125,515 @@ func InitDB() *sql.DB {
 	if _, err := db.Exec(createTableQuery); err != nil {
 		log.Fatal("Ошибка создания таблицы:", err)
 	}
+	migrateMessagesToUserIDs(db)
+
+	messagesIndex := `
+	CREATE INDEX IF NOT EXISTS idx_messages_from_to ON messages(from_user_id, to_user_id);
+	CREATE INDEX IF NOT EXISTS idx_messages_to ON messages(to_user_id);
+	`
+	if _, err := db.Exec(messagesIndex); err != nil {
+		log.Fatal("Ошибка создания индексов сообщений:", err)
+	}
+
+	attachmentsTable := `
+	CREATE TABLE IF NOT EXISTS attachments (
+	    id INTEGER PRIMARY KEY AUTOINCREMENT,
+	    message_id INTEGER,
+	    uploader TEXT NOT NULL,
+	    storage_key TEXT NOT NULL UNIQUE,
+	    thumbnail_key TEXT,
+	    filename TEXT NOT NULL,
+	    mime_type TEXT NOT NULL,
+	    size INTEGER NOT NULL,
+	    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	    FOREIGN KEY (message_id) REFERENCES messages(id) ON DELETE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS idx_attachments_message ON attachments(message_id);
+	`
+	if _, err := db.Exec(attachmentsTable); err != nil {
+		log.Fatal("Ошибка создания таблицы вложений:", err)
+	}
+
+	draftsTable := `
+	CREATE TABLE IF NOT EXISTS drafts (
+	    username TEXT NOT NULL,
+	    peer TEXT NOT NULL,
+	    content TEXT NOT NULL,
+	    updated_at TIMESTAMP NOT NULL,
+	    PRIMARY KEY (username, peer)
+	)
+	`
+	if _, err := db.Exec(draftsTable); err != nil {
+		log.Fatal("Ошибка создания таблицы черновиков:", err)
+	}
+
+	blocksTable := `
+	CREATE TABLE IF NOT EXISTS blocks (
+	    blocker TEXT NOT NULL,
+	    blocked TEXT NOT NULL,
+	    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	    PRIMARY KEY (blocker, blocked)
+	)
+	`
+	if _, err := db.Exec(blocksTable); err != nil {
+		log.Fatal("Ошибка создания таблицы блокировок:", err)
+	}
+
+	// Колонка добавлена после первого релиза, поэтому для старых баз её нужно досоздать
+	addColumnIfMissing(db, "users", "suspended_at", "TIMESTAMP")
+
+	reportsTable := `
+	CREATE TABLE IF NOT EXISTS reports (
+	    id INTEGER PRIMARY KEY AUTOINCREMENT,
+	    message_id INTEGER NOT NULL,
+	    reporter TEXT NOT NULL,
+	    reason TEXT NOT NULL,
+	    message_from TEXT NOT NULL,
+	    message_to TEXT NOT NULL,
+	    message_content TEXT NOT NULL,
+	    message_created_at TIMESTAMP,
+	    status TEXT NOT NULL DEFAULT 'open',
+	    resolved_by TEXT,
+	    resolved_at TIMESTAMP,
+	    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	    UNIQUE (message_id, reporter)
+	);
+	CREATE INDEX IF NOT EXISTS idx_reports_status ON reports(status);
+
+	CREATE TABLE IF NOT EXISTS moderation_log (
+	    id INTEGER PRIMARY KEY AUTOINCREMENT,
+	    report_id INTEGER,
+	    moderator TEXT NOT NULL,
+	    action TEXT NOT NULL,
+	    target_user TEXT,
+	    message_id INTEGER,
+	    note TEXT,
+	    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	`
+	if _, err := db.Exec(reportsTable); err != nil {
+		log.Fatal("Ошибка создания таблиц модерации:", err)
+	}
+	addColumnIfMissing(db, "reports", "message_from_id", "INTEGER")
+
+	// Пользователи, зарегистрированные до появления подтверждения почты, считаются подтверждёнными
+	if !columnExists(db, "users", "email_verified_at") {
+		addColumnIfMissing(db, "users", "email_verified_at", "TIMESTAMP")
+		if _, err := db.Exec(`UPDATE users SET email_verified_at = CURRENT_TIMESTAMP`); err != nil {
+			log.Fatal("Ошибка миграции подтверждения почты:", err)
+		}
+	}
+
+	emailVerificationsTable := `
+	CREATE TABLE IF NOT EXISTS email_verifications (
+	    token_hash TEXT PRIMARY KEY,
+	    user_id INTEGER NOT NULL,
+	    email TEXT NOT NULL,
+	    expires_at TIMESTAMP NOT NULL,
+	    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	)
+	`
+	if _, err := db.Exec(emailVerificationsTable); err != nil {
+		log.Fatal("Ошибка создания таблицы подтверждения почты:", err)
+	}
+
+	// Счётчики обращений к письмам подтверждения и сброса пароля (authorization_tools.Throttle)
+	requestLimitsTable := `
+	CREATE TABLE IF NOT EXISTS request_limits (
+	    key TEXT PRIMARY KEY,
+	    hits INTEGER NOT NULL,
+	    window_started_at INTEGER NOT NULL
+	)
+	`
+	if _, err := db.Exec(requestLimitsTable); err != nil {
+		log.Fatal("Ошибка создания таблицы ограничения запросов:", err)
+	}
+
+	passwordResetsTable := `
+	CREATE TABLE IF NOT EXISTS password_resets (
+	    token_hash TEXT PRIMARY KEY,
+	    user_id INTEGER NOT NULL,
+	    expires_at TIMESTAMP NOT NULL,
+	    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	)
+	`
+	if _, err := db.Exec(passwordResetsTable); err != nil {
+		log.Fatal("Ошибка создания таблицы сброса пароля:", err)
+	}
+
+	// Двухфакторная аутентификация: секрет TOTP хранится у пользователя,
+	// коды восстановления — хешами, как пароли
+	addColumnIfMissing(db, "users", "totp_secret", "TEXT")
+	addColumnIfMissing(db, "users", "totp_enabled_at", "TIMESTAMP")
+	addColumnIfMissing(db, "users", "totp_last_step", "INTEGER")
+
+	// Удаление учётной записи: время, на которое оно назначено, и время обезличивания
+	addColumnIfMissing(db, "users", "deletion_scheduled_at", "TIMESTAMP")
+	addColumnIfMissing(db, "users", "deleted_at", "TIMESTAMP")
+
+	recoveryCodesTable := `
+	CREATE TABLE IF NOT EXISTS recovery_codes (
+	    id INTEGER PRIMARY KEY AUTOINCREMENT,
+	    user_id INTEGER NOT NULL,
+	    lookup TEXT NOT NULL,
+	    code_hash TEXT NOT NULL,
+	    used_at TIMESTAMP,
+	    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	)
+	`
+	if _, err := db.Exec(recoveryCodesTable); err != nil {
+		log.Fatal("Ошибка создания таблицы кодов восстановления:", err)
+	}
+
+	// Использованные токены первого шага входа (jti): каждый обменивается на сессию только один раз
+	usedChallengesTable := `
+	CREATE TABLE IF NOT EXISTS used_login_challenges (
+	    jti TEXT PRIMARY KEY,
+	    expires_at INTEGER NOT NULL
+	)
+	`
+	if _, err := db.Exec(usedChallengesTable); err != nil {
+		log.Fatal("Ошибка создания таблицы токенов входа:", err)
+	}
+
+	migratePasswordHashes(db, "users", "id", "password")
+	migratePasswordHashes(db, "recovery_codes", "id", "code_hash")
+	if err := authorization_tools.EncryptTOTPSecrets(db); err != nil {
+		log.Fatal("Ошибка шифрования секретов двухфакторной аутентификации: ", err)
+	}
+
+	// Счётчики неудачных попыток входа: ключ user:<имя> или ip:<адрес>
+	loginAttemptsTable := `
+	CREATE TABLE IF NOT EXISTS login_attempts (
+	    key TEXT PRIMARY KEY,
+	    failures INTEGER NOT NULL,
+	    last_failure_at INTEGER NOT NULL,
+	    locked_until INTEGER
+	)
+	`
+	if _, err := db.Exec(loginAttemptsTable); err != nil {
+		log.Fatal("Ошибка создания таблицы попыток входа:", err)
+	}
+
+	initMessageSearch(db)
+
+	// Выгрузки персональных данных: архив собирается в фоне и хранится рядом с вложениями
+	dataExportsTable := `
+	CREATE TABLE IF NOT EXISTS data_exports (
+	    id INTEGER PRIMARY KEY AUTOINCREMENT,
+	    user_id INTEGER NOT NULL,
+	    status TEXT NOT NULL,
+	    storage_key TEXT,
+	    size INTEGER,
+	    error TEXT,
+	    created_at TIMESTAMP NOT NULL,
+	    completed_at TIMESTAMP,
+	    expires_at TIMESTAMP,
+	    download_token_hash TEXT,
+	    download_token_expires_at INTEGER,
+	    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS idx_data_exports_user ON data_exports(user_id);
+	-- Незавершённая выгрузка у пользователя может быть только одна
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_data_exports_active ON data_exports(user_id)
+	    WHERE status IN ('pending', 'running');
+	`
+	if _, err := db.Exec(dataExportsTable); err != nil {
+		log.Fatal("Ошибка создания таблицы выгрузок данных:", err)
+	}
+
+	// Боты — пользователи с ролью bot, у каждого есть владелец. Вместо пароля у бота API-ключи.
+	addColumnIfMissing(db, "users", "bot_owner_id", "INTEGER REFERENCES users(id)")
+
+	apiKeysTable := `
+	CREATE TABLE IF NOT EXISTS api_keys (
+	    id INTEGER PRIMARY KEY AUTOINCREMENT,
+	    user_id INTEGER NOT NULL,
+	    name TEXT NOT NULL,
+	    prefix TEXT NOT NULL,
+	    key_hash TEXT NOT NULL UNIQUE,
+	    scopes TEXT NOT NULL,
+	    created_at TIMESTAMP NOT NULL,
+	    last_used_at TIMESTAMP,
+	    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	)
+	`
+	if _, err := db.Exec(apiKeysTable); err != nil {
+		log.Fatal("Ошибка создания таблицы API-ключей:", err)
+	}
+
+	// Исходящие вебхуки и очередь их доставок. next_attempt_at — секунды Unix,
+	// чтобы диспетчер мог выбирать наступившие доставки сравнением в SQL.
+	webhooksTable := `
+	CREATE TABLE IF NOT EXISTS webhooks (
+	    id INTEGER PRIMARY KEY AUTOINCREMENT,
+	    owner_id INTEGER NOT NULL,
+	    url TEXT NOT NULL,
+	    secret TEXT NOT NULL,
+	    events TEXT NOT NULL,
+	    all_users INTEGER NOT NULL DEFAULT 0,
+	    created_at TIMESTAMP NOT NULL,
+	    FOREIGN KEY (owner_id) REFERENCES users(id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS webhook_deliveries (
+	    id INTEGER PRIMARY KEY AUTOINCREMENT,
+	    webhook_id INTEGER NOT NULL,
+	    event TEXT NOT NULL,
+	    payload TEXT NOT NULL,
+	    status TEXT NOT NULL,
+	    attempts INTEGER NOT NULL DEFAULT 0,
+	    next_attempt_at INTEGER,
+	    last_status_code INTEGER,
+	    last_error TEXT,
+	    created_at TIMESTAMP NOT NULL,
+	    delivered_at TIMESTAMP,
+	    FOREIGN KEY (webhook_id) REFERENCES webhooks(id) ON DELETE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_queue ON webhook_deliveries(status, next_attempt_at);
+	CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_webhook ON webhook_deliveries(webhook_id);
+	`
+	if _, err := db.Exec(webhooksTable); err != nil {
+		log.Fatal("Ошибка создания таблиц вебхуков:", err)
+	}
+
+	// Входящие вебхуки: сообщения от sender_id (владелец или его бот) в переписку с target_id
+	incomingHooksTable := `
+	CREATE TABLE IF NOT EXISTS incoming_hooks (
+	    id INTEGER PRIMARY KEY AUTOINCREMENT,
+	    owner_id INTEGER NOT NULL,
+	    sender_id INTEGER NOT NULL,
+	    target_id INTEGER NOT NULL,
+	    name TEXT NOT NULL,
+	    prefix TEXT NOT NULL,
+	    token_hash TEXT NOT NULL UNIQUE,
+	    created_at TIMESTAMP NOT NULL,
+	    last_used_at TIMESTAMP,
+	    FOREIGN KEY (owner_id) REFERENCES users(id) ON DELETE CASCADE,
+	    FOREIGN KEY (sender_id) REFERENCES users(id) ON DELETE CASCADE,
+	    FOREIGN KEY (target_id) REFERENCES users(id) ON DELETE CASCADE
+	)
+	`
+	if _, err := db.Exec(incomingHooksTable); err != nil {
+		log.Fatal("Ошибка создания таблицы входящих вебхуков:", err)
+	}
+
+	// Данные слэш-команд: напоминания (/remind), отключённые уведомления (/mute) и команды ботов.
+	// remind_at и until — секунды Unix, чтобы сравнивать их в SQL; until NULL — без срока.
+	commandsTables := `
+	CREATE TABLE IF NOT EXISTS reminders (
+	    id INTEGER PRIMARY KEY AUTOINCREMENT,
+	    user_id INTEGER NOT NULL,
+	    peer_id INTEGER NOT NULL,
+	    text TEXT NOT NULL,
+	    remind_at INTEGER NOT NULL,
+	    created_at TIMESTAMP NOT NULL,
+	    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+	    FOREIGN KEY (peer_id) REFERENCES users(id) ON DELETE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS idx_reminders_remind_at ON reminders(remind_at);
+
+	CREATE TABLE IF NOT EXISTS mutes (
+	    user_id INTEGER NOT NULL,
+	    peer_id INTEGER NOT NULL,
+	    until INTEGER,
+	    PRIMARY KEY (user_id, peer_id),
+	    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+	    FOREIGN KEY (peer_id) REFERENCES users(id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS bot_commands (
+	    bot_id INTEGER NOT NULL,
+	    name TEXT NOT NULL,
+	    usage TEXT NOT NULL DEFAULT '',
+	    description TEXT NOT NULL DEFAULT '',
+	    PRIMARY KEY (bot_id, name),
+	    FOREIGN KEY (bot_id) REFERENCES users(id) ON DELETE CASCADE
+	);
+	`
+	if _, err := db.Exec(commandsTables); err != nil {
+		log.Fatal("Ошибка создания таблиц команд:", err)
+	}
 
 	return db
 }
+
+// migrateExpiryToUnix переводит сроки expires_at, записанные драйвером строкой, в unix-время в секундах.
+// Строки с часовым поясом нельзя сравнивать в SQL, а числа можно, поэтому истёкшие строки
+// удаляются одним запросом.
+func migrateExpiryToUnix(db *sql.DB, table, keyColumn string) {
+	rows, err := db.Query("SELECT " + keyColumn + ", expires_at FROM " + table + " WHERE typeof(expires_at) != 'integer'")
+	if err != nil {
+		log.Fatalf("Ошибка чтения сроков %s: %v", table, err)
+	}
+	converted := make(map[interface{}]int64)
+	for rows.Next() {
+		var key interface{}
+		var expiresAt time.Time
+		if err := rows.Scan(&key, &expiresAt); err != nil {
+			log.Fatalf("Ошибка чтения сроков %s: %v", table, err)
+		}
+		converted[key] = expiresAt.Unix()
+	}
+	rows.Close()
+	if len(converted) == 0 {
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer tx.Rollback()
+	for key, expiresAt := range converted {
+		if _, err := tx.Exec("UPDATE "+table+" SET expires_at = ? WHERE "+keyColumn+" = ?", expiresAt, key); err != nil {
+			log.Fatalf("Ошибка обновления срока %s: %v", table, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Сроки %s переведены в unix-время: %d", table, len(converted))
+}
+
+// migratePasswordHashes переводит хеши, у которых соль хранилась в отдельной колонке salt,
+// в самоописывающий формат PHC и удаляет колонку. Параметры хешей не меняются:
+// более стойкий хеш пароля будет сделан при следующем входе.
+func migratePasswordHashes(db *sql.DB, table, idColumn, hashColumn string) {
+	if !columnExists(db, table, "salt") {
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("SELECT " + idColumn + ", " + hashColumn + ", salt FROM " + table)
+	if err != nil {
+		log.Fatalf("Ошибка чтения хешей %s: %v", table, err)
+	}
+	converted := make(map[int]string)
+	for rows.Next() {
+		var id int
+		var hash, salt string
+		if err := rows.Scan(&id, &hash, &salt); err != nil {
+			log.Fatalf("Ошибка чтения хешей %s: %v", table, err)
+		}
+		phc, err := authorization_tools.LegacyHashToPHC(hash, salt)
+		if err != nil {
+			log.Fatalf("Не удалось преобразовать хеш %s.%d: %v", table, id, err)
+		}
+		converted[id] = phc
+	}
+	rows.Close()
+
+	for id, phc := range converted {
+		if _, err := tx.Exec("UPDATE "+table+" SET "+hashColumn+" = ? WHERE "+idColumn+" = ?", phc, id); err != nil {
+			log.Fatalf("Ошибка обновления хеша %s.%d: %v", table, id, err)
+		}
+	}
+	if _, err := tx.Exec("ALTER TABLE " + table + " DROP COLUMN salt"); err != nil {
+		log.Fatalf("Ошибка удаления колонки %s.salt: %v", table, err)
+	}
+	if err := tx.Commit(); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Хеши %s переведены в формат PHC: %d", table, len(converted))
+}
+
+// initMessageSearch создаёт полнотекстовый индекс FTS5 по сообщениям.
+// Индекс синхронизируется с таблицей messages триггерами на вставку, изменение и удаление.
+func initMessageSearch(db *sql.DB) {
+	var exists int
+	err := db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'messages_fts'`).Scan(&exists)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	searchTable := `
+	CREATE VIRTUAL TABLE IF NOT EXISTS messages_fts USING fts5(
+	    content,
+	    content='messages',
+	    content_rowid='id'
+	);
+
+	CREATE TRIGGER IF NOT EXISTS messages_fts_insert AFTER INSERT ON messages BEGIN
+	    INSERT INTO messages_fts(rowid, content) VALUES (new.id, new.content);
+	END;
+
+	CREATE TRIGGER IF NOT EXISTS messages_fts_delete AFTER DELETE ON messages BEGIN
+	    INSERT INTO messages_fts(messages_fts, rowid, content) VALUES ('delete', old.id, old.content);
+	END;
+
+	CREATE TRIGGER IF NOT EXISTS messages_fts_update AFTER UPDATE OF content ON messages BEGIN
+	    INSERT INTO messages_fts(messages_fts, rowid, content) VALUES ('delete', old.id, old.content);
+	    INSERT INTO messages_fts(rowid, content) VALUES (new.id, new.content);
+	END;
+	`
+	if _, err := db.Exec(searchTable); err != nil {
+		log.Fatal("Ошибка создания поискового индекса:", err)
+	}
+
+	// Сообщения, сохранённые до появления индекса, нужно проиндексировать один раз
+	if exists == 0 {
+		if _, err := db.Exec(`INSERT INTO messages_fts(messages_fts) VALUES ('rebuild')`); err != nil {
+			log.Fatal("Ошибка построения поискового индекса:", err)
+		}
+	}
+}
+
+// addColumnIfMissing добавляет колонку в существующую таблицу, если её ещё нет.
+// CREATE TABLE IF NOT EXISTS не меняет уже созданные таблицы, поэтому новые колонки
+// нужно добавлять отдельно.
+func addColumnIfMissing(db *sql.DB, table, column, definition string) {
+	if columnExists(db, table, column) {
+		return
+	}
+
+	if _, err := db.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + definition); err != nil {
+		log.Fatalf("Ошибка добавления колонки %s.%s: %v", table, column, err)
+	}
+}
+
+func columnExists(db *sql.DB, table, column string) bool {
+	var exists int
+	err := db.QueryRow("SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?", table, column).Scan(&exists)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return exists > 0
+}
+
+// migrateMessagesToUserIDs переводит сообщения со ссылок на имена пользователей (from_user, to_user)
+// на ссылки по id, чтобы смена имени не отрывала пользователя от его переписки.
+// Сообщения пользователей, которых уже нет в базе, остаются с пустым id.
+func migrateMessagesToUserIDs(db *sql.DB) {
+	if !columnExists(db, "messages", "from_user") {
+		return
+	}
+	log.Println("Перевод сообщений на id пользователей...")
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	migration := `
+	ALTER TABLE messages ADD COLUMN from_user_id INTEGER REFERENCES users(id);
+	ALTER TABLE messages ADD COLUMN to_user_id INTEGER REFERENCES users(id);
+	UPDATE messages SET
+	    from_user_id = (SELECT id FROM users WHERE users.username = messages.from_user),
+	    to_user_id = (SELECT id FROM users WHERE users.username = messages.to_user);
+	ALTER TABLE messages DROP COLUMN from_user;
+	ALTER TABLE messages DROP COLUMN to_user;
+	`
+	if _, err := tx.Exec(migration); err != nil {
+		log.Fatal("Ошибка перевода сообщений на id пользователей:", err)
+	}
+	if err := tx.Commit(); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -12,7 +12,7 @@ func CORSMiddleware() gin.HandlerFunc {
 		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
 		c.Writer.Header().Set("Access-Control-Allow-Credentials", "true")
 		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
-		c.Writer.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS, PUT, DELETE")
+		c.Writer.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS, PUT, PATCH, DELETE")
 
 		// Если это OPTIONS-запрос, сразу завершаем обработку
 		if c.Request.Method == "OPTIONS" {
@@ -28,12 +28,68 @@ func RegisterRoutes(r *gin.Engine, db *sql.DB) {
 	r.GET("/users", handlers.GetUsers(db))
 	r.POST("/users", handlers.CreateUsers(db))
 	r.POST("/login", handlers.Login(db))
-	r.POST("/delete", handlers.DeleteUser(db))
+	r.POST("/login/2fa", handlers.LoginSecondFactor(db))
+	r.GET("/verify-email", handlers.VerifyEmail(db))
+	r.POST("/verify-email/resend", handlers.ResendVerificationEmail(db))
+	r.POST("/password/forgot", handlers.ForgotPassword(db))
+	r.POST("/password/reset", handlers.ResetPassword(db))
 	r.POST("/encrypt", handlers.CryptText())
 	r.POST("/decrypt", handlers.DecryptText())
 	r.POST("/refresh", handlers.RefreshToken(db))
+	r.GET("/.well-known/jwks.json", handlers.JWKS())
+	r.POST("/logout", handlers.Logout(db))
+	r.POST("/logout-all", handlers.LogoutAll(db))
+	r.GET("/sessions", handlers.GetSessions(db))
+	r.DELETE("/sessions/:id", handlers.DeleteSession(db))
+	r.GET("/me", handlers.GetProfile(db))
+	r.PATCH("/me", handlers.UpdateProfile(db))
+	r.DELETE("/me", handlers.DeleteAccount(db))
+	r.POST("/me/restore", handlers.RestoreAccount(db))
+	r.POST("/me/export", handlers.RequestDataExport(db))
+	r.GET("/me/export/:id", handlers.GetDataExport(db))
+	r.POST("/me/export/:id/link", handlers.DataExportLink(db))
+	r.GET("/me/export/:id/download", handlers.DownloadDataExport(db))
+
+	r.POST("/bots", handlers.CreateBot(db))
+	r.GET("/bots", handlers.GetBots(db))
+	r.DELETE("/bots/:username", handlers.DeleteBot(db))
+	r.POST("/bots/:username/keys", handlers.CreateAPIKey(db))
+	r.GET("/bots/:username/keys", handlers.GetAPIKeys(db))
+	r.DELETE("/bots/:username/keys/:id", handlers.RevokeAPIKey(db))
+
+	r.POST("/webhooks", handlers.CreateWebhook(db))
+	r.GET("/webhooks", handlers.GetWebhooks(db))
+	r.DELETE("/webhooks/:id", handlers.DeleteWebhook(db))
+	r.GET("/webhooks/:id/deliveries", handlers.GetWebhookDeliveries(db))
+	r.POST("/webhooks/:id/deliveries/:delivery_id/retry", handlers.RetryWebhookDelivery(db))
+
+	r.POST("/incoming-hooks", handlers.CreateIncomingHook(db))
+	r.GET("/incoming-hooks", handlers.GetIncomingHooks(db))
+	r.DELETE("/incoming-hooks/:id", handlers.DeleteIncomingHook(db))
+	r.POST("/hooks/:token", handlers.PostIncomingHook(db))
+
+	r.POST("/commands", handlers.RegisterBotCommand(db))
+	r.GET("/commands", handlers.GetBotCommands(db))
+	r.DELETE("/commands/:name", handlers.DeleteBotCommand(db))
+
+	r.POST("/2fa/enroll", handlers.EnrollTOTP(db))
+	r.POST("/2fa/confirm", handlers.ConfirmTOTP(db))
+	r.POST("/2fa/disable", handlers.DisableTOTP(db))
 	r.GET("/get-chats", handlers.GetUserChats(db))
 	r.GET("/get-messages", handlers.GetChatMessages(db))
+	r.GET("/search", handlers.SearchMessages(db))
+	r.POST("/attachments", handlers.UploadAttachment(db))
+	r.GET("/attachments/:id", handlers.DownloadAttachment(db, false))
+	r.GET("/attachments/:id/thumbnail", handlers.DownloadAttachment(db, true))
+	r.GET("/attachments/:id/link", handlers.AttachmentLink(db))
+	r.GET("/blocks", handlers.GetBlockedUsers(db))
+	r.POST("/blocks", handlers.BlockUser(db))
+	r.DELETE("/blocks/:username", handlers.UnblockUser(db))
+	r.POST("/messages/:id/report", handlers.ReportMessage(db))
+	r.GET("/moderation/reports", handlers.GetReports(db))
+	r.POST("/moderation/reports/:id/resolve", handlers.ResolveReport(db))
+	r.GET("/moderation/log", handlers.GetModerationLog(db))
+	r.POST("/admin/users/:username/unlock", handlers.UnlockUser(db))
 	//r.POST("/delete-message", handlers.DeleteMessage(db))
 	//r.POST("/update-message", handlers.UpdateMessage(db))
 
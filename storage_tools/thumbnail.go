@@ -0,0 +1,112 @@
+package storage_tools
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	_ "image/gif" // регистрирует декодер GIF для image.Decode
+	"image/jpeg"
+	"image/png"
+	"io"
+)
+
+// maxThumbnailPixels — изображения больше этого не декодируются: небольшой файл может
+// заявлять огромные размеры, и декодер выделил бы под них гигабайты памяти
+const maxThumbnailPixels = 40_000_000
+
+var (
+	ErrUnsupportedImage = errors.New("формат изображения не поддерживается")
+	ErrImageTooLarge    = errors.New("изображение слишком большое для миниатюры")
+)
+
+// Thumbnail уменьшает изображение так, чтобы оно помещалось в квадрат maxSize×maxSize.
+// Поддерживаются JPEG, PNG и GIF (берётся первый кадр). PNG и GIF сохраняются в PNG,
+// чтобы не потерять прозрачность, остальные — в JPEG. Возвращает данные и их MIME-тип.
+// Размеры проверяются по заголовку до декодирования, поэтому нужен io.ReadSeeker.
+func Thumbnail(r io.ReadSeeker, maxSize int) ([]byte, string, error) {
+	config, _, err := image.DecodeConfig(r)
+	if errors.Is(err, image.ErrFormat) {
+		return nil, "", ErrUnsupportedImage
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	if config.Width <= 0 || config.Height <= 0 || int64(config.Width)*int64(config.Height) > maxThumbnailPixels {
+		return nil, "", ErrImageTooLarge
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, "", err
+	}
+
+	src, format, err := image.Decode(r)
+	if err != nil {
+		return nil, "", err
+	}
+
+	dst := scaleDown(src, maxSize)
+
+	var buf bytes.Buffer
+	switch format {
+	case "png", "gif":
+		err = png.Encode(&buf, dst)
+		return buf.Bytes(), "image/png", err
+	default:
+		err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 80})
+		return buf.Bytes(), "image/jpeg", err
+	}
+}
+
+// scaleDown уменьшает изображение усреднением пикселей исходной области (box filter)
+func scaleDown(src image.Image, maxSize int) image.Image {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= maxSize && h <= maxSize {
+		return src
+	}
+
+	dw, dh := maxSize, maxSize
+	if w > h {
+		dh = h * maxSize / w
+	} else {
+		dw = w * maxSize / h
+	}
+	if dw < 1 {
+		dw = 1
+	}
+	if dh < 1 {
+		dh = 1
+	}
+
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		y0 := b.Min.Y + y*h/dh
+		y1 := b.Min.Y + (y+1)*h/dh
+		for x := 0; x < dw; x++ {
+			x0 := b.Min.X + x*w/dw
+			x1 := b.Min.X + (x+1)*w/dw
+
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					c := color.NRGBA64Model.Convert(src.At(sx, sy)).(color.NRGBA64)
+					r += uint64(c.R)
+					g += uint64(c.G)
+					bl += uint64(c.B)
+					a += uint64(c.A)
+					n++
+				}
+			}
+			if n == 0 {
+				continue
+			}
+			dst.Set(x, y, color.NRGBA64{
+				R: uint16(r / n),
+				G: uint16(g / n),
+				B: uint16(bl / n),
+				A: uint16(a / n),
+			})
+		}
+	}
+	return dst
+}
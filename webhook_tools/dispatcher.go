@@ -0,0 +1,250 @@
+package webhook_tools
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// maxAttempts — после стольких неудачных попыток доставка попадает в список недоставленных
+	maxAttempts = 8
+	// Задержка перед повторной попыткой удваивается от firstRetryDelay до maxRetryDelay
+	firstRetryDelay = 10 * time.Second
+	maxRetryDelay   = time.Hour
+
+	deliveryTimeout = 10 * time.Second
+	batchSize       = 20
+	pollInterval    = 5 * time.Second
+	// maxErrorLength — сколько байт ответа получателя сохраняется в last_error
+	maxErrorLength = 512
+)
+
+var errPrivateAddress = errors.New("доставка во внутреннюю сеть запрещена")
+
+// allowPrivateNetworks разрешает доставку на localhost и адреса внутренних сетей.
+// По умолчанию запрещено, чтобы через вебхук нельзя было обращаться к внутренним сервисам.
+var allowPrivateNetworks bool
+
+func SetAllowPrivateNetworks(allow bool) {
+	allowPrivateNetworks = allow
+}
+
+// wake будит диспетчер, когда в очереди появилась новая доставка
+var wake = make(chan struct{}, 1)
+
+func wakeDispatcher() {
+	select {
+	case wake <- struct{}{}:
+	default:
+	}
+}
+
+// Sign возвращает подпись тела запроса: HMAC-SHA256 от "<timestamp>.<body>" в hex.
+// Получатель передаёт в заголовке X-Webhook-Signature: t=<timestamp>,v1=<подпись>
+// и должен сравнить подпись и проверить, что timestamp недавний.
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10) + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// sharedAddressSpace — 100.64.0.0/10 (RFC 6598): адреса за NAT провайдера, IsPrivate их не включает
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// checkAddress запрещает соединения с внутренними адресами. Проверяется адрес, к которому
+// действительно идёт подключение, поэтому подмена DNS после регистрации вебхука не поможет.
+func checkAddress(network, address string, _ syscall.RawConn) error {
+	if allowPrivateNetworks {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || sharedAddressSpace.Contains(ip) ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsMulticast() {
+		return errPrivateAddress
+	}
+	return nil
+}
+
+var httpClient = &http.Client{
+	Timeout: deliveryTimeout,
+	Transport: &http.Transport{
+		DialContext:         (&net.Dialer{Timeout: deliveryTimeout, Control: checkAddress}).DialContext,
+		TLSHandshakeTimeout: deliveryTimeout,
+		MaxIdleConnsPerHost: 2,
+	},
+	// Перенаправление считается неудачей: иначе подпись уйдёт на другой адрес
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// StartDispatcher запускает фоновую доставку событий из очереди.
+// Возвращённая функция останавливает доставку и ждёт завершения текущих запросов.
+func StartDispatcher(db *sql.DB) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		for {
+			for deliverDue(ctx, db) {
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-wake:
+			case <-time.After(pollInterval):
+			}
+		}
+	}()
+
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// pendingDelivery — доставка из очереди вместе с адресом и секретом вебхука
+type pendingDelivery struct {
+	id       int
+	attempts int
+	event    string
+	payload  []byte
+	url      string
+	secret   string
+}
+
+// deliverDue отправляет очередную пачку доставок, срок которых наступил.
+// Возвращает true, если пачка была полной и в очереди могут быть ещё.
+func deliverDue(ctx context.Context, db *sql.DB) bool {
+	// next_attempt_at хранится в секундах Unix, чтобы очередь можно было выбирать сравнением в SQL
+	rows, err := db.Query(`
+		SELECT d.id, d.attempts, d.event, d.payload, w.url, w.secret
+		FROM webhook_deliveries d
+		JOIN webhooks w ON w.id = d.webhook_id
+		WHERE d.status = ? AND d.next_attempt_at <= ?
+		ORDER BY d.next_attempt_at
+		LIMIT ?`, StatusPending, time.Now().Unix(), batchSize)
+	if err != nil {
+		log.Println("Ошибка чтения очереди вебхуков:", err)
+		return false
+	}
+	var batch []pendingDelivery
+	for rows.Next() {
+		var d pendingDelivery
+		var payload string
+		if err := rows.Scan(&d.id, &d.attempts, &d.event, &payload, &d.url, &d.secret); err != nil {
+			rows.Close()
+			log.Println("Ошибка чтения очереди вебхуков:", err)
+			return false
+		}
+		d.payload = []byte(payload)
+		batch = append(batch, d)
+	}
+	rows.Close()
+
+	var wg sync.WaitGroup
+	for _, d := range batch {
+		wg.Add(1)
+		go func(d pendingDelivery) {
+			defer wg.Done()
+			statusCode, err := send(ctx, d)
+			if ctx.Err() != nil {
+				// Сервер останавливается: доставка останется в очереди и будет повторена после запуска
+				return
+			}
+			if err := recordAttempt(db, d, statusCode, err); err != nil {
+				log.Printf("Ошибка сохранения результата доставки %d: %v", d.id, err)
+			}
+		}(d)
+	}
+	wg.Wait()
+	return len(batch) == batchSize && ctx.Err() == nil
+}
+
+// send отправляет подписанный запрос. Успех — любой ответ 2xx.
+func send(ctx context.Context, d pendingDelivery) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.url, bytes.NewReader(d.payload))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "gorutines-webhooks/1")
+	req.Header.Set("X-Webhook-Event", d.event)
+	req.Header.Set("X-Webhook-Delivery", strconv.Itoa(d.id))
+	req.Header.Set("X-Webhook-Signature", fmt.Sprintf("t=%d,v1=%s", timestamp, Sign(d.secret, timestamp, d.payload)))
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorLength))
+		return resp.StatusCode, fmt.Errorf("получатель ответил %s: %s", resp.Status, body)
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+	return resp.StatusCode, nil
+}
+
+// recordAttempt сохраняет результат попытки и назначает следующую
+func recordAttempt(db *sql.DB, d pendingDelivery, statusCode int, sendErr error) error {
+	attempts := d.attempts + 1
+	if sendErr == nil {
+		_, err := db.Exec(`
+			UPDATE webhook_deliveries
+			SET status = ?, attempts = ?, last_status_code = ?, last_error = NULL, delivered_at = ?
+			WHERE id = ?`, StatusDelivered, attempts, statusCode, time.Now(), d.id)
+		return err
+	}
+
+	status := StatusPending
+	if attempts >= maxAttempts {
+		status = StatusDead
+		log.Printf("Доставка %d события %s на %s не удалась после %d попыток: %v", d.id, d.event, d.url, attempts, sendErr)
+	}
+	message := sendErr.Error()
+	if len(message) > maxErrorLength {
+		message = message[:maxErrorLength]
+	}
+	_, err := db.Exec(`
+		UPDATE webhook_deliveries
+		SET status = ?, attempts = ?, last_status_code = ?, last_error = ?, next_attempt_at = ?
+		WHERE id = ?`,
+		status, attempts, sql.NullInt64{Int64: int64(statusCode), Valid: statusCode != 0}, message,
+		time.Now().Add(retryDelay(attempts)).Unix(), d.id)
+	return err
+}
+
+// retryDelay — задержка перед попыткой номер attempts+1
+func retryDelay(attempts int) time.Duration {
+	delay := firstRetryDelay
+	for i := 1; i < attempts && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	return delay
+}
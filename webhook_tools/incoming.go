@@ -0,0 +1,238 @@
+package webhook_tools
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"gorutines/authorization_tools"
+	"strings"
+	"sync"
+	"time"
+)
+
+// incomingTokenPrefix отличает токен входящего вебхука от других секретов в логах и конфигурации
+const incomingTokenPrefix = "ih_"
+
+// Ограничение частоты для каждого входящего вебхука: до incomingBurst сообщений подряд,
+// затем одно сообщение в incomingRefill
+const (
+	incomingBurst  = 10
+	incomingRefill = 2 * time.Second
+)
+
+var (
+	ErrIncomingHookInvalid = errors.New("неверный токен вебхука")
+	ErrEmptyIncomingText   = errors.New("сообщение пустое: нужен text, title или fields")
+	// ErrTooManyIncomingHooks — у владельца уже максимальное число входящих вебхуков
+	ErrTooManyIncomingHooks = errors.New("превышено число входящих вебхуков")
+	// ErrIncomingHookDisabled — отправитель или владелец вебхука заблокирован либо удаляет учётную запись
+	ErrIncomingHookDisabled = errors.New("учетная запись отправителя заблокирована")
+)
+
+// IncomingHook — входящий вебхук: публикует сообщения от имени sender в переписку с target.
+// Сам токен показывается один раз при создании.
+type IncomingHook struct {
+	ID         int        `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Sender     string     `json:"sender"`
+	Target     string     `json:"to"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+// IncomingSender — от чьего имени и кому публикуется сообщение входящего вебхука
+type IncomingSender struct {
+	HookID   int
+	SenderID int
+	Sender   string
+	FromBot  bool
+	TargetID int
+	Target   string
+}
+
+// IncomingField — строка «название: значение» в оформленном сообщении
+type IncomingField struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// IncomingPayload — тело запроса входящего вебхука: простой текст или оформленное сообщение
+type IncomingPayload struct {
+	Text   string          `json:"text"`
+	Title  string          `json:"title"`
+	URL    string          `json:"url"`
+	Fields []IncomingField `json:"fields"`
+}
+
+// Render собирает из оформленного сообщения обычный текст: заголовок, текст, поля и ссылку по строкам
+func (p IncomingPayload) Render() (string, error) {
+	var lines []string
+	for _, line := range []string{p.Title, p.Text} {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	for _, f := range p.Fields {
+		name, value := strings.TrimSpace(f.Name), strings.TrimSpace(f.Value)
+		switch {
+		case name != "" && value != "":
+			lines = append(lines, name+": "+value)
+		case name != "" || value != "":
+			lines = append(lines, name+value)
+		}
+	}
+	if len(lines) == 0 {
+		return "", ErrEmptyIncomingText
+	}
+	if url := strings.TrimSpace(p.URL); url != "" {
+		lines = append(lines, url)
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// CreateIncomingHook выпускает входящий вебхук владельца ownerID. В базе хранится только хеш токена.
+// Если у владельца уже limit вебхуков, возвращает ErrTooManyIncomingHooks: проверка и вставка —
+// один запрос, поэтому параллельные запросы не превысят лимит.
+// Имена отправителя и получателя в возвращённом вебхуке не заполняются.
+func CreateIncomingHook(ownerID, senderID, targetID int, name string, limit int, db *sql.DB) (string, IncomingHook, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", IncomingHook{}, err
+	}
+	token := incomingTokenPrefix + hex.EncodeToString(b)
+
+	h := IncomingHook{Name: name, Prefix: token[:len(incomingTokenPrefix)+8], CreatedAt: time.Now()}
+	res, err := db.Exec(`
+		INSERT INTO incoming_hooks (owner_id, sender_id, target_id, name, prefix, token_hash, created_at)
+		SELECT ?, ?, ?, ?, ?, ?, ?
+		WHERE (SELECT COUNT(*) FROM incoming_hooks WHERE owner_id = ?) < ?`,
+		ownerID, senderID, targetID, name, h.Prefix, authorization_tools.HashToken(token), h.CreatedAt,
+		ownerID, limit)
+	if err != nil {
+		return "", IncomingHook{}, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return "", IncomingHook{}, err
+	} else if n == 0 {
+		return "", IncomingHook{}, ErrTooManyIncomingHooks
+	}
+	id, err := res.LastInsertId()
+	h.ID = int(id)
+	return token, h, err
+}
+
+// ListIncomingHooks возвращает входящие вебхуки владельца
+func ListIncomingHooks(ownerID int, db *sql.DB) ([]IncomingHook, error) {
+	rows, err := db.Query(`
+		SELECT h.id, h.name, h.prefix, s.username, t.username, h.created_at, h.last_used_at
+		FROM incoming_hooks h
+		JOIN users s ON s.id = h.sender_id
+		JOIN users t ON t.id = h.target_id
+		WHERE h.owner_id = ?
+		ORDER BY h.id`, ownerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hooks := []IncomingHook{}
+	for rows.Next() {
+		var h IncomingHook
+		var lastUsedAt sql.NullTime
+		if err := rows.Scan(&h.ID, &h.Name, &h.Prefix, &h.Sender, &h.Target, &h.CreatedAt, &lastUsedAt); err != nil {
+			return nil, err
+		}
+		if lastUsedAt.Valid {
+			h.LastUsedAt = &lastUsedAt.Time
+		}
+		hooks = append(hooks, h)
+	}
+	return hooks, rows.Err()
+}
+
+// DeleteIncomingHook удаляет входящий вебхук владельца, found == false — такого вебхука нет
+func DeleteIncomingHook(ownerID, hookID int, db *sql.DB) (bool, error) {
+	res, err := db.Exec(`DELETE FROM incoming_hooks WHERE id = ? AND owner_id = ?`, hookID, ownerID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if n > 0 {
+		limiterMu.Lock()
+		delete(buckets, hookID)
+		limiterMu.Unlock()
+	}
+	return n > 0, err
+}
+
+// AuthenticateIncomingHook находит вебхук по токену и отмечает его использование.
+// Вебхук не действует, пока отправитель или владелец заблокирован или ожидает удаления.
+func AuthenticateIncomingHook(token string, db *sql.DB) (IncomingSender, error) {
+	var s IncomingSender
+	var senderRole string
+	var disabled bool
+	err := db.QueryRow(`
+		SELECT h.id, s.id, s.username, s.role, t.id, t.username,
+			s.suspended_at IS NOT NULL OR s.deletion_scheduled_at IS NOT NULL OR
+			o.suspended_at IS NOT NULL OR o.deletion_scheduled_at IS NOT NULL
+		FROM incoming_hooks h
+		JOIN users s ON s.id = h.sender_id
+		JOIN users t ON t.id = h.target_id
+		JOIN users o ON o.id = h.owner_id
+		WHERE h.token_hash = ?`, authorization_tools.HashToken(token)).
+		Scan(&s.HookID, &s.SenderID, &s.Sender, &senderRole, &s.TargetID, &s.Target, &disabled)
+	if errors.Is(err, sql.ErrNoRows) {
+		return IncomingSender{}, ErrIncomingHookInvalid
+	}
+	if err != nil {
+		return IncomingSender{}, err
+	}
+	if disabled {
+		return IncomingSender{}, ErrIncomingHookDisabled
+	}
+	s.FromBot = senderRole == "bot"
+
+	if _, err := db.Exec(`UPDATE incoming_hooks SET last_used_at = ? WHERE id = ?`, time.Now(), s.HookID); err != nil {
+		return IncomingSender{}, err
+	}
+	return s, nil
+}
+
+// bucket — запас сообщений вебхука на момент updated
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+var (
+	limiterMu sync.Mutex
+	buckets   = make(map[int]*bucket)
+)
+
+// IncomingRetryAfter расходует одно сообщение из запаса вебхука.
+// Ноль — сообщение можно публиковать, иначе — сколько ждать до следующего.
+// Запас хранится в памяти: после перезапуска сервера он снова полный.
+func IncomingRetryAfter(hookID int) time.Duration {
+	limiterMu.Lock()
+	defer limiterMu.Unlock()
+
+	now := time.Now()
+	b, ok := buckets[hookID]
+	if !ok {
+		b = &bucket{tokens: incomingBurst, updated: now}
+		buckets[hookID] = b
+	}
+	b.tokens += float64(now.Sub(b.updated)) / float64(incomingRefill)
+	if b.tokens > incomingBurst {
+		b.tokens = incomingBurst
+	}
+	b.updated = now
+
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) * float64(incomingRefill))
+	}
+	b.tokens--
+	return 0
+}
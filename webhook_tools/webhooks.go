@@ -0,0 +1,274 @@
+package webhook_tools
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// События, о которых можно получать уведомления
+const (
+	EventSendMessage   = "send_message"
+	EventEditMessage   = "edit_message"
+	EventDeleteMessage = "delete_message"
+)
+
+var knownEvents = []string{EventSendMessage, EventEditMessage, EventDeleteMessage}
+
+// Состояния доставки: ждёт отправки (в том числе повторной), доставлена, исчерпала попытки
+const (
+	StatusPending   = "pending"
+	StatusDelivered = "delivered"
+	StatusDead      = "dead"
+)
+
+var (
+	ErrInvalidURL   = errors.New("адрес вебхука должен быть http(s) ссылкой")
+	ErrUnknownEvent = errors.New("неизвестное событие")
+)
+
+// Webhook — зарегистрированный получатель событий. Секрет для подписи в списке не отдаётся.
+type Webhook struct {
+	ID        int       `json:"id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	AllUsers  bool      `json:"all_users"` // события всех пользователей, а не только владельца
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Delivery — одна доставка события вебхуку
+type Delivery struct {
+	ID             int             `json:"id"`
+	Event          string          `json:"event"`
+	Status         string          `json:"status"`
+	Attempts       int             `json:"attempts"`
+	LastStatusCode int             `json:"last_status_code,omitempty"`
+	LastError      string          `json:"last_error,omitempty"`
+	CreatedAt      time.Time       `json:"created_at"`
+	NextAttemptAt  *time.Time      `json:"next_attempt_at,omitempty"`
+	DeliveredAt    *time.Time      `json:"delivered_at,omitempty"`
+	Payload        json.RawMessage `json:"payload"`
+}
+
+// ValidateURL проверяет адрес вебхука. Доступность адреса проверяется при доставке.
+func ValidateURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.User != nil {
+		return ErrInvalidURL
+	}
+	return nil
+}
+
+// ValidateEvents проверяет список событий и убирает повторы. Пустой список — все события.
+func ValidateEvents(events []string) ([]string, error) {
+	if len(events) == 0 {
+		return knownEvents, nil
+	}
+	seen := make(map[string]bool)
+	var result []string
+	for _, event := range events {
+		known := false
+		for _, k := range knownEvents {
+			known = known || k == event
+		}
+		if !known {
+			return nil, fmt.Errorf("%w: %q", ErrUnknownEvent, event)
+		}
+		if !seen[event] {
+			seen[event] = true
+			result = append(result, event)
+		}
+	}
+	return result, nil
+}
+
+// CreateWebhook регистрирует вебхук и возвращает секрет для проверки подписи.
+// Секрет хранится открытым: без него нельзя подписать запрос.
+func CreateWebhook(ownerID int, rawURL string, events []string, allUsers bool, db *sql.DB) (Webhook, string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return Webhook{}, "", err
+	}
+	secret := "whsec_" + hex.EncodeToString(b)
+
+	w := Webhook{URL: rawURL, Events: events, AllUsers: allUsers, CreatedAt: time.Now()}
+	res, err := db.Exec(`
+		INSERT INTO webhooks (owner_id, url, secret, events, all_users, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)`,
+		ownerID, rawURL, secret, strings.Join(events, ","), allUsers, w.CreatedAt)
+	if err != nil {
+		return Webhook{}, "", err
+	}
+	id, err := res.LastInsertId()
+	w.ID = int(id)
+	return w, secret, err
+}
+
+// CountWebhooks возвращает число вебхуков владельца
+func CountWebhooks(ownerID int, db *sql.DB) (int, error) {
+	var n int
+	err := db.QueryRow(`SELECT COUNT(*) FROM webhooks WHERE owner_id = ?`, ownerID).Scan(&n)
+	return n, err
+}
+
+// ListWebhooks возвращает вебхуки владельца
+func ListWebhooks(ownerID int, db *sql.DB) ([]Webhook, error) {
+	rows, err := db.Query(`SELECT id, url, events, all_users, created_at FROM webhooks WHERE owner_id = ? ORDER BY id`, ownerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	webhooks := []Webhook{}
+	for rows.Next() {
+		var w Webhook
+		var events string
+		if err := rows.Scan(&w.ID, &w.URL, &events, &w.AllUsers, &w.CreatedAt); err != nil {
+			return nil, err
+		}
+		w.Events = strings.Split(events, ",")
+		webhooks = append(webhooks, w)
+	}
+	return webhooks, rows.Err()
+}
+
+// OwnsWebhook сообщает, что вебхук принадлежит пользователю
+func OwnsWebhook(ownerID, webhookID int, db *sql.DB) (bool, error) {
+	var n int
+	err := db.QueryRow(`SELECT COUNT(*) FROM webhooks WHERE id = ? AND owner_id = ?`, webhookID, ownerID).Scan(&n)
+	return n > 0, err
+}
+
+// DeleteWebhook удаляет вебхук вместе с очередью его доставок
+func DeleteWebhook(ownerID, webhookID int, db *sql.DB) (bool, error) {
+	res, err := db.Exec(`DELETE FROM webhooks WHERE id = ? AND owner_id = ?`, webhookID, ownerID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// ListDeliveries возвращает последние доставки вебхука, status может быть пустым
+func ListDeliveries(webhookID int, status string, limit int, db *sql.DB) ([]Delivery, error) {
+	query := `
+		SELECT id, event, status, attempts, last_status_code, last_error, created_at, next_attempt_at, delivered_at, payload
+		FROM webhook_deliveries
+		WHERE webhook_id = ? AND (? = '' OR status = ?)
+		ORDER BY id DESC
+		LIMIT ?`
+	rows, err := db.Query(query, webhookID, status, status, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []Delivery{}
+	for rows.Next() {
+		var d Delivery
+		var statusCode sql.NullInt64
+		var lastError sql.NullString
+		var nextAttemptAt sql.NullInt64
+		var deliveredAt sql.NullTime
+		var payload string
+		err := rows.Scan(&d.ID, &d.Event, &d.Status, &d.Attempts, &statusCode, &lastError,
+			&d.CreatedAt, &nextAttemptAt, &deliveredAt, &payload)
+		if err != nil {
+			return nil, err
+		}
+		d.LastStatusCode = int(statusCode.Int64)
+		d.LastError = lastError.String
+		if d.Status == StatusPending && nextAttemptAt.Valid {
+			t := time.Unix(nextAttemptAt.Int64, 0)
+			d.NextAttemptAt = &t
+		}
+		if deliveredAt.Valid {
+			d.DeliveredAt = &deliveredAt.Time
+		}
+		d.Payload = json.RawMessage(payload)
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+// RetryDelivery возвращает доставку из списка недоставленных в очередь с новым счётчиком попыток
+func RetryDelivery(webhookID, deliveryID int, db *sql.DB) (bool, error) {
+	res, err := db.Exec(`
+		UPDATE webhook_deliveries SET status = ?, attempts = 0, next_attempt_at = ?
+		WHERE id = ? AND webhook_id = ? AND status = ?`,
+		StatusPending, time.Now().Unix(), deliveryID, webhookID, StatusDead)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if n > 0 {
+		wakeDispatcher()
+	}
+	return n > 0, err
+}
+
+// allUsersFilter отбирает вебхуки всех пользователей, владелец которых — администратор,
+// не заблокирован и не ожидает удаления: снятые с должности теряют доступ к чужим событиям
+const allUsersFilter = "(w.all_users AND u.role = 'admin' AND u.suspended_at IS NULL AND u.deletion_scheduled_at IS NULL)"
+
+// Enqueue ставит событие в очередь доставки всем подходящим вебхукам: владельцам,
+// которые участвуют в событии (participants — id пользователей), и вебхукам всех пользователей.
+// Вебхук всех пользователей получает события, только пока владелец остаётся действующим администратором.
+func Enqueue(event string, participants []int, data interface{}, db *sql.DB) error {
+	payload, err := json.Marshal(struct {
+		Event     string      `json:"event"`
+		CreatedAt time.Time   `json:"created_at"`
+		Data      interface{} `json:"data"`
+	}{event, time.Now(), data})
+	if err != nil {
+		return err
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(participants)), ",")
+	args := []interface{}{StatusPending, time.Now().Unix(), event, string(payload), time.Now()}
+	for _, id := range participants {
+		args = append(args, id)
+	}
+	args = append(args, event)
+
+	ownerFilter := allUsersFilter
+	if len(participants) > 0 {
+		ownerFilter = "(" + allUsersFilter + " OR w.owner_id IN (" + placeholders + "))"
+	}
+	// events хранится через запятую, поэтому ищем событие с запятыми по краям
+	res, err := db.Exec(`
+		INSERT INTO webhook_deliveries (webhook_id, status, attempts, next_attempt_at, event, payload, created_at)
+		SELECT w.id, ?, 0, ?, ?, ?, ?
+		FROM webhooks w JOIN users u ON u.id = w.owner_id
+		WHERE `+ownerFilter+` AND ',' || w.events || ',' LIKE '%,' || ? || ',%'`, args...)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		wakeDispatcher()
+	}
+	return nil
+}
+
+// CleanupDeliveries оставляет у каждого вебхука не больше keep последних завершённых доставок
+func CleanupDeliveries(keep int, db *sql.DB) (int, error) {
+	res, err := db.Exec(`
+		DELETE FROM webhook_deliveries
+		WHERE status != ? AND id NOT IN (
+			SELECT id FROM (
+				SELECT id, ROW_NUMBER() OVER (PARTITION BY webhook_id ORDER BY id DESC) AS n
+				FROM webhook_deliveries WHERE status != ?
+			) WHERE n <= ?
+		)`, StatusPending, StatusPending, keep)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
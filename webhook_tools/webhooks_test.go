@@ -0,0 +1,325 @@
+package webhook_tools
+
+import (
+	"context"
+	"crypto/hmac"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"gorutines/models"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestDB создаёт базу в отдельном каталоге (InitDB открывает ./project.db) с пользователями 1..users
+func newTestDB(t *testing.T, users int) *sql.DB {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	db := models.InitDB()
+	t.Cleanup(func() { db.Close() })
+	for i := 1; i <= users; i++ {
+		_, err := db.Exec(`INSERT INTO users (id, username, email, password, role) VALUES (?, ?, ?, '', 'user')`,
+			i, fmt.Sprintf("user%d", i), fmt.Sprintf("user%d@example.com", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db
+}
+
+func allowPrivateNetworksForTest(t *testing.T) {
+	SetAllowPrivateNetworks(true)
+	t.Cleanup(func() { SetAllowPrivateNetworks(false) })
+}
+
+// queuedWebhooks — id вебхуков, которым поставлена доставка события event
+func queuedWebhooks(t *testing.T, db *sql.DB, event string) []int {
+	t.Helper()
+	rows, err := db.Query(`SELECT webhook_id FROM webhook_deliveries WHERE event = ?`, event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+func TestEnqueueFiltersOwnersAndEvents(t *testing.T) {
+	db := newTestDB(t, 3)
+	create := func(owner int, events []string, allUsers bool) int {
+		t.Helper()
+		w, _, err := CreateWebhook(owner, "https://example.com/hook", events, allUsers, db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return w.ID
+	}
+	if _, err := db.Exec(`UPDATE users SET role = 'admin' WHERE id = 3`); err != nil {
+		t.Fatal(err)
+	}
+	ownSend := create(1, []string{EventSendMessage}, false)
+	ownAll := create(2, knownEvents, false)
+	allUsersEdit := create(3, []string{EventEditMessage}, true)
+	create(3, []string{EventSendMessage}, false) // владелец не участвует в событиях
+
+	if err := Enqueue(EventSendMessage, []int{1, 2}, map[string]string{"content": "hi"}, db); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := queuedWebhooks(t, db, EventSendMessage), []int{ownSend, ownAll}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("send_message для участников 1 и 2: вебхуки %v, ожидались %v", got, want)
+	}
+
+	if err := Enqueue(EventEditMessage, []int{1, 2}, nil, db); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := queuedWebhooks(t, db, EventEditMessage), []int{ownAll, allUsersEdit}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("edit_message для участников 1 и 2: вебхуки %v, ожидались %v", got, want)
+	}
+
+	// Вебхук всех пользователей перестаёт получать события, когда владелец больше не действующий администратор
+	for _, demote := range []string{
+		`UPDATE users SET role = 'user' WHERE id = 3`,
+		`UPDATE users SET role = 'admin', suspended_at = CURRENT_TIMESTAMP WHERE id = 3`,
+		`UPDATE users SET suspended_at = NULL, deletion_scheduled_at = CURRENT_TIMESTAMP WHERE id = 3`,
+	} {
+		if _, err := db.Exec(`DELETE FROM webhook_deliveries`); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Exec(demote); err != nil {
+			t.Fatal(err)
+		}
+		if err := Enqueue(EventEditMessage, []int{1, 2}, nil, db); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := queuedWebhooks(t, db, EventEditMessage), []int{ownAll}; fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("после %q: вебхуки %v, ожидались %v", demote, got, want)
+		}
+	}
+
+	if err := Enqueue(EventDeleteMessage, nil, nil, db); err != nil {
+		t.Fatal(err)
+	}
+	if got := queuedWebhooks(t, db, EventDeleteMessage); len(got) != 0 {
+		t.Errorf("delete_message без участников: вебхуки %v, ожидалось ни одного", got)
+	}
+}
+
+func TestCheckAddress(t *testing.T) {
+	for address, allowed := range map[string]bool{
+		"93.184.216.34:443":  true,
+		"127.0.0.1:80":       false,
+		"10.1.2.3:80":        false,
+		"192.168.0.1:80":     false,
+		"169.254.169.254:80": false,
+		"100.64.0.1:80":      false,
+		"100.127.255.254:80": false,
+		"100.128.0.1:80":     true,
+		"[::1]:80":           false,
+		"[fd00::1]:80":       false,
+	} {
+		err := checkAddress("tcp", address, nil)
+		if allowed && err != nil {
+			t.Errorf("%s: %v, ожидалось разрешение", address, err)
+		}
+		if !allowed && err == nil {
+			t.Errorf("%s разрешён, ожидался отказ", address)
+		}
+	}
+}
+
+func TestDeliverySignature(t *testing.T) {
+	allowPrivateNetworksForTest(t)
+	db := newTestDB(t, 1)
+
+	type received struct {
+		header http.Header
+		body   []byte
+	}
+	var mu sync.Mutex
+	var requests []received
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		requests = append(requests, received{r.Header.Clone(), body})
+		mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	hook, secret, err := CreateWebhook(1, server.URL, knownEvents, false, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Enqueue(EventSendMessage, []int{1}, map[string]string{"content": "hi"}, db); err != nil {
+		t.Fatal(err)
+	}
+	deliverDue(context.Background(), db)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(requests) != 1 {
+		t.Fatalf("получено запросов: %d, ожидался 1", len(requests))
+	}
+	req := requests[0]
+	if got := req.header.Get("X-Webhook-Event"); got != EventSendMessage {
+		t.Errorf("X-Webhook-Event = %q", got)
+	}
+
+	// Проверка так, как её должен делать получатель
+	var timestamp int64
+	var signature string
+	for _, part := range strings.Split(req.header.Get("X-Webhook-Signature"), ",") {
+		key, value, _ := strings.Cut(part, "=")
+		switch key {
+		case "t":
+			timestamp, _ = strconv.ParseInt(value, 10, 64)
+		case "v1":
+			signature = value
+		}
+	}
+	if age := time.Since(time.Unix(timestamp, 0)); age < 0 || age > time.Minute {
+		t.Errorf("timestamp подписи %d не текущий", timestamp)
+	}
+	if !hmac.Equal([]byte(signature), []byte(Sign(secret, timestamp, req.body))) {
+		t.Errorf("подпись %q не совпадает с телом запроса", signature)
+	}
+	if hmac.Equal([]byte(signature), []byte(Sign("whsec_other", timestamp, req.body))) {
+		t.Errorf("подпись совпала для чужого секрета")
+	}
+
+	var payload struct {
+		Event string            `json:"event"`
+		Data  map[string]string `json:"data"`
+	}
+	if err := json.Unmarshal(req.body, &payload); err != nil || payload.Event != EventSendMessage || payload.Data["content"] != "hi" {
+		t.Errorf("тело доставки %s (%v)", req.body, err)
+	}
+
+	deliveries, err := ListDeliveries(hook.ID, StatusDelivered, 10, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 1 || deliveries[0].Attempts != 1 || deliveries[0].LastStatusCode != http.StatusNoContent {
+		t.Errorf("доставка не отмечена доставленной: %+v", deliveries)
+	}
+}
+
+func TestDeliveryRetriesAndDies(t *testing.T) {
+	allowPrivateNetworksForTest(t)
+	db := newTestDB(t, 1)
+
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	hook, _, err := CreateWebhook(1, server.URL, knownEvents, false, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Enqueue(EventSendMessage, []int{1}, nil, db); err != nil {
+		t.Fatal(err)
+	}
+
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		before := time.Now()
+		deliverDue(context.Background(), db)
+
+		var status string
+		var attempts, statusCode int
+		var nextAttemptAt int64
+		err := db.QueryRow(`SELECT status, attempts, last_status_code, next_attempt_at FROM webhook_deliveries`).
+			Scan(&status, &attempts, &statusCode, &nextAttemptAt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if attempts != attempt || statusCode != http.StatusServiceUnavailable {
+			t.Fatalf("после попытки %d: attempts = %d, код %d", attempt, attempts, statusCode)
+		}
+		if attempt < maxAttempts {
+			if status != StatusPending {
+				t.Fatalf("после попытки %d: статус %s, ожидался %s", attempt, status, StatusPending)
+			}
+			wantNext := before.Add(retryDelay(attempt)).Unix()
+			if nextAttemptAt < wantNext || nextAttemptAt > wantNext+1 {
+				t.Errorf("после попытки %d: следующая через %d с, ожидалось %v",
+					attempt, nextAttemptAt-before.Unix(), retryDelay(attempt))
+			}
+			// Повтор ещё не наступил — диспетчер не должен отправлять
+			deliverDue(context.Background(), db)
+			if int(calls.Load()) != attempt {
+				t.Fatalf("доставка отправлена раньше срока: запросов %d после %d попыток", calls.Load(), attempt)
+			}
+			if _, err := db.Exec(`UPDATE webhook_deliveries SET next_attempt_at = 0`); err != nil {
+				t.Fatal(err)
+			}
+		} else if status != StatusDead {
+			t.Fatalf("после %d попыток статус %s, ожидался %s", attempt, status, StatusDead)
+		}
+	}
+
+	// Недоставленная больше не отправляется, пока её не вернут в очередь
+	if _, err := db.Exec(`UPDATE webhook_deliveries SET next_attempt_at = 0`); err != nil {
+		t.Fatal(err)
+	}
+	deliverDue(context.Background(), db)
+	if calls.Load() != maxAttempts {
+		t.Errorf("недоставленная доставка отправлена ещё раз: запросов %d", calls.Load())
+	}
+
+	dead, err := ListDeliveries(hook.ID, StatusDead, 10, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dead) != 1 {
+		t.Fatalf("недоставленных: %d, ожидалась 1", len(dead))
+	}
+	if ok, err := RetryDelivery(hook.ID, dead[0].ID, db); err != nil || !ok {
+		t.Fatalf("RetryDelivery: %v, %v", ok, err)
+	}
+	deliverDue(context.Background(), db)
+	if calls.Load() != maxAttempts+1 {
+		t.Errorf("возвращённая в очередь доставка не отправлена: запросов %d", calls.Load())
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	for attempts, want := range map[int]time.Duration{
+		1:  firstRetryDelay,
+		2:  2 * firstRetryDelay,
+		3:  4 * firstRetryDelay,
+		9:  256 * firstRetryDelay,
+		10: maxRetryDelay,
+	} {
+		if got := retryDelay(attempts); got != want {
+			t.Errorf("retryDelay(%d) = %v, ожидалось %v", attempts, got, want)
+		}
+	}
+}